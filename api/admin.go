@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+)
+
+// AdminOnly wraps a handler so that only authenticated users with the admin
+// flag reach it. Others get 403, including everybody when authentication is
+// disabled.
+func AdminOnly(h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+
+		username := Username(r)
+		for _, v := range httpConfig.Authen {
+			if username != "" && v.Username == username && v.Admin {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		renderError(w, r, http.StatusForbidden, "Forbidden", "This page is reserved to administrators")
+	})
+}
+
+// PurgeTempHandler removes the temporary files of uploads which were left
+// behind, e.g. by a crash, and reports them in JSON
+func PurgeTempHandler(w http.ResponseWriter, r *http.Request) {
+	mlog := logger.New()
+
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	dirs := []string{httpConfig.FileServerDirectory}
+	if httpConfig.UploadTempDirectory != "" {
+		dirs = append(dirs, httpConfig.UploadTempDirectory)
+	}
+
+	purged, err := PurgeTemp(dirs, time.Now().Add(-httpConfig.TempFileMaxAge))
+	for _, path := range purged {
+		mlog.Info.Printf("Purge %s", path)
+	}
+	if err != nil {
+		mlog.Critical.Printf("%+v", err)
+		renderError(w, r, http.StatusInternalServerError, "Purge failed", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Count int      `json:"count"`
+		Files []string `json:"files"`
+	}{
+		Count: len(purged),
+		Files: purged,
+	})
+}
+
+// PurgeTemp removes the temporary files under dirs last modified before t,
+// which are temporary files of uploads not in progress anymore. Stored files
+// ending in .tmp are kept. It returns the paths of the removed files.
+func PurgeTemp(dirs []string, t time.Time) ([]string, error) {
+	purged := make([]string, 0)
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || !isUploadTemp(info.Name()) || !info.ModTime().Before(t) {
+				return nil
+			}
+
+			err = os.Remove(path)
+			if err == nil {
+				purged = append(purged, path)
+			}
+			return err
+		})
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPurgeTempKeepsUploads(t *testing.T) {
+	dir := makeTempDir("TestPurgeTempKeepsUploads", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("report.tmp", "content", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	// A name which would be taken for a temporary file can't be stored
+	w = httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest(tempName("report"), "content", "", t))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	purged, err := PurgeTemp([]string{dir}, time.Now().Add(time.Hour))
+	if err != nil || len(purged) != 0 {
+		t.Fatalf("expected nothing to be purged, got %v, %v", purged, err)
+	}
+	fileCount(dir, 1, t)
+}
+
+func TestPurgeTemp(t *testing.T) {
+	dir := makeTempDir("TestPurgeTemp", t)
+	defer os.RemoveAll(dir)
+	tmpDir := makeTempDir("TestPurgeTempTmp", t)
+	defer os.RemoveAll(tmpDir)
+	loadConfig(dir, fmt.Sprintf(`upload_temp_directory = %q
+temp_file_max_age = "1h"
+
+[[http.basic_authen]]
+username = "admin"
+password = "e10adc3949ba59abbe56e057f20f883e"
+admin = true
+
+[[http.basic_authen]]
+username = "user"
+password = "e10adc3949ba59abbe56e057f20f883e"`, tmpDir), t)
+
+	os.Mkdir(filepath.Join(dir, "user"), 0755)
+	old := time.Now().Add(-2 * time.Hour)
+	files := []struct {
+		path   string
+		old    bool
+		purged bool
+	}{
+		{filepath.Join(dir, tempName("a.txt")), true, true},
+		{filepath.Join(dir, "user", tempName("b.txt")), true, true},
+		{filepath.Join(dir, "user", tempName("."+nameIndexFile)), true, true},
+		{filepath.Join(tmpDir, tempName("c.txt")), true, true},
+		{filepath.Join(dir, tempName("recent.txt")), false, false},
+		// Stored files may end in .tmp
+		{filepath.Join(dir, "a.txt.tmp"), true, false},
+		{filepath.Join(dir, "a.txt.not-a-uuid.tmp"), true, false},
+		{filepath.Join(dir, "old.txt"), true, false},
+		{filepath.Join(dir, "old.tmp.txt"), true, false},
+	}
+	for _, f := range files {
+		writeFile(f.path, "content", t)
+		if f.old {
+			os.Chtimes(f.path, old, old)
+		}
+	}
+
+	h := ValidateMiddleware(AdminOnly(http.HandlerFunc(PurgeTempHandler)))
+
+	// Only admins may purge
+	r := httptest.NewRequest("POST", "/admin/purge-temp", nil)
+	r.SetBasicAuth("user", "123456")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/admin/purge-temp", nil)
+	r.SetBasicAuth("admin", "123456")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var result struct {
+		Count int      `json:"count"`
+		Files []string `json:"files"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	expected := make([]string, 0)
+	for _, f := range files {
+		_, err := os.Stat(f.path)
+		if f.purged {
+			expected = append(expected, f.path)
+			if !os.IsNotExist(err) {
+				t.Fatalf("expected %s to be purged", f.path)
+			}
+		} else if err != nil {
+			t.Fatalf("expected %s to be kept, got %v", f.path, err)
+		}
+	}
+	sort.Strings(expected)
+	sort.Strings(result.Files)
+	if result.Count != len(expected) || fmt.Sprint(result.Files) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v to be reported, got %d %v", expected, result.Count, result.Files)
+	}
+}
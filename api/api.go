@@ -1,25 +1,80 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
-	"mime/multipart"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 
+	"github.com/anhdowastaken/fileserver-go/audit"
 	"github.com/anhdowastaken/fileserver-go/configurationmanager"
 	"github.com/anhdowastaken/fileserver-go/logger"
+	templates "github.com/anhdowastaken/fileserver-go/template"
 	"github.com/anhdowastaken/fileserver-go/utilities"
 )
 
+// contextKey is the type of keys of values stored in request contexts
+type contextKey int
+
+const (
+	// usernameKey is the key of the authenticated username
+	usernameKey contextKey = iota
+)
+
+// Username returns the name of the user authenticated by ValidateMiddleware,
+// or an empty string if authentication is disabled
+func Username(r *http.Request) string {
+	username, _ := r.Context().Value(usernameKey).(string)
+	return username
+}
+
+// userDirectory returns the directory under which files of the request are
+// stored: the file server directory itself, or a directory named after the
+// authenticated user when per-user directories are enabled
+func userDirectory(r *http.Request, httpConfig configurationmanager.HTTPConfig) string {
+	return filepath.Join(httpConfig.FileServerDirectory, userPrefix(r, httpConfig))
+}
+
+// userPrefix returns the path of the directory of the user relative to the
+// file server directory
+func userPrefix(r *http.Request, httpConfig configurationmanager.HTTPConfig) string {
+	username := Username(r)
+	if !httpConfig.PerUserDirectory || username == "" {
+		return ""
+	}
+
+	return userDirectoryName(username)
+}
+
+// userDirectoryName returns the name of the directory of a user, which is
+// always a single path element
+func userDirectoryName(username string) string {
+	name := utilities.SanitizeFilename(username)
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "_", -1)
+	}
+
+	return name
+}
+
 type customResponseWriter struct {
 	http.ResponseWriter
 	status int
+	// written is the number of bytes of the body sent
+	written int64
 }
 
 func (w *customResponseWriter) WriteHeader(status int) {
@@ -32,10 +87,162 @@ func (w *customResponseWriter) Write(b []byte) (int, error) {
 		w.status = 200
 	}
 	n, err := w.ResponseWriter.Write(b)
+	atomic.AddInt64(&w.written, int64(n))
+
+	return n, err
+}
+
+// ReadFrom passes io.ReaderFrom of the wrapped writer through, so that plain
+// downloads are still sent by the operating system where possible rather than
+// copied through a buffer
+func (w *customResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{w.ResponseWriter}, src)
+	}
+	atomic.AddInt64(&w.written, n)
 
 	return n, err
 }
 
+// countingReadCloser counts the bytes read from the body of a request. The
+// count is atomic since a handler which timed out may still be reading.
+type countingReadCloser struct {
+	io.ReadCloser
+	read int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+
+	return n, err
+}
+
+// throughput formats the rate of transferring n bytes in d
+func throughput(n int64, d time.Duration) string {
+	if d <= 0 {
+		return "n/a"
+	}
+
+	return fmt.Sprintf("%.0f B/s", float64(n)/d.Seconds())
+}
+
+// wantsJSON reports whether the client prefers a JSON response over HTML
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// renderError writes an error response with the given status code. The body is
+// JSON if the client asks for it, otherwise the error template is rendered.
+func renderError(w http.ResponseWriter, r *http.Request, status int, title string, message string) {
+	renderErrorCode(w, r, status, "", title, message)
+}
+
+// renderHTTPError writes the error response of err, with the status and code
+// of an httpError, otherwise with status 500
+func renderHTTPError(w http.ResponseWriter, r *http.Request, title string, err error) {
+	status := http.StatusInternalServerError
+	code := ""
+	if e, ok := err.(httpError); ok {
+		status = e.status
+		code = e.code
+	}
+
+	renderErrorCode(w, r, status, code, title, fmt.Sprintf("%+v", err))
+}
+
+// renderErrorCode writes an error response like renderError, with code, if not
+// empty, as the machine-readable error code
+func renderErrorCode(w http.ResponseWriter, r *http.Request, status int, code string, title string, message string) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Status  int    `json:"status"`
+			Code    string `json:"code,omitempty"`
+			Title   string `json:"title"`
+			Message string `json:"message"`
+		}{
+			Status:  status,
+			Code:    code,
+			Title:   title,
+			Message: message,
+		})
+		return
+	}
+
+	tmpl := template.Must(parseTemplate("error.html"))
+	data := struct {
+		Title     string
+		Message   string
+		Code      string
+		RequestID string
+	}{
+		Title:     title,
+		Message:   message,
+		Code:      code,
+		RequestID: requestID(w),
+	}
+
+	setHTMLContentType(w)
+	w.WriteHeader(status)
+	tmpl.Execute(w, data)
+}
+
+// requestID returns the ID given by LoggingMiddleware to the request answered
+// with w, so that users can quote it when reporting an issue. It's empty if
+// the request wasn't logged.
+func requestID(w http.ResponseWriter) string {
+	return w.Header().Get("X-Request-Id")
+}
+
+// setHTMLContentType sets the Content-Type of an HTML page with the configured
+// charset, so that browsers don't have to guess it
+func setHTMLContentType(w http.ResponseWriter) {
+	cm := configurationmanager.New()
+	w.Header().Set("Content-Type", mime.FormatMediaType("text/html", map[string]string{
+		"charset": cm.GetHTTPConfig().HTMLCharset,
+	}))
+}
+
+// parseTemplate parses template file name from the template directory if it's
+// configured, otherwise from the templates embedded in the binary. Without
+// embedded templates, the default directory is template in the working
+// directory.
+func parseTemplate(name string) (*template.Template, error) {
+	cm := configurationmanager.New()
+	dir := cm.GetHTTPConfig().TemplateDirectory
+
+	if dir == "" && templates.FS != nil {
+		return template.ParseFS(templates.FS, name)
+	}
+	if dir == "" {
+		dir = "template"
+	}
+
+	return template.ParseFiles(filepath.Join(dir, name))
+}
+
+// httpError is an error which should be reported with a specific HTTP status
+// and, optionally, a code telling clients what failed
+type httpError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e httpError) Error() string {
+	return e.err.Error()
+}
+
 func authen(username string, password string) bool {
 	cm := configurationmanager.New()
 
@@ -48,7 +255,7 @@ func authen(username string, password string) bool {
 
 	for _, v := range authenList {
 		if v.Username == username {
-			if v.Password == utilities.StringToMD5String(password) {
+			if utilities.VerifyPassword(v.Password, password) {
 				return true
 			}
 		}
@@ -66,138 +273,658 @@ func ValidateMiddleware(next http.Handler) http.Handler {
 	// Bypass authentication if authen list is empty
 	if len(authenList) == 0 {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if username := clientCertUsername(r); username != "" {
+				r = r.WithContext(context.WithValue(r.Context(), usernameKey, username))
+			}
 			next.ServeHTTP(w, r)
 		})
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username := clientCertUsername(r); username != "" {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), usernameKey, username)))
+			return
+		}
+
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 		username, password, ok := r.BasicAuth()
 		if ok {
 			if !authen(username, password) {
-				http.Error(w, "Unauthorized.", 401)
+				unauthorized(w, r)
 				return
 			}
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), usernameKey, username)))
 		} else {
-			http.Error(w, "Unauthorized.", 401)
+			unauthorized(w, r)
+			return
+		}
+	})
+}
+
+// clientCertUsername returns the common name of the verified client
+// certificate of r if it's used as identity, otherwise an empty string
+func clientCertUsername(r *http.Request) string {
+	cm := configurationmanager.New()
+	if !cm.GetHTTPConfig().ClientCertIdentity || r.TLS == nil ||
+		len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// unauthorized rejects a request without valid credentials, either with plain
+// text or with a login page for browsers
+func unauthorized(w http.ResponseWriter, r *http.Request) {
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	if !httpConfig.UnauthorizedPage {
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	tmpl := template.Must(parseTemplate("unauthorized.html"))
+	setHTMLContentType(w)
+	w.WriteHeader(http.StatusUnauthorized)
+	tmpl.Execute(w, nil)
+}
+
+// TimeoutMiddleware is an HTTP middleware which answers 503 when a request
+// takes longer than the configured handler timeout. It must not wrap uploads
+// and downloads, which legitimately take long.
+func TimeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		timeout := cm.GetHTTPConfig().HandlerTimeout
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
 			return
 		}
+
+		http.TimeoutHandler(next, timeout, "Request timed out.").ServeHTTP(w, r)
 	})
 }
 
 // LoggingMiddleware is an HTTP middleware used to log all requests
 func LoggingMiddleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		mlog := logger.New()
+		mlog := logger.New().Category(logger.ACCESS)
 		id := uuid.New().String()
 		mlog.Info.Printf("--> [%s] %s \"%s %s\"", id, r.RemoteAddr, r.Method, r.URL)
 		w.Header().Set("X-Request-Id", id)
 
+		body := &countingReadCloser{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+
+		start := time.Now()
 		cw := customResponseWriter{ResponseWriter: w}
 		handler.ServeHTTP(&cw, r)
+		duration := time.Since(start)
 
 		statusCode := cw.status
 		id = cw.Header().Get("X-Request-Id")
-		mlog.Info.Printf("<-- [%s] %d %s", id, statusCode, http.StatusText(statusCode))
+		// The request line is repeated so that the line can be read without
+		// looking for the matching --> line among those of other requests
+		mlog.Info.Printf("<-- [%s] \"%s %s\" %d %s %s", id, r.Method, r.URL, statusCode, http.StatusText(statusCode), duration)
+
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+		received, sent := atomic.LoadInt64(&body.read), atomic.LoadInt64(&cw.written)
+		if httpConfig.LogThroughput && received+sent > 0 {
+			mlog.Info.Printf("Throughput [%s] received %d bytes, sent %d bytes in %s: %s",
+				id, received, sent, duration, throughput(received+sent, duration))
+		}
+
+		threshold := httpConfig.SlowRequestThreshold
+		if threshold > 0 && duration > threshold {
+			mlog.Warning.Printf("Slow request [%s] \"%s %s\" took %s", id, r.Method, r.URL.Path, duration)
+		}
 	})
 }
 
+// VersionHandler returns a handler describing the build of the server in JSON
+func VersionHandler(version string, commit string, buildDate string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Version   string `json:"version"`
+			Commit    string `json:"commit"`
+			BuildDate string `json:"build_date"`
+		}{
+			Version:   version,
+			Commit:    commit,
+			BuildDate: buildDate,
+		})
+	})
+}
+
+// ServerHeaderMiddleware is an HTTP middleware used to set the Server header
+// of all responses. Nothing is set if the header is not configured.
+func ServerHeaderMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		if serverHeader := cm.GetHTTPConfig().ServerHeader; serverHeader != "" {
+			w.Header().Set("Server", serverHeader)
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// MethodOverrideHeader is the header of POST requests naming the method they
+// stand for, for clients and proxies which can't send it
+const MethodOverrideHeader = "X-HTTP-Method-Override"
+
+// overridableMethods are the methods a POST request may stand for
+var overridableMethods = map[string]bool{
+	http.MethodDelete: true,
+	http.MethodPatch:  true,
+	http.MethodPut:    true,
+}
+
+// CustomHeadersMiddleware is an HTTP middleware which adds the configured
+// custom headers to every response. Strict-Transport-Security is only added to
+// responses over HTTPS.
+func CustomHeadersMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		for name, value := range cm.GetHTTPConfig().CustomHeaders {
+			if name == "Strict-Transport-Security" && r.TLS == nil {
+				continue
+			}
+			w.Header().Set(name, value)
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// MethodOverrideMiddleware is an HTTP middleware which changes the method of
+// POST requests to the one named by the X-HTTP-Method-Override header or by the
+// _method field of URL-encoded forms. It must wrap the router so that requests
+// are routed with their new method. Only DELETE, PATCH and PUT are allowed,
+// other values get 400.
+func MethodOverrideMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Header.Get(MethodOverrideHeader)
+		if method == "" {
+			// Multipart bodies are left unread so that uploads keep streaming
+			ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if ct == "application/x-www-form-urlencoded" && r.ParseForm() == nil {
+				method = r.PostForm.Get("_method")
+			}
+		}
+		if method == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if !overridableMethods[method] {
+			renderError(w, r, http.StatusBadRequest, "Bad request", fmt.Sprintf("Method %s can't override POST", method))
+			return
+		}
+
+		overridden := new(http.Request)
+		*overridden = *r
+		overridden.Method = method
+
+		handler.ServeHTTP(w, overridden)
+	})
+}
+
+// NotFoundHandler renders the error page of a path which has no route, with
+// 404
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	renderError(w, r, http.StatusNotFound, "Not found", fmt.Sprintf("%s does not exist", r.URL.Path))
+}
+
+// MethodNotAllowed returns a handler rejecting requests with 405 and an Allow
+// header listing the methods returned by allowed for the request
+func MethodNotAllowed(allowed func(r *http.Request) []string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods := allowed(r)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		renderError(w, r, http.StatusMethodNotAllowed, "Method not allowed",
+			fmt.Sprintf("Method %s is not allowed for %s, use %s", r.Method, r.URL.Path, strings.Join(methods, " or ")))
+	})
+}
+
+// IndexHandler renders the index page with the upload form, unless it is
+// disabled by configuration
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	cm := configurationmanager.New()
 	httpConfig := cm.GetHTTPConfig()
 
-	tmpl := template.Must(template.ParseFiles("template/index.html"))
+	if !httpConfig.IndexEnable {
+		renderError(w, r, http.StatusNotFound, "Not found", "The index page is disabled")
+		return
+	}
+
+	var tmpl *template.Template
+	if httpConfig.IndexTemplate != "" {
+		tmpl = template.Must(template.ParseFiles(httpConfig.IndexTemplate))
+	} else {
+		tmpl = template.Must(parseTemplate("index.html"))
+	}
 	data := struct {
-		MaxFileSize int
+		MaxFileSize     int
+		EnableUpload    bool
+		UploadFieldName string
 	}{
-		MaxFileSize: httpConfig.MaxFileSize,
+		MaxFileSize:     httpConfig.MaxFileSize,
+		EnableUpload:    httpConfig.EnableUpload,
+		UploadFieldName: httpConfig.UploadFieldName,
 	}
 
+	setHTMLContentType(w)
 	tmpl.Execute(w, data)
 }
 
-func UploadHandler(w http.ResponseWriter, r *http.Request) {
-	mlog := logger.New()
+// resolvePath cleans a request path and maps it to a file under dir. It returns
+// the cleaned name relative to dir and the local path. Paths can never escape
+// dir because they are cleaned as absolute paths first.
+func resolvePath(dir string, p string) (string, string) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	return name, filepath.Join(dir, filepath.FromSlash(name))
+}
 
-	var err error
-	var localFilename string
+// DeleteHandler removes a stored file together with its checksum sidecar
+func DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	mlog := logger.New()
 
-	// ParseMultipartForm parses a request body as multipart/form-data
 	cm := configurationmanager.New()
 	httpConfig := cm.GetHTTPConfig()
-	err = r.ParseMultipartForm(int64(httpConfig.MaxFileSize * 1024 * 1024))
+
+	name, localFilePath := resolvePath(userDirectory(r, httpConfig), r.URL.Path)
+	info, err := os.Stat(localFilePath)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		renderError(w, r, http.StatusNotFound, fmt.Sprintf("Delete %s failed", name), fmt.Sprintf("%s does not exist", name))
+		return
+	}
+
+	// Don't delete a file which changed since the client last saw it
+	ifMatch := r.Header.Get("If-Match")
+	if err == nil && ifMatch != "" && !matchETag(ifMatch, fileETag(localFilePath, info, httpConfig)) {
+		renderError(w, r, http.StatusPreconditionFailed, fmt.Sprintf("Delete %s failed", name), fmt.Sprintf("%s has changed", name))
+		return
+	}
+
 	if err == nil {
-		// Retrieve the file from form data
-		var file multipart.File
-		var fileHandler *multipart.FileHeader
+		err = checkImmutable(localFilePath, httpConfig)
+	}
+	if _, ok := err.(httpError); ok {
+		renderHTTPError(w, r, fmt.Sprintf("Delete %s failed", name), err)
+		return
+	}
 
-		file, fileHandler, err = r.FormFile("file")
+	mlog.Debug.Printf("Delete %s", localFilePath)
+
+	if err == nil {
+		err = os.Remove(localFilePath)
 		if err == nil {
-			defer file.Close()
+			adjustFileCount(localFilePath, -1)
+		}
+	}
+	if err == nil {
+		err = removeChecksumSidecar(localFilePath)
+	}
+	invalidateCaches(localFilePath)
+	if err != nil {
+		mlog.Critical.Printf("%+v", err)
+		renderError(w, r, http.StatusInternalServerError, fmt.Sprintf("Delete %s failed", name), fmt.Sprintf("%+v", err))
+		return
+	}
 
-			cm := configurationmanager.New()
-			httpConfig := cm.GetHTTPConfig()
-			fileServerDirectory := httpConfig.FileServerDirectory
+	if httpConfig.PruneEmptyDirectories {
+		err = pruneEmptyDirectories(filepath.Dir(localFilePath), httpConfig.FileServerDirectory)
+		if err != nil {
+			mlog.Warning.Printf("Cannot remove empty directories of %s: %+v", name, err)
+		}
+	}
 
-			newFilename := r.FormValue("filename")
-			if newFilename == "" {
-				localFilename = utilities.SanitizeFilename(fileHandler.Filename)
-			} else {
-				localFilename = utilities.SanitizeFilename(newFilename)
-			}
-			localFilePath := filepath.Join(fileServerDirectory, localFilename)
+	err = audit.New().Log(audit.Record{
+		User:     Username(r),
+		Action:   audit.DELETE,
+		Filename: name,
+		Size:     info.Size(),
+	})
+	if err != nil {
+		mlog.Critical.Printf("Cannot record delete of %s in audit log: %+v", name, err)
+	}
 
-			localFilenameTmp := fmt.Sprintf("%s.tmp", localFilename)
-			localFilePathTmp := filepath.Join(fileServerDirectory, localFilenameTmp)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-			mlog.Debug.Printf("Save %s", localFilePath)
+// pruneEmptyDirectories removes dir and its parents as long as they are empty,
+// stopping at root which is never removed
+func pruneEmptyDirectories(dir string, root string) error {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return nil
+		}
 
-			var f *os.File
-			f, err = os.Create(localFilePathTmp)
-			if err == nil {
-				defer f.Close()
+		err = os.Remove(dir)
+		if err != nil {
+			return err
+		}
+	}
 
-				_, err = io.Copy(f, file)
-				if err == nil {
-					err = os.Rename(localFilePathTmp, localFilePath)
-				}
+	return nil
+}
+
+// checkImmutable verifies that the file at path, if it exists, was uploaded
+// longer than the immutable period ago, so it may be replaced or deleted
+func checkImmutable(path string, httpConfig configurationmanager.HTTPConfig) error {
+	if httpConfig.ImmutablePeriod <= 0 {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	until := info.ModTime().Add(httpConfig.ImmutablePeriod)
+	if time.Now().Before(until) {
+		return httpError{
+			status: http.StatusConflict,
+			code:   codeImmutable,
+			err:    fmt.Errorf("%s can't be changed until %s", filepath.Base(path), until.UTC().Format(http.TimeFormat)),
+		}
+	}
+
+	return nil
+}
+
+// UserScope wraps a file server rooted at the file server directory so that
+// authenticated users only reach their own directory when per-user directories
+// are enabled
+func UserScope(h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+
+		username := Username(r)
+		if !httpConfig.PerUserDirectory || username == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		scoped := new(http.Request)
+		*scoped = *r
+		scoped.URL = new(url.URL)
+		*scoped.URL = *r.URL
+		scoped.URL.Path = userDirectoryName(username) + "/" + strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+		h.ServeHTTP(w, scoped)
+	})
+}
+
+// MissingFile wraps a file server rooted at dir so that requests for files
+// which do not exist get the error page with a 404 status instead of the plain
+// text response of http.FileServer
+func MissingFile(dir string, h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, localPath := resolvePath(dir, r.URL.Path)
+		_, err := os.Stat(localPath)
+		if os.IsNotExist(err) {
+			renderError(w, r, http.StatusNotFound, fmt.Sprintf("Download %s failed", name), fmt.Sprintf("%s does not exist", name))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// FileServer serves the files under dir. Unlike http.FileServer, it never
+// follows symlinks out of dir, and directories are never served: requests for
+// them get a plain 404 instead of a listing or a redirect.
+func FileServer(dir string) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, localPath := resolvePath(dir, r.URL.Path)
+		if !confined(dir, localPath) {
+			renderError(w, r, http.StatusNotFound, fmt.Sprintf("Download %s failed", name), fmt.Sprintf("%s does not exist", name))
+			return
+		}
+
+		f, err := os.Open(localPath)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil || info.IsDir() || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		// http.ServeContent keeps a Content-Type which is already set
+		contentType, ok := contentTypeOverride(info.Name())
+		if ok {
+			w.Header().Set("Content-Type", contentType)
+		} else {
+			contentType = mime.TypeByExtension(filepath.Ext(info.Name()))
+		}
+		if contentType == "" {
+			// Sniffed like http.ServeContent would
+			head := make([]byte, 512)
+			n, _ := io.ReadFull(f, head)
+			contentType = http.DetectContentType(head[:n])
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				http.Error(w, "Cannot read file.", http.StatusInternalServerError)
+				return
 			}
 		}
+		protectDownload(w, info.Name(), contentType)
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	})
+}
+
+// contentTypeOverride returns the configured Content-Type of files named name,
+// if any
+func contentTypeOverride(name string) (string, bool) {
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	contentType, ok := httpConfig.ContentTypes[strings.ToLower(filepath.Ext(name))]
+	return contentType, ok
+}
+
+// activeContentTypes are the types which browsers render with scripts running
+// in the origin of the server
+var activeContentTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+	"text/xml":              true,
+	"application/xml":       true,
+}
+
+// protectDownload sets the headers keeping browsers from running scripts of a
+// downloaded file named name of type contentType, unless safe_downloads is
+// disabled: its type isn't sniffed, and it's downloaded rather than rendered if
+// its type is active. Otherwise an uploaded HTML file could steal the
+// credentials of other users of the server.
+func protectDownload(w http.ResponseWriter, name string, contentType string) {
+	cm := configurationmanager.New()
+	if !cm.GetHTTPConfig().SafeDownloads {
+		return
 	}
 
-	var tmpl *template.Template
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if activeContentTypes[mediaType] {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+}
+
+// confined reports whether the file at localPath, once symlinks are resolved,
+// is still under dir
+func confined(dir string, localPath string) bool {
+	root, err := filepath.EvalSymlinks(dir)
 	if err != nil {
-		mlog.Critical.Printf("%+v", err)
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(localPath)
+	if err != nil {
+		return false
+	}
 
-		tmpl = template.Must(template.ParseFiles("template/error.html"))
-		data := struct {
-			Filename string
-			Message  string
-		}{
-			Filename: localFilename,
-			Message:  fmt.Sprintf("%+v", err),
+	return resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator))
+}
+
+// ETag wraps a file server rooted at dir so that files are served with a strong
+// ETag, see fileETag. http.ServeContent compares it with If-Range, so a client
+// resuming a download of a file which changed since gets the whole new file
+// instead of a part of it.
+func ETag(dir string, h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+
+		_, localPath := resolvePath(dir, r.URL.Path)
+		info, err := os.Stat(localPath)
+		if err == nil && info.Mode().IsRegular() && confined(dir, localPath) {
+			w.Header().Set("ETag", fileETag(localPath, info, httpConfig))
 		}
+		h.ServeHTTP(w, r)
+	})
+}
 
-		tmpl.Execute(w, data)
-	} else {
-		tmpl = template.Must(template.ParseFiles("template/success.html"))
-		data := struct {
-			Filename string
-		}{
-			Filename: localFilename,
+// fileETag returns the strong ETag of the file at path, described by info. It's
+// made of the modification time and size of the file, or of the hash of its
+// content if etag_strategy is content, in which case a file rewritten with the
+// same content keeps its ETag.
+func fileETag(path string, info os.FileInfo, httpConfig configurationmanager.HTTPConfig) string {
+	if httpConfig.ETagStrategy == configurationmanager.ETagContent {
+		etag, err := contentETag(path, info, httpConfig)
+		if err == nil {
+			return etag
 		}
+		logger.New().Warning.Printf("Cannot hash %s for its ETag: %+v", path, err)
+	}
+
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
 
-		tmpl.Execute(w, data)
+// matchETag reports whether the If-Match header value ifMatch matches etag.
+// Weak tags never match because If-Match uses the strong comparison.
+func matchETag(ifMatch string, etag string) bool {
+	for _, v := range strings.Split(ifMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || v == etag {
+			return true
+		}
 	}
+	return false
 }
 
-func NoDirListing(h http.Handler) http.HandlerFunc {
+// DecryptFileServer serves files under dir which were encrypted on upload,
+// decrypting them on the fly. It replaces http.FileServer when encryption is
+// enabled, so directories are never served and Range requests are ignored.
+func DecryptFileServer(dir string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, "/") {
+		mlog := logger.New()
+
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+
+		_, localPath := resolvePath(dir, r.URL.Path)
+		if !confined(dir, localPath) {
+			http.NotFound(w, r)
+			return
+		}
+
+		f, err := os.Open(localPath)
+		if err != nil {
 			http.NotFound(w, r)
 			return
 		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil || info.IsDir() || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		dr, err := utilities.NewDecryptReader(f, httpConfig.EncryptionKey)
+		if err != nil {
+			mlog.Critical.Printf("Cannot decrypt %s: %+v", localPath, err)
+			http.Error(w, "Cannot decrypt file.", http.StatusInternalServerError)
+			return
+		}
+
+		contentType, ok := contentTypeOverride(localPath)
+		if !ok {
+			contentType = mime.TypeByExtension(filepath.Ext(localPath))
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		protectDownload(w, info.Name(), contentType)
+
+		_, err = copyBuffer(w, dr, httpConfig.CopyBufferSize)
+		if err != nil {
+			// The status is already sent, so abort the connection to let the
+			// client know the content is incomplete
+			mlog.Critical.Printf("Cannot decrypt %s: %+v", localPath, err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// NoDirListing wraps a file server rooted at dir so that directories are never
+// exposed. Requests for a directory, with or without a trailing slash, get a
+// plain 404 instead of a listing, a redirect or the directory's index.html.
+// index.html files requested explicitly are served directly because
+// http.FileServer would redirect them to their directory.
+func NoDirListing(dir string, h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		_, localPath := resolvePath(dir, r.URL.Path)
+		info, err := os.Stat(localPath)
+		if err == nil && info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err == nil && path.Base(r.URL.Path) == "index.html" {
+			f, err := os.Open(localPath)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			defer f.Close()
+
+			http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+			return
+		}
+
 		h.ServeHTTP(w, r)
 	})
 }
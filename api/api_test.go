@@ -0,0 +1,1275 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/anhdowastaken/fileserver-go/audit"
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+	templates "github.com/anhdowastaken/fileserver-go/template"
+)
+
+// TestMain runs tests from the root of the repository so that templates can
+// be found at the same relative paths as in a deployed instance
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestMissingFileHTML(t *testing.T) {
+	dir := makeTempDir("TestMissingFileHTML", t)
+	defer os.RemoveAll(dir)
+
+	h := MissingFile(dir, http.FileServer(http.Dir(dir)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/missing.txt", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "missing.txt does not exist") {
+		t.Fatalf("expected error page, got %q", w.Body.String())
+	}
+}
+
+func TestMissingFileJSON(t *testing.T) {
+	dir := makeTempDir("TestMissingFileJSON", t)
+	defer os.RemoveAll(dir)
+
+	h := MissingFile(dir, http.FileServer(http.Dir(dir)))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/missing.txt", nil)
+	r.Header.Set("Accept", "application/json")
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected JSON response, got %q", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), `"message":"missing.txt does not exist"`) {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+}
+
+func TestMissingFileExisting(t *testing.T) {
+	dir := makeTempDir("TestMissingFileExisting", t)
+	defer os.RemoveAll(dir)
+	writeFile(filepath.Join(dir, "exists.txt"), "hello", t)
+
+	h := MissingFile(dir, http.FileServer(http.Dir(dir)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/exists.txt", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("expected file content, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestUploadLocation(t *testing.T) {
+	dir := makeTempDir("TestUploadLocation", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("my report.txt", "hello", "", t))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "/download/my_report.txt" {
+		t.Fatalf("unexpected Location %q", loc)
+	}
+	if !strings.Contains(w.Body.String(), "successfully") {
+		t.Fatalf("expected success page, got %q", w.Body.String())
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "my_report.txt"))
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("uploaded file not stored: %v %q", err, b)
+	}
+}
+
+func TestUploadFilenameTooLong(t *testing.T) {
+	dir := makeTempDir("TestUploadFilenameTooLong", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	// 128 two-byte characters: well under 255 characters but over 255 bytes
+	name := strings.Repeat("é", 128) + ".txt"
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest(name, "hello", "", t))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	fileCount(dir, 0, t)
+}
+
+func TestUploadFilenameTruncated(t *testing.T) {
+	dir := makeTempDir("TestUploadFilenameTruncated", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "truncate_filename = true", t)
+
+	name := strings.Repeat("é", 128) + ".txt"
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest(name, "hello", "", t))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	expected := strings.Repeat("é", 125) + ".txt"
+	b, err := ioutil.ReadFile(filepath.Join(dir, expected))
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("truncated file not stored: %v %q", err, b)
+	}
+}
+
+func TestDeleteMissing(t *testing.T) {
+	dir := makeTempDir("TestDeleteMissing", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	for _, p := range []string{"/missing.txt", "/", "/../../etc/passwd"} {
+		r := httptest.NewRequest("DELETE", "/", nil)
+		r.URL.Path = p
+		w := httptest.NewRecorder()
+		DeleteHandler(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusNotFound, p, w.Code)
+		}
+	}
+}
+
+func TestUnauthorizedPage(t *testing.T) {
+	dir := makeTempDir("TestUnauthorizedPage", t)
+	defer os.RemoveAll(dir)
+
+	for _, page := range []bool{false, true} {
+		loadConfig(dir, fmt.Sprintf(`unauthorized_page = %t
+
+[[http.basic_authen]]
+username = "admin"
+password = "e10adc3949ba59abbe56e057f20f883e"`, page), t)
+
+		h := ValidateMiddleware(http.HandlerFunc(IndexHandler))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("expected WWW-Authenticate header")
+		}
+		html := strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") &&
+			strings.Contains(w.Body.String(), "Login required")
+		if html != page {
+			t.Fatalf("unauthorized_page = %t: unexpected response %q", page, w.Body.String())
+		}
+	}
+}
+
+func TestEmbeddedTemplates(t *testing.T) {
+	if templates.FS == nil {
+		t.Skip("templates are not embedded")
+	}
+
+	dir := makeTempDir("TestEmbeddedTemplates", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	// Templates can't be read from disk anymore
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	w := httptest.NewRecorder()
+	renderError(w, httptest.NewRequest("GET", "/", nil), http.StatusNotFound, "Not found", "missing.txt does not exist")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "<h4>Not found</h4>") {
+		t.Fatalf("expected embedded error page, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<form") {
+		t.Fatalf("expected embedded index page, got %d %q", w.Code, w.Body.String())
+	}
+
+	// A configured directory takes precedence
+	writeFile(filepath.Join(dir, "error.html"), "custom {{.Title}}", t)
+	loadConfig(dir, fmt.Sprintf("template_directory = %q", dir), t)
+	w = httptest.NewRecorder()
+	renderError(w, httptest.NewRequest("GET", "/", nil), http.StatusNotFound, "Not found", "")
+	if w.Body.String() != "custom Not found" {
+		t.Fatalf("expected custom error page, got %q", w.Body.String())
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	VersionHandler("1.2.0", "0123abc", "2019-06-01T10:00:00Z").ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+
+	var v map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	expected := map[string]string{"version": "1.2.0", "commit": "0123abc", "build_date": "2019-06-01T10:00:00Z"}
+	if fmt.Sprint(v) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, v)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	dir := makeTempDir("TestTimeoutMiddleware", t)
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	defer close(release)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("done"))
+	})
+	fast := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	})
+
+	loadConfig(dir, `handler_timeout = "50ms"`, t)
+	w := httptest.NewRecorder()
+	TimeoutMiddleware(slow).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "Request timed out." {
+		t.Fatalf("expected timeout response, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	TimeoutMiddleware(fast).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "done" {
+		t.Fatalf("expected fast handler to complete, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	dir := makeTempDir("TestDeleteIfMatch", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	path := filepath.Join(dir, "a.txt")
+	del := func(ifMatch string) int {
+		r := httptest.NewRequest("DELETE", "/", nil)
+		r.URL.Path = "a.txt"
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		DeleteHandler(w, r)
+		return w.Code
+	}
+
+	writeFile(path, "content", t)
+	info, _ := os.Stat(path)
+	etag := fileETag(path, info, configurationmanager.New().GetHTTPConfig())
+
+	// Stale and weak validators
+	for _, v := range []string{`"0-0"`, "W/" + etag} {
+		if code := del(v); code != http.StatusPreconditionFailed {
+			t.Fatalf("expected status %d for If-Match %s, got %d", http.StatusPreconditionFailed, v, code)
+		}
+	}
+	fileCount(dir, 1, t)
+
+	// Matching validator, among others
+	if code := del(`"0-0", ` + etag); code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, code)
+	}
+	fileCount(dir, 0, t)
+
+	// No precondition
+	writeFile(path, "content", t)
+	if code := del(""); code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, code)
+	}
+	fileCount(dir, 0, t)
+}
+
+func TestPruneEmptyDirectories(t *testing.T) {
+	dir := makeTempDir("TestPruneEmptyDirectories", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "prune_empty_directories = true", t)
+
+	del := func(p string) {
+		r := httptest.NewRequest("DELETE", "/", nil)
+		r.URL.Path = p
+		w := httptest.NewRecorder()
+		DeleteHandler(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusNoContent, p, w.Code)
+		}
+	}
+
+	os.MkdirAll(filepath.Join(dir, "a", "b", "c"), 0755)
+	writeFile(filepath.Join(dir, "a", "b", "c", "1.txt"), "1", t)
+	writeFile(filepath.Join(dir, "a", "b", "c", "2.txt"), "2", t)
+	writeFile(filepath.Join(dir, "a", "3.txt"), "3", t)
+
+	// The directory still has a file
+	del("a/b/c/1.txt")
+	if _, err := os.Stat(filepath.Join(dir, "a", "b", "c")); err != nil {
+		t.Fatalf("expected a/b/c to be kept: %v", err)
+	}
+
+	// The directory and its parent become empty, but not a
+	del("a/b/c/2.txt")
+	if _, err := os.Stat(filepath.Join(dir, "a", "b")); !os.IsNotExist(err) {
+		t.Fatalf("expected a/b to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "3.txt")); err != nil {
+		t.Fatalf("expected a/3.txt to be kept: %v", err)
+	}
+
+	// The serve directory itself is never removed
+	del("a/3.txt")
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Fatalf("expected a to be removed")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("expected %s to be kept: %v", dir, err)
+	}
+}
+
+func TestKeepEmptyDirectories(t *testing.T) {
+	dir := makeTempDir("TestKeepEmptyDirectories", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	writeFile(filepath.Join(dir, "a", "b", "1.txt"), "1", t)
+
+	r := httptest.NewRequest("DELETE", "/", nil)
+	r.URL.Path = "a/b/1.txt"
+	w := httptest.NewRecorder()
+	DeleteHandler(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "b")); err != nil {
+		t.Fatalf("expected a/b to be kept: %v", err)
+	}
+}
+
+func TestImmutablePeriod(t *testing.T) {
+	dir := makeTempDir("TestImmutablePeriod", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `immutable_period = "1h"`, t)
+
+	path := filepath.Join(dir, "a.txt")
+	upload := func() int {
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest("a.txt", "new content", "", t))
+		return w.Code
+	}
+	del := func() int {
+		r := httptest.NewRequest("DELETE", "/", nil)
+		r.URL.Path = "a.txt"
+		w := httptest.NewRecorder()
+		DeleteHandler(w, r)
+		return w.Code
+	}
+
+	// Within the period
+	if code := upload(); code != http.StatusCreated {
+		t.Fatalf("expected first upload to succeed, got %d", code)
+	}
+	if code := upload(); code != http.StatusConflict {
+		t.Fatalf("expected status %d for upload, got %d", http.StatusConflict, code)
+	}
+	if code := del(); code != http.StatusConflict {
+		t.Fatalf("expected status %d for delete, got %d", http.StatusConflict, code)
+	}
+	fileCount(dir, 1, t)
+
+	// After the period
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path, past, past)
+	if code := upload(); code != http.StatusCreated {
+		t.Fatalf("expected upload after the period to succeed, got %d", code)
+	}
+	os.Chtimes(path, past, past)
+	if code := del(); code != http.StatusNoContent {
+		t.Fatalf("expected delete after the period to succeed, got %d", code)
+	}
+	fileCount(dir, 0, t)
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := makeTempDir("TestAuditLog", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	buf := &bytes.Buffer{}
+	audit.New().SetStream(buf)
+	defer audit.New().SetStream(ioutil.Discard)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("a.txt", "content", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	r := httptest.NewRequest("DELETE", "/", nil)
+	r.URL.Path = "a.txt"
+	w = httptest.NewRecorder()
+	DeleteHandler(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in audit log, got %q", buf.String())
+	}
+
+	expected := []audit.Record{
+		{Action: audit.UPLOAD, Filename: "a.txt", Size: 7,
+			SHA256: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"},
+		{Action: audit.DELETE, Filename: "a.txt", Size: 7},
+	}
+	for i, line := range lines {
+		var record audit.Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %q is not valid JSON: %v", line, err)
+		}
+		if record.Time.IsZero() {
+			t.Fatalf("expected time in %q", line)
+		}
+		record.Time = time.Time{}
+		if record != expected[i] {
+			t.Fatalf("expected record %+v, got %+v", expected[i], record)
+		}
+	}
+}
+
+func TestETagIfRange(t *testing.T) {
+	dir := makeTempDir("TestETagIfRange", t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+	writeFile(path, "0123456789", t)
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, modTime, modTime)
+
+	h := ETag(dir, http.FileServer(http.Dir(dir)))
+	get := func(ifRange string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/a.txt", nil)
+		r.Header.Set("Range", "bytes=0-3")
+		if ifRange != "" {
+			r.Header.Set("If-Range", ifRange)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(etag, "\"") {
+		t.Fatalf("expected partial content with a strong ETag, got %d and %q", w.Code, etag)
+	}
+
+	// Validators match
+	lastModified := modTime.UTC().Format(http.TimeFormat)
+	for _, v := range []string{etag, lastModified} {
+		w = get(v)
+		if w.Code != http.StatusPartialContent || w.Body.String() != "0123" {
+			t.Fatalf("expected partial content for If-Range %s, got %d %q", v, w.Code, w.Body.String())
+		}
+	}
+
+	// The file changes between requests
+	writeFile(path, "abcdefghijk", t)
+	for _, v := range []string{etag, lastModified} {
+		w = get(v)
+		if w.Code != http.StatusOK || w.Body.String() != "abcdefghijk" {
+			t.Fatalf("expected whole file for stale If-Range %s, got %d %q", v, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestETagStrategy(t *testing.T) {
+	dir := makeTempDir("TestETagStrategy", t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.txt")
+
+	h := ETag(dir, MissingFile(dir, FileServer(dir)))
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/a.txt", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	// rewrite writes content to the file with a new modification time
+	modTime := time.Now().Add(-time.Hour)
+	rewrite := func(content string) {
+		writeFile(path, content, t)
+		modTime = modTime.Add(time.Second)
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	for _, strategy := range []string{configurationmanager.ETagModTime, configurationmanager.ETagContent} {
+		loadConfig(dir, fmt.Sprintf("etag_strategy = %q", strategy), t)
+
+		rewrite("content")
+		etag := get("").Header().Get("ETag")
+
+		// Rewritten with the same content, the file is only the same to
+		// content ETags
+		rewrite("content")
+		w := get(etag)
+		if same := w.Code == http.StatusNotModified; same != (strategy == configurationmanager.ETagContent) {
+			t.Errorf("%s: unexpected status %d for identical content", strategy, w.Code)
+		}
+
+		// Other content of the same size changes both
+		rewrite("CONTENT")
+		if w := get(etag); w.Code != http.StatusOK || w.Body.String() != "CONTENT" || w.Header().Get("ETag") == etag {
+			t.Errorf("%s: unexpected response %d %q with ETag %s", strategy, w.Code, w.Body.String(), w.Header().Get("ETag"))
+		}
+	}
+
+	// Content ETags are the hash of the content
+	expected := fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256([]byte("CONTENT"))))
+	if etag := get("").Header().Get("ETag"); etag != expected {
+		t.Errorf("unexpected content ETag %s", etag)
+	}
+}
+
+func TestMultiRange(t *testing.T) {
+	dir := makeTempDir("TestMultiRange", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+	writeFile(filepath.Join(dir, "a.txt"), "0123456789abcdefghij", t)
+
+	h := ETag(dir, MissingFile(dir, FileServer(dir)))
+	get := func(ranges string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/a.txt", nil)
+		r.Header.Set("Range", ranges)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("bytes=0-3,10-12,-2")
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected multipart partial content, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	expected := []struct {
+		contentRange string
+		body         string
+	}{
+		{"bytes 0-3/20", "0123"},
+		{"bytes 10-12/20", "abc"},
+		{"bytes 18-19/20", "ij"},
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, e := range expected {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("cannot read part %s: %v", e.contentRange, err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if part.Header.Get("Content-Range") != e.contentRange || string(body) != e.body ||
+			!strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain") {
+			t.Fatalf("expected part %s %q, got %s %q", e.contentRange, e.body, part.Header.Get("Content-Range"), body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("expected %d parts", len(expected))
+	}
+
+	// Unsatisfiable ranges are dropped
+	w = get("bytes=0-3,100-200")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "0123" || w.Header().Get("Content-Range") != "bytes 0-3/20" {
+		t.Fatalf("expected single range, got %d %q", w.Code, w.Body.String())
+	}
+	w = get("bytes=100-200,300-400")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected status %d, got %d", http.StatusRequestedRangeNotSatisfiable, w.Code)
+	}
+
+	// Ranges covering more than the file get the whole file instead
+	w = get("bytes=0-15,5-19")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789abcdefghij" {
+		t.Fatalf("expected whole file, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestFileServerSymlinks(t *testing.T) {
+	dir := makeTempDir("TestFileServerSymlinks", t)
+	defer os.RemoveAll(dir)
+	outside := makeTempDir("TestFileServerSymlinksOutside", t)
+	defer os.RemoveAll(outside)
+	loadConfig(dir, "", t)
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeFile(filepath.Join(dir, "sub", "a.txt"), "inside", t)
+	writeFile(filepath.Join(outside, "secret.txt"), "leaked", t)
+	for link, target := range map[string]string{
+		"inside.txt":   filepath.Join("sub", "a.txt"),
+		"insidedir":    "sub",
+		"outside.txt":  filepath.Join(outside, "secret.txt"),
+		"relative.txt": filepath.Join("..", filepath.Base(outside), "secret.txt"),
+		"outsidedir":   outside,
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := ETag(dir, MissingFile(dir, FileServer(dir)))
+	for p, expected := range map[string]string{
+		"/sub/a.txt":             "inside",
+		"/inside.txt":            "inside",
+		"/insidedir/a.txt":       "inside",
+		"/outside.txt":           "",
+		"/relative.txt":          "",
+		"/outsidedir/secret.txt": "",
+		"/sub":                   "",
+		"/sub/":                  "",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if expected == "" {
+			if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "leaked") || w.Header().Get("ETag") != "" {
+				t.Fatalf("expected status %d for %s, got %d %q", http.StatusNotFound, p, w.Code, w.Body.String())
+			}
+			continue
+		}
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Fatalf("expected %q for %s, got %d %q", expected, p, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSafeDownloads(t *testing.T) {
+	dir := makeTempDir("TestSafeDownloads", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	page := "<html><script>alert(document.cookie)</script></html>"
+	for name, content := range map[string]string{"page.html": page, "page": page, "image.svg": "<svg></svg>", "notes.txt": "notes"} {
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(name, content, "", t))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: expected status %d, got %d", name, http.StatusCreated, w.Code)
+		}
+	}
+
+	download := func(name string) http.Header {
+		w := httptest.NewRecorder()
+		FileServer(dir).ServeHTTP(w, httptest.NewRequest("GET", "/"+name, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", name, http.StatusOK, w.Code)
+		}
+		return w.Header()
+	}
+	for name, disposition := range map[string]string{
+		"page.html": "attachment; filename=page.html",
+		// Sniffed as HTML
+		"page":      "attachment; filename=page",
+		"image.svg": "attachment; filename=image.svg",
+		"notes.txt": "",
+	} {
+		header := download(name)
+		if header.Get("X-Content-Type-Options") != "nosniff" || header.Get("Content-Disposition") != disposition {
+			t.Errorf("%s: expected nosniff and Content-Disposition %q, got %v", name, disposition, header)
+		}
+	}
+
+	loadConfig(dir, "safe_downloads = false", t)
+	header := download("page.html")
+	if header.Get("X-Content-Type-Options") != "" || header.Get("Content-Disposition") != "" {
+		t.Errorf("unexpected protective headers %v", header)
+	}
+
+	// Decrypted files are protected too
+	encrypted := makeTempDir("TestSafeDownloadsEncrypted", t)
+	defer os.RemoveAll(encrypted)
+	loadConfig(encrypted, `encryption = true
+encryption_key = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"`, t)
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("page.html", page, "", t))
+	w = httptest.NewRecorder()
+	DecryptFileServer(encrypted).ServeHTTP(w, httptest.NewRequest("GET", "/page.html", nil))
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Content-Disposition") != "attachment; filename=page.html" {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	dir := makeTempDir("TestContentTypes", t)
+	defer os.RemoveAll(dir)
+	types := `[http.content_types]
+"WASM" = "application/wasm"
+".avif" = "image/avif"`
+	loadConfig(dir, types, t)
+
+	expected := map[string]string{
+		"a.wasm":    "application/wasm",
+		"b.AVIF":    "image/avif",
+		"c.txt":     "text/plain; charset=utf-8",
+		"d.unknown": "text/plain; charset=utf-8",
+	}
+	for name := range expected {
+		writeFile(filepath.Join(dir, name), "content", t)
+	}
+	for name, contentType := range expected {
+		w := httptest.NewRecorder()
+		FileServer(dir).ServeHTTP(w, httptest.NewRequest("GET", "/"+name, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Errorf("%s: expected Content-Type %q, got %d %q", name, contentType, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+
+	// Decrypted files get the configured type too
+	encrypted := makeTempDir("TestContentTypesEncrypted", t)
+	defer os.RemoveAll(encrypted)
+	loadConfig(encrypted, `encryption = true
+encryption_key = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+`+types, t)
+	for name, contentType := range map[string]string{"a.wasm": "application/wasm", "c.txt": "text/plain; charset=utf-8"} {
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(name, "content", "", t))
+		w = httptest.NewRecorder()
+		DecryptFileServer(encrypted).ServeHTTP(w, httptest.NewRequest("GET", "/"+name, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Errorf("%s: expected Content-Type %q, got %d %q", name, contentType, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestNoDirListing(t *testing.T) {
+	dir := makeTempDir("TestNoDirListing", t)
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeFile(filepath.Join(dir, "sub", "index.html"), "<html></html>", t)
+	writeFile(filepath.Join(dir, "sub", "foo.txt"), "foo", t)
+
+	h := NoDirListing(dir, http.FileServer(http.Dir(dir)))
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"", http.StatusNotFound, ""},
+		{"sub", http.StatusNotFound, ""},
+		{"sub/", http.StatusNotFound, ""},
+		{"sub/./", http.StatusNotFound, ""},
+		{"sub/index.html", http.StatusOK, "<html></html>"},
+		{"sub/foo.txt", http.StatusOK, "foo"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = test.path
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Fatalf("expected status %d for %q, got %d", test.status, test.path, w.Code)
+		}
+		if w.Header().Get("Location") != "" {
+			t.Fatalf("unexpected redirect for %q to %s", test.path, w.Header().Get("Location"))
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Fatalf("expected body %q for %q, got %q", test.body, test.path, w.Body.String())
+		}
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	dir := makeTempDir("TestEncryptionRoundTrip", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `encryption = true
+encryption_key = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"`, t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("secret.txt", "top secret", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "secret.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("top secret")) {
+		t.Fatal("file is stored in plaintext")
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.URL.Path = "secret.txt"
+	DecryptFileServer(dir).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "top secret" {
+		t.Fatalf("expected decrypted content, got %d %q", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected Content-Type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestIndexEnabled(t *testing.T) {
+	loadConfig("/tmp", "max_file_size = 42", t)
+
+	w := httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Maximum size is 42MB") {
+		t.Fatalf("expected index page, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestIndexUploadDisabled(t *testing.T) {
+	loadConfig("/tmp", "enable_upload = false", t)
+
+	w := httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "<form") {
+		t.Fatalf("expected index page without upload form, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestIndexDisabled(t *testing.T) {
+	loadConfig("/tmp", "index_enable = false", t)
+
+	w := httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestIndexCustomTemplate(t *testing.T) {
+	dir := makeTempDir("TestIndexCustomTemplate", t)
+	defer os.RemoveAll(dir)
+	custom := filepath.Join(dir, "custom.html")
+	writeFile(custom, "custom index {{.MaxFileSize}}", t)
+	loadConfig(dir, fmt.Sprintf("index_template = %q", custom), t)
+
+	w := httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "custom index 10" {
+		t.Fatalf("expected custom index page, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSlowRequestWarning(t *testing.T) {
+	loadConfig("/tmp", `slow_request_threshold = "10ms"`, t)
+	buf := captureLog(logger.WARNING)
+	defer restoreLog()
+
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	})
+	LoggingMiddleware(slow).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	if !strings.Contains(buf.String(), `Slow request`) || !strings.Contains(buf.String(), `"GET /slow" took`) {
+		t.Fatalf("expected slow request warning, got %q", buf.String())
+	}
+
+	buf.Reset()
+	fast := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	LoggingMiddleware(fast).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	if strings.Contains(buf.String(), "Slow request") {
+		t.Fatalf("unexpected slow request warning %q", buf.String())
+	}
+}
+
+func TestAccessLogExitLine(t *testing.T) {
+	loadConfig("/tmp", "", t)
+	buf := captureLog(logger.INFO)
+	defer restoreLog()
+
+	h := LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/download/a%20b.txt?x=1", nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	exit := lines[len(lines)-1]
+	expected := fmt.Sprintf(`<-- [%s] "DELETE /download/a%%20b.txt?x=1" 204 No Content`, w.Header().Get("X-Request-Id"))
+	if !strings.Contains(exit, expected) {
+		t.Fatalf("expected exit line with %q, got %q", expected, exit)
+	}
+}
+
+func TestPagesRequestID(t *testing.T) {
+	dir := makeTempDir("TestPagesRequestID", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	h := LoggingMiddleware(http.HandlerFunc(UploadHandler))
+	for _, r := range []*http.Request{
+		newUploadRequest("a.txt", "alpha", "", t),
+		// The form has no file
+		httptest.NewRequest("POST", "/upload", strings.NewReader("")),
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		id := w.Header().Get("X-Request-Id")
+		if id == "" || !strings.Contains(w.Body.String(), "Request ID: <code>"+id+"</code>") {
+			t.Errorf("expected page %d with request ID %q, got %q", w.Code, id, w.Body.String())
+		}
+	}
+
+	// Pages of requests which aren't logged have no request ID
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("a.txt", "alpha", "", t))
+	if strings.Contains(w.Body.String(), "Request ID") {
+		t.Errorf("unexpected request ID in %q", w.Body.String())
+	}
+}
+
+func TestThroughputLog(t *testing.T) {
+	h := LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	send := func() string {
+		buf := captureLog(logger.INFO)
+		defer restoreLog()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("x", 1000))))
+		return buf.String()
+	}
+
+	loadConfig("/tmp", "log_throughput = true", t)
+	if log := send(); !strings.Contains(log, "received 1000 bytes, sent 100 bytes in ") || !strings.Contains(log, " B/s") {
+		t.Fatalf("expected throughput in log, got %q", log)
+	}
+
+	loadConfig("/tmp", "", t)
+	if log := send(); strings.Contains(log, "Throughput") {
+		t.Fatalf("unexpected throughput in log %q", log)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	if rate := throughput(1000, 0); rate != "n/a" {
+		t.Fatalf("expected no rate for zero duration, got %q", rate)
+	}
+	if rate := throughput(1000, 500*time.Millisecond); rate != "2000 B/s" {
+		t.Fatalf("expected 2000 B/s, got %q", rate)
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	h := ServerHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	loadConfig("/tmp", `server_header = "my-server"`, t)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("Server") != "my-server" {
+		t.Fatalf("expected Server header, got %q", w.Header().Get("Server"))
+	}
+
+	loadConfig("/tmp", `server_header = ""`, t)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if _, ok := w.Header()["Server"]; ok {
+		t.Fatalf("expected no Server header, got %q", w.Header().Get("Server"))
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	h := CustomHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+	}))
+	loadConfig("/tmp", `[http.custom_headers]
+"x-content-type-options" = "nosniff"
+"Content-Security-Policy" = "default-src 'self'"
+"Strict-Transport-Security" = "max-age=31536000"
+"Content-Type" = "text/html"`, t)
+
+	for _, https := range []bool{false, true} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if https {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		expected := map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"Content-Security-Policy": "default-src 'self'",
+			// The handler has the last word
+			"Content-Type": "text/plain",
+		}
+		if https {
+			expected["Strict-Transport-Security"] = "max-age=31536000"
+		}
+		if len(w.Header()) != len(expected) {
+			t.Errorf("https %t: unexpected headers %v", https, w.Header())
+		}
+		for name, value := range expected {
+			if w.Header().Get(name) != value {
+				t.Errorf("https %t: expected %s %q, got %q", https, name, value, w.Header().Get(name))
+			}
+		}
+	}
+}
+
+func TestPerUserDirectory(t *testing.T) {
+	dir := makeTempDir("TestPerUserDirectory", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `per_user_directory = true
+
+[[http.basic_authen]]
+username = "alice"
+password = "e10adc3949ba59abbe56e057f20f883e"
+
+[[http.basic_authen]]
+username = "bob"
+password = "e10adc3949ba59abbe56e057f20f883e"`, t)
+
+	upload := ValidateMiddleware(http.HandlerFunc(UploadHandler))
+	download := ValidateMiddleware(UserScope(NoDirListing(dir, http.FileServer(http.Dir(dir)))))
+
+	for _, user := range []string{"alice", "bob"} {
+		r := newUploadRequest("report.txt", "report of "+user, "", t)
+		r.SetBasicAuth(user, "123456")
+		w := httptest.NewRecorder()
+		upload.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusCreated, user, w.Code)
+		}
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, user, "report.txt"))
+		if err != nil || string(b) != "report of "+user {
+			t.Fatalf("file of %s not stored in its directory: %v %q", user, err, b)
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = "report.txt"
+		r.SetBasicAuth(user, "123456")
+		w := httptest.NewRecorder()
+		download.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "report of "+user {
+			t.Fatalf("unexpected download for %s: %d %q", user, w.Code, w.Body.String())
+		}
+	}
+
+	// Users can't escape their directory
+	r := httptest.NewRequest("GET", "/", nil)
+	r.URL.Path = "../bob/report.txt"
+	r.SetBasicAuth("alice", "123456")
+	w := httptest.NewRecorder()
+	download.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// loadConfig writes a config file serving dir with extra options appended to
+// the [http] part and loads it into the configuration manager
+func loadConfig(dir string, extra string, t testing.TB) {
+	content := fmt.Sprintf(`[app]
+log_level = 0
+
+[http]
+file_server_directory = %q
+%s
+`, dir, extra)
+
+	f, err := ioutil.TempFile("", "fileserver-go-*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(content)
+	f.Close()
+
+	if err := configurationmanager.New().Load(f.Name()); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+}
+
+// newUploadRequest builds a multipart upload request carrying content as the
+// file part and filename, if not empty, as the filename field
+func newUploadRequest(name string, content string, filename string, t testing.TB) *http.Request {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	if filename != "" {
+		mw.WriteField("filename", filename)
+	}
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// captureLog redirects the logger to a buffer with the given level
+func captureLog(level int) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	mlog := logger.New()
+	mlog.SetStreamSingle(buf)
+	mlog.SetLevel(level)
+	return buf
+}
+
+// restoreLog sends the logger back to stderr
+func restoreLog() {
+	logger.New().SetStreamSingle(os.Stderr)
+}
+
+func makeTempDir(name string, t testing.TB) string {
+	dir, err := ioutil.TempDir("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(path string, content string, t testing.TB) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tempName returns the name of a temporary file of an upload of name
+func tempName(name string) string {
+	return name + ".8c2f1e9a-4b7d-4f1e-9a3c-5d6e7f809a1b.tmp"
+}
+
+func fileCount(dir string, exp int, t testing.TB) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != exp {
+		t.Fatalf("expected %d files in %s, got %d", exp, dir, len(files))
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	dir := makeTempDir("TestMethodOverride", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/upload", UploadHandler).Methods("POST")
+	router.PathPrefix("/download/").Handler(http.StripPrefix("/download/", http.HandlerFunc(DeleteHandler))).Methods("DELETE")
+	h := MethodOverrideMiddleware(router)
+
+	// Header
+	writeFile(filepath.Join(dir, "a.txt"), "a", t)
+	r := httptest.NewRequest("POST", "/download/a.txt", nil)
+	r.Header.Set(MethodOverrideHeader, "delete")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	fileCount(dir, 0, t)
+
+	// Form field
+	writeFile(filepath.Join(dir, "a.txt"), "a", t)
+	r = httptest.NewRequest("POST", "/download/a.txt", strings.NewReader("_method=DELETE"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	fileCount(dir, 0, t)
+
+	// Methods which can't override
+	writeFile(filepath.Join(dir, "a.txt"), "a", t)
+	for _, method := range []string{"GET", "CONNECT", "POST"} {
+		r = httptest.NewRequest("POST", "/download/a.txt", nil)
+		r.Header.Set(MethodOverrideHeader, method)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusBadRequest, method, w.Code)
+		}
+	}
+
+	// Only POST can be overridden
+	r = httptest.NewRequest("GET", "/download/a.txt", nil)
+	r.Header.Set(MethodOverrideHeader, "DELETE")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	fileCount(dir, 1, t)
+
+	// Uploads are not affected
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newUploadRequest("b.txt", "b", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+}
+
+func TestHTMLContentType(t *testing.T) {
+	dir := makeTempDir("TestHTMLContentType", t)
+	defer os.RemoveAll(dir)
+
+	for extra, expected := range map[string]string{
+		"":                            "text/html; charset=utf-8",
+		`html_charset = "ISO-8859-1"`: "text/html; charset=ISO-8859-1",
+	} {
+		loadConfig(dir, "index_enable = true\n"+extra, t)
+
+		w := httptest.NewRecorder()
+		IndexHandler(w, httptest.NewRequest("GET", "/", nil))
+		if ct := w.Header().Get("Content-Type"); ct != expected {
+			t.Fatalf("expected index Content-Type %q, got %q", expected, ct)
+		}
+
+		r := httptest.NewRequest("DELETE", "/missing.txt", nil)
+		r.Header.Set("Accept", "text/html")
+		w = httptest.NewRecorder()
+		DeleteHandler(w, r)
+		if ct := w.Header().Get("Content-Type"); w.Code != http.StatusNotFound || ct != expected {
+			t.Fatalf("expected error Content-Type %q, got %d %q", expected, w.Code, ct)
+		}
+	}
+}
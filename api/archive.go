@@ -0,0 +1,362 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+// archiveFormats maps the formats accepted by ArchiveHandler to the extension
+// and content type of their archives
+var archiveFormats = map[string][2]string{
+	"zip":    {".zip", "application/zip"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+	"tgz":    {".tar.gz", "application/gzip"},
+}
+
+// archiveEntry is a file added to an archive
+type archiveEntry struct {
+	// name is the slash separated path of the file in the archive
+	name string
+	// path is the local path of the file
+	path string
+	// size is the size of the file on disk
+	size int64
+}
+
+// ArchiveHandler streams a zip or tar.gz archive of files of the user, so it's
+// never held in memory or on disk. The files are listed in the files query
+// parameter separated by commas, or in the JSON body {"files": [...]} of a POST
+// request. The format query parameter is zip, the default, tar.gz or tgz.
+// Missing and hidden files are rejected with 409 or skipped according to
+// archive_missing_policy. Files adding up to more than max_archive_size are
+// rejected with 413.
+func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	format, err := archiveFormat(r)
+	var names []string
+	if err == nil {
+		names, err = archiveNames(r, httpConfig)
+	}
+	var entries []archiveEntry
+	if err == nil {
+		entries, err = archiveEntries(userDirectory(r, httpConfig), names, httpConfig)
+	}
+	if err == nil {
+		err = checkArchiveSize(entries, httpConfig)
+	}
+	if err != nil {
+		renderArchiveError(w, r, err)
+		return
+	}
+
+	writeArchive(w, format, "files-"+time.Now().UTC().Format("20060102-150405"), entries, httpConfig)
+}
+
+// DirectoryArchiveHandler streams a zip or tar.gz archive of the directory of
+// the user named by the request path, or of the whole directory of the user if
+// the path is empty. Hidden files and files deeper than max_path_depth are
+// left out like in listings, and symlinks are never followed. The format query
+// parameter is the same as for ArchiveHandler. Directories whose files add up
+// to more than max_archive_size are rejected with 413.
+func DirectoryArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	format, err := archiveFormat(r)
+	if err != nil {
+		renderArchiveError(w, r, err)
+		return
+	}
+
+	dir := userDirectory(r, httpConfig)
+	name, localPath := resolvePath(dir, r.URL.Path)
+	basename := "files"
+	if name != "" {
+		basename = path.Base(name)
+	}
+
+	info, err := os.Stat(localPath)
+	switch {
+	case os.IsNotExist(err) && name == "":
+		// The directory of the user doesn't exist until the first upload
+	case err == nil && info.IsDir() && !isHidden(name, httpConfig.HiddenPatterns) && confined(dir, localPath):
+	default:
+		renderError(w, r, http.StatusNotFound, fmt.Sprintf("Archive %s failed", name), fmt.Sprintf("%s is not a directory", name))
+		return
+	}
+
+	// Depths are relative to the directory of the user, so a directory at the
+	// limit has no file within it
+	files := []listedFile{}
+	limit := httpConfig.MaxPathDepth
+	if name != "" && limit > 0 {
+		httpConfig.MaxPathDepth = limit - pathDepth(name)
+	}
+	if limit == 0 || httpConfig.MaxPathDepth > 0 {
+		files, _, err = listFiles(localPath, httpConfig)
+	}
+	if err != nil {
+		renderArchiveError(w, r, err)
+		return
+	}
+
+	entries := []archiveEntry{}
+	for _, f := range files {
+		entries = append(entries, archiveEntry{
+			name: path.Join(basename, f.Name),
+			path: filepath.Join(localPath, filepath.FromSlash(f.Name)),
+			size: f.Size,
+		})
+	}
+	if err := checkArchiveSize(entries, httpConfig); err != nil {
+		renderArchiveError(w, r, err)
+		return
+	}
+
+	writeArchive(w, format, basename, entries, httpConfig)
+}
+
+// archiveFormat returns the format requested in r, zip by default
+func archiveFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if _, ok := archiveFormats[format]; !ok {
+		return "", httpError{status: http.StatusBadRequest, err: errors.New("format must be zip, tar.gz or tgz")}
+	}
+
+	return format, nil
+}
+
+// renderArchiveError renders the error page of an archive request failing
+// with err
+func renderArchiveError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.New().Critical.Printf("%+v", err)
+	renderHTTPError(w, r, "Archive failed", err)
+}
+
+// archiveNames returns the names of the files requested in r without
+// duplicates
+func archiveNames(r *http.Request, httpConfig configurationmanager.HTTPConfig) ([]string, error) {
+	var requested []string
+	if r.Method == http.MethodPost {
+		var body struct {
+			Files []string `json:"files"`
+		}
+		err := json.NewDecoder(io.LimitReader(r.Body, int64(httpConfig.MultipartMemory))).Decode(&body)
+		if err != nil {
+			return nil, httpError{status: http.StatusBadRequest, err: fmt.Errorf("invalid body: %v", err)}
+		}
+		requested = body.Files
+	} else {
+		for _, files := range r.URL.Query()["files"] {
+			requested = append(requested, strings.Split(files, ",")...)
+		}
+	}
+
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, name := range requested {
+		name, _ = resolvePath("", strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, httpError{status: http.StatusBadRequest, err: errors.New("no file is requested")}
+	}
+
+	return names, nil
+}
+
+// archiveEntries returns the entries of the files of dir named by names.
+// Names are resolved within dir, and files which are missing, hidden, not
+// regular or out of dir through a symlink are rejected or skipped.
+func archiveEntries(dir string, names []string, httpConfig configurationmanager.HTTPConfig) ([]archiveEntry, error) {
+	entries := []archiveEntry{}
+	for _, name := range names {
+		name, localPath := resolvePath(dir, name)
+		info, err := os.Stat(localPath)
+		if err == nil && info.Mode().IsRegular() && !isHidden(name, httpConfig.HiddenPatterns) && confined(dir, localPath) {
+			entries = append(entries, archiveEntry{name: name, path: localPath, size: info.Size()})
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if httpConfig.ArchiveMissingPolicy == configurationmanager.ArchiveMissingReject {
+			return nil, httpError{status: http.StatusConflict, err: fmt.Errorf("%s does not exist", name)}
+		}
+	}
+
+	return entries, nil
+}
+
+// checkArchiveSize rejects an archive of entries adding up to more than
+// max_archive_size with 413
+func checkArchiveSize(entries []archiveEntry, httpConfig configurationmanager.HTTPConfig) error {
+	if httpConfig.MaxArchiveSize <= 0 {
+		return nil
+	}
+
+	var size int64
+	for _, entry := range entries {
+		size += entry.size
+	}
+	if size > int64(httpConfig.MaxArchiveSize)*1024*1024 {
+		return httpError{
+			status: http.StatusRequestEntityTooLarge,
+			err:    fmt.Errorf("files are larger than %d MB", httpConfig.MaxArchiveSize),
+		}
+	}
+
+	return nil
+}
+
+// writeArchive streams the archive of entries in format to w as an attachment
+// named basename. Once the archive is started the status is sent, so errors
+// abort the connection to let the client know the archive is incomplete.
+func writeArchive(w http.ResponseWriter, format string, basename string, entries []archiveEntry, httpConfig configurationmanager.HTTPConfig) {
+	mlog := logger.New()
+
+	ext, contentType := archiveFormats[format][0], archiveFormats[format][1]
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": basename + ext}))
+
+	var aw archiveWriter
+	if ext == ".zip" {
+		aw = &zipArchive{zw: zip.NewWriter(w), bufferSize: httpConfig.CopyBufferSize}
+	} else {
+		gw := gzip.NewWriter(w)
+		aw = &tarArchive{gw: gw, tw: tar.NewWriter(gw), bufferSize: httpConfig.CopyBufferSize}
+	}
+
+	for _, entry := range entries {
+		if err := addArchiveEntry(aw, entry, httpConfig); err != nil {
+			mlog.Critical.Printf("Cannot archive %s: %+v", entry.path, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		mlog.Critical.Printf("Cannot archive %d files: %+v", len(entries), err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// addArchiveEntry adds the content of entry to aw, decrypted if encryption is
+// enabled
+func addArchiveEntry(aw archiveWriter, entry archiveEntry, httpConfig configurationmanager.HTTPConfig) error {
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var content io.Reader = f
+	size := info.Size()
+	if httpConfig.Encryption {
+		size = utilities.DecryptedSize(size)
+		content, err = utilities.NewDecryptReader(f, httpConfig.EncryptionKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return aw.add(entry.name, info, size, content)
+}
+
+// archiveWriter writes files to an archive
+type archiveWriter interface {
+	// add writes a file named name, of size bytes read from r, with the
+	// permission and modification time of info
+	add(name string, info os.FileInfo, size int64, r io.Reader) error
+	// Close finishes the archive
+	Close() error
+}
+
+type zipArchive struct {
+	zw         *zip.Writer
+	bufferSize int
+}
+
+func (a *zipArchive) add(name string, info os.FileInfo, size int64, r io.Reader) error {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: info.ModTime(),
+	}
+	header.SetMode(info.Mode().Perm())
+
+	fw, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffer(fw, r, a.bufferSize)
+
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	gw         *gzip.Writer
+	tw         *tar.Writer
+	bufferSize int
+}
+
+func (a *tarArchive) add(name string, info os.FileInfo, size int64, r io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(info.Mode().Perm()),
+		Size:     size,
+		ModTime:  info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	// The size in the header must match the content
+	n, err := copyBuffer(a.tw, io.LimitReader(r, size), a.bufferSize)
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+
+	return a.gw.Close()
+}
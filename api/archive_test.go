@@ -0,0 +1,243 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// unzip returns the content of the files of a zip archive by name
+func unzip(data []byte, t *testing.T) map[string]string {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("invalid zip archive: %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(content)
+	}
+
+	return files
+}
+
+// untar returns the content of the files of a tar.gz archive by name
+func untar(data []byte, t *testing.T) map[string]string {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid gzip stream: %v", err)
+	}
+
+	files := make(map[string]string)
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid tar archive: %v", err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = string(content)
+	}
+
+	return files
+}
+
+func TestArchive(t *testing.T) {
+	dir := makeTempDir("TestArchive", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `hidden_patterns = ["secret*"]`, t)
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeFile(filepath.Join(dir, "a.txt"), "alpha", t)
+	writeFile(filepath.Join(dir, "sub", "b.txt"), strings.Repeat("beta", 10000), t)
+	writeFile(filepath.Join(dir, "secret.txt"), "hidden", t)
+
+	w := httptest.NewRecorder()
+	ArchiveHandler(w, httptest.NewRequest("GET", "/archive?files=a.txt,sub/b.txt,a.txt", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if w.Header().Get("Content-Type") != "application/zip" ||
+		!strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment; filename=files-") {
+		t.Errorf("unexpected headers %v", w.Header())
+	}
+	expected := map[string]string{"a.txt": "alpha", "sub/b.txt": strings.Repeat("beta", 10000)}
+	if files := unzip(w.Body.Bytes(), t); !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	w = httptest.NewRecorder()
+	ArchiveHandler(w, httptest.NewRequest("POST", "/archive?format=tar.gz", strings.NewReader(`{"files": ["a.txt", "/sub/../sub/b.txt"]}`)))
+	if w.Code != http.StatusOK || !strings.HasSuffix(w.Header().Get("Content-Disposition"), ".tar.gz") {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if files := untar(w.Body.Bytes(), t); !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	// Missing, hidden and escaping files are rejected
+	for _, files := range []string{"a.txt,c.txt", "secret.txt", "sub", "../TestArchive/a.txt,../../etc/passwd"} {
+		w = httptest.NewRecorder()
+		ArchiveHandler(w, httptest.NewRequest("GET", "/archive?files="+files, nil))
+		if w.Code != http.StatusConflict {
+			t.Errorf("%s: expected status %d, got %d", files, http.StatusConflict, w.Code)
+		}
+	}
+
+	for _, target := range []string{"/archive", "/archive?files=,", "/archive?files=a.txt&format=rar"} {
+		w = httptest.NewRecorder()
+		ArchiveHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", target, http.StatusBadRequest, w.Code)
+		}
+	}
+
+	// Or skipped
+	loadConfig(dir, `archive_missing_policy = "skip"
+hidden_patterns = ["secret*"]`, t)
+	w = httptest.NewRecorder()
+	ArchiveHandler(w, httptest.NewRequest("GET", "/archive?files=a.txt,c.txt,secret.txt", nil))
+	if files := unzip(w.Body.Bytes(), t); !reflect.DeepEqual(files, map[string]string{"a.txt": "alpha"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	// Files larger than max_archive_size altogether are rejected
+	loadConfig(dir, "max_archive_size = 1", t)
+	writeFile(filepath.Join(dir, "big.bin"), strings.Repeat("x", 1024*1024), t)
+	w = httptest.NewRecorder()
+	ArchiveHandler(w, httptest.NewRequest("GET", "/archive?files=big.bin", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d at the limit, got %d", http.StatusOK, w.Code)
+	}
+	w = httptest.NewRecorder()
+	ArchiveHandler(w, httptest.NewRequest("GET", "/archive?files=big.bin,a.txt", nil))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestArchiveEncrypted(t *testing.T) {
+	dir := makeTempDir("TestArchiveEncrypted", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `encryption = true
+encryption_key = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"`, t)
+
+	content := strings.Repeat("x", 100*1024)
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("a.txt", content, "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	for _, format := range []string{"zip", "tgz"} {
+		w = httptest.NewRecorder()
+		ArchiveHandler(w, httptest.NewRequest("GET", "/archive?files=a.txt&format="+format, nil))
+		files := unzip
+		if format == "tgz" {
+			files = untar
+		}
+		if files(w.Body.Bytes(), t)["a.txt"] != content {
+			t.Errorf("%s: a.txt isn't decrypted", format)
+		}
+	}
+}
+
+func TestDirectoryArchive(t *testing.T) {
+	dir := makeTempDir("TestDirectoryArchive", t)
+	defer os.RemoveAll(dir)
+	outside := makeTempDir("TestDirectoryArchiveOutside", t)
+	defer os.RemoveAll(outside)
+	loadConfig(dir, `hidden_patterns = ["secret*"]`, t)
+
+	os.MkdirAll(filepath.Join(dir, "project", "src", "deep"), 0755)
+	os.MkdirAll(filepath.Join(dir, "project", "secrets"), 0755)
+	writeFile(filepath.Join(dir, "top.txt"), "top", t)
+	writeFile(filepath.Join(dir, "project", "README"), "readme", t)
+	writeFile(filepath.Join(dir, "project", "src", "main.go"), "main", t)
+	writeFile(filepath.Join(dir, "project", "src", "deep", "x.txt"), "x", t)
+	writeFile(filepath.Join(dir, "project", "secrets", "key"), "key", t)
+	writeFile(filepath.Join(dir, "project", tempName("a.txt")), "partial", t)
+	writeFile(filepath.Join(outside, "passwd"), "root", t)
+	os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(dir, "project", "passwd"))
+	os.Symlink(outside, filepath.Join(dir, "project", "outside"))
+
+	h := http.StripPrefix("/archive/", http.HandlerFunc(DirectoryArchiveHandler))
+	archive := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	w := archive("/archive/project")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != "attachment; filename=project.zip" {
+		t.Fatalf("expected status %d, got %d and headers %v", http.StatusOK, w.Code, w.Header())
+	}
+	expected := map[string]string{
+		"project/README":         "readme",
+		"project/src/main.go":    "main",
+		"project/src/deep/x.txt": "x",
+	}
+	if files := unzip(w.Body.Bytes(), t); !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	w = archive("/archive/project/src?format=tar.gz")
+	expected = map[string]string{"src/main.go": "main", "src/deep/x.txt": "x"}
+	if files := untar(w.Body.Bytes(), t); !reflect.DeepEqual(files, expected) {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	// The whole directory of the user
+	w = archive("/archive/")
+	if files := unzip(w.Body.Bytes(), t); len(files) != 4 || files["files/top.txt"] != "top" {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	for _, target := range []string{"/archive/missing", "/archive/top.txt", "/archive/project/secrets", "/archive/project/outside", "/archive/../" + filepath.Base(outside)} {
+		if w := archive(target); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", target, http.StatusNotFound, w.Code)
+		}
+	}
+
+	// Depths are relative to the directory of the user
+	loadConfig(dir, "max_path_depth = 3", t)
+	w = archive("/archive/project/src")
+	if files := unzip(w.Body.Bytes(), t); !reflect.DeepEqual(files, map[string]string{"src/main.go": "main"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+	w = archive("/archive/project/src/deep")
+	if files := unzip(w.Body.Bytes(), t); len(files) != 0 {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	loadConfig(dir, "max_archive_size = 1", t)
+	writeFile(filepath.Join(dir, "project", "big.bin"), strings.Repeat("x", 1024*1024), t)
+	if w := archive("/archive/project"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
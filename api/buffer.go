@@ -0,0 +1,31 @@
+package api
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBuffers holds the buffers of copyBuffer so that concurrent transfers
+// reuse them instead of allocating one each
+var copyBuffers sync.Pool
+
+// copyBuffer copies src to dst like io.Copy, through a pooled buffer of size
+// bytes. Buffers of another size, left in the pool before copy_buffer_size was
+// changed by reloading, are dropped.
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	buf, _ := copyBuffers.Get().(*[]byte)
+	if buf == nil || len(*buf) != size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	defer copyBuffers.Put(buf)
+
+	// io.CopyBuffer ignores the buffer if dst is an io.ReaderFrom, as a
+	// http.ResponseWriter is, so hide it
+	return io.CopyBuffer(writerOnly{dst}, src, *buf)
+}
+
+// writerOnly hides all methods of a writer but Write
+type writerOnly struct {
+	io.Writer
+}
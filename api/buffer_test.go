@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+)
+
+// readerFrom counts the calls of ReadFrom, which copyBuffer must not use
+type readerFrom struct {
+	bytes.Buffer
+	calls int
+}
+
+func (w *readerFrom) ReadFrom(r io.Reader) (int64, error) {
+	w.calls++
+	return w.Buffer.ReadFrom(r)
+}
+
+func TestCopyBuffer(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	for _, size := range []int{7, 4096, 4096, 1 << 20} {
+		w := &readerFrom{}
+		n, err := copyBuffer(w, strings.NewReader(content), size)
+		if err != nil || n != int64(len(content)) || w.String() != content {
+			t.Fatalf("%d: unexpected copy of %d bytes: %v", size, n, err)
+		}
+		if w.calls != 0 {
+			t.Errorf("%d: buffer was bypassed", size)
+		}
+	}
+}
+
+// BenchmarkCopyBuffer measures the throughput of writing a file through
+// buffers of several sizes
+func BenchmarkCopyBuffer(b *testing.B) {
+	dir, err := ioutil.TempDir("", "BenchmarkCopyBuffer")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 64 << 20
+	for _, bufferSize := range []int{32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", bufferSize>>10), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				f, err := os.Create(filepath.Join(dir, "out"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = copyBuffer(f, io.LimitReader(zeroReader{}, size), bufferSize)
+				f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// recorderFrom is a response recorder counting the calls of ReadFrom, through
+// which net/http sends files by the operating system
+type recorderFrom struct {
+	*httptest.ResponseRecorder
+	calls int
+}
+
+func (w *recorderFrom) ReadFrom(r io.Reader) (int64, error) {
+	w.calls++
+	return w.Body.ReadFrom(r)
+}
+
+func TestDownloadReadFrom(t *testing.T) {
+	dir := makeTempDir("TestDownloadReadFrom", t)
+	defer os.RemoveAll(dir)
+	content := strings.Repeat("x", 100)
+	writeFile(filepath.Join(dir, "file.txt"), content, t)
+
+	download := func(h http.Handler) int {
+		w := &recorderFrom{ResponseRecorder: httptest.NewRecorder()}
+		LoggingMiddleware(h).ServeHTTP(w, httptest.NewRequest("GET", "/file.txt", nil))
+		if w.Code != http.StatusOK || w.Body.String() != content {
+			t.Fatalf("unexpected response %d of %d bytes", w.Code, w.Body.Len())
+		}
+		return w.calls
+	}
+
+	// Plain downloads are sent by the operating system through the logging
+	// middleware, throttled ones through a buffer
+	loadConfig(dir, `download_rate_limit = "1MB"`, t)
+	if calls := download(FileServer(dir)); calls != 1 {
+		t.Errorf("plain download: %d calls of ReadFrom", calls)
+	}
+	if calls := download(Throttle(configurationmanager.RouteDownload, FileServer(dir))); calls != 0 {
+		t.Errorf("throttled download: %d calls of ReadFrom", calls)
+	}
+}
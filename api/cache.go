@@ -0,0 +1,163 @@
+package api
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+)
+
+// cachedListing is the listing of a directory walked at some time
+type cachedListing struct {
+	dir          string
+	files        []listedFile
+	lastModified time.Time
+	time         time.Time
+}
+
+// cachedFileCount is the number of files stored under a directory, counted at
+// some time and kept up to date by uploads and deletes since
+type cachedFileCount struct {
+	count int
+	time  time.Time
+}
+
+var (
+	// listingCacheSize is the maximum number of cached listings, beyond which
+	// the oldest is dropped
+	listingCacheSize = 1024
+
+	listingCacheMutex sync.Mutex
+	listingCache      = make(map[string]cachedListing)
+	// listingGeneration changes whenever listings are invalidated, so that a
+	// walk which may have missed the change isn't cached
+	listingGeneration uint64
+
+	fileCountCacheMutex sync.Mutex
+	fileCountCache      = make(map[string]cachedFileCount)
+	// fileCountGeneration changes whenever counts are adjusted, so that a walk
+	// which may have missed the change isn't cached
+	fileCountGeneration uint64
+)
+
+// cachedListFiles returns the result of listFiles for dir, computed at most
+// list_cache_duration ago and not before a change of dir through the server
+func cachedListFiles(dir string, httpConfig configurationmanager.HTTPConfig) ([]listedFile, time.Time, error) {
+	if httpConfig.ListCacheDuration <= 0 {
+		return listFiles(dir, httpConfig)
+	}
+
+	// Listings depend on these options, which may be changed by reloading
+	key := fmt.Sprintf("%s\x00%d\x00%q", dir, httpConfig.MaxPathDepth, httpConfig.HiddenPatterns)
+
+	listingCacheMutex.Lock()
+	c, ok := listingCache[key]
+	generation := listingGeneration
+	listingCacheMutex.Unlock()
+	if ok && time.Since(c.time) < httpConfig.ListCacheDuration {
+		// Callers sort the files in place
+		return append([]listedFile{}, c.files...), c.lastModified, nil
+	}
+
+	now := time.Now()
+	files, lastModified, err := listFiles(dir, httpConfig)
+	if err != nil {
+		return files, lastModified, err
+	}
+
+	listingCacheMutex.Lock()
+	defer listingCacheMutex.Unlock()
+	if generation != listingGeneration {
+		return files, lastModified, nil
+	}
+	if _, ok := listingCache[key]; !ok && len(listingCache) >= listingCacheSize {
+		var oldest string
+		for k, c := range listingCache {
+			if oldest == "" || c.time.Before(listingCache[oldest].time) {
+				oldest = k
+			}
+		}
+		delete(listingCache, oldest)
+	}
+	listingCache[key] = cachedListing{
+		dir:          dir,
+		files:        append([]listedFile{}, files...),
+		lastModified: lastModified,
+		time:         now,
+	}
+
+	return files, lastModified, nil
+}
+
+// cachedCountFiles returns the result of countFiles for dir, counted at most
+// usage_cache_duration ago and adjusted for the files stored and removed
+// through the server since, so that uploads don't walk dir every time
+func cachedCountFiles(dir string, httpConfig configurationmanager.HTTPConfig) (int, error) {
+	fileCountCacheMutex.Lock()
+	c, ok := fileCountCache[dir]
+	generation := fileCountGeneration
+	fileCountCacheMutex.Unlock()
+	if ok && time.Since(c.time) < httpConfig.UsageCacheDuration {
+		return c.count, nil
+	}
+
+	now := time.Now()
+	count, err := countFiles(dir, httpConfig)
+	if err != nil || httpConfig.UsageCacheDuration <= 0 {
+		return count, err
+	}
+
+	fileCountCacheMutex.Lock()
+	defer fileCountCacheMutex.Unlock()
+	if generation == fileCountGeneration {
+		fileCountCache[dir] = cachedFileCount{count: count, time: now}
+	}
+
+	return count, nil
+}
+
+// adjustFileCount adds delta to the cached numbers of files of the directories
+// containing path, after a file was stored there, or removed if delta is
+// negative
+func adjustFileCount(path string, delta int) {
+	fileCountCacheMutex.Lock()
+	defer fileCountCacheMutex.Unlock()
+
+	fileCountGeneration++
+	for dir, c := range fileCountCache {
+		if contains(dir, path) {
+			c.count += delta
+			fileCountCache[dir] = c
+		}
+	}
+}
+
+// contains reports whether path is dir or a file under dir
+func contains(dir string, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// invalidateCaches drops the cached listings and usages of the directories
+// containing path, after a file was stored or removed there
+func invalidateCaches(path string) {
+	listingCacheMutex.Lock()
+	listingGeneration++
+	for key, c := range listingCache {
+		if contains(c.dir, path) {
+			delete(listingCache, key)
+		}
+	}
+	listingCacheMutex.Unlock()
+
+	usageCacheMutex.Lock()
+	usageGeneration++
+	for dir := range usageCache {
+		if contains(dir, path) {
+			delete(usageCache, dir)
+		}
+	}
+	usageCacheMutex.Unlock()
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+)
+
+func TestListCache(t *testing.T) {
+	dir := makeTempDir("TestListCache", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `list_cache_duration = "1h"`, t)
+
+	writeFile(filepath.Join(dir, "a.txt"), "alpha", t)
+	if names := list(t); !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Fatalf("unexpected files %v", names)
+	}
+
+	// Files changed on disk are not listed within the duration
+	writeFile(filepath.Join(dir, "b.txt"), "beta", t)
+	if names := list(t); !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Fatalf("expected cached listing, got %v", names)
+	}
+	// Sorting a listing doesn't change the cached one
+	if names, _ := listQuery("order=desc", t); !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Fatalf("expected cached listing, got %v", names)
+	}
+
+	// But uploads and deletes refresh it
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("c.txt", "gamma", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if names := list(t); !reflect.DeepEqual(names, []string{"a.txt", "b.txt", "c.txt"}) {
+		t.Fatalf("unexpected files %v", names)
+	}
+
+	w = httptest.NewRecorder()
+	http.StripPrefix("/delete/", http.HandlerFunc(DeleteHandler)).ServeHTTP(w, httptest.NewRequest("DELETE", "/delete/a.txt", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if names := list(t); !reflect.DeepEqual(names, []string{"b.txt", "c.txt"}) {
+		t.Fatalf("unexpected files %v", names)
+	}
+
+	// And so does the expiry
+	loadConfig(dir, `list_cache_duration = "10ms"`, t)
+	list(t)
+	writeFile(filepath.Join(dir, "d.txt"), "delta", t)
+	time.Sleep(20 * time.Millisecond)
+	if names := list(t); !reflect.DeepEqual(names, []string{"b.txt", "c.txt", "d.txt"}) {
+		t.Fatalf("unexpected files %v", names)
+	}
+}
+
+func TestListCacheSize(t *testing.T) {
+	dir := makeTempDir("TestListCacheSize", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `list_cache_duration = "1h"`, t)
+	httpConfig := configurationmanager.New().GetHTTPConfig()
+
+	defer func(size int) {
+		listingCacheSize = size
+	}(listingCacheSize)
+	listingCacheSize = 2
+	listingCacheMutex.Lock()
+	listingCache = make(map[string]cachedListing)
+	listingCacheMutex.Unlock()
+
+	for _, name := range []string{"a", "b", "c"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+		cachedListFiles(filepath.Join(dir, name), httpConfig)
+	}
+	listingCacheMutex.Lock()
+	defer listingCacheMutex.Unlock()
+	if len(listingCache) > 2 {
+		t.Errorf("expected at most 2 listings, got %d", len(listingCache))
+	}
+}
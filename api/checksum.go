@@ -0,0 +1,144 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+// checksumSuffix is appended to the name of a stored file to get the name of
+// its checksum sidecar
+const checksumSuffix = ".sha256"
+
+// checksumSidecarPath returns the path of the checksum sidecar of a file
+func checksumSidecarPath(path string) string {
+	return path + checksumSuffix
+}
+
+// writeChecksumSidecar stores the SHA-256 sum of a file next to it, in the
+// same format as the output of sha256sum
+func writeChecksumSidecar(path string, sum []byte) error {
+	content := fmt.Sprintf("%s  %s\n", hex.EncodeToString(sum), filepath.Base(path))
+	return utilities.WriteFileAtomic(checksumSidecarPath(path), []byte(content), 0644)
+}
+
+// removeChecksumSidecar removes the checksum sidecar of a file if it exists
+func removeChecksumSidecar(path string) error {
+	err := os.Remove(checksumSidecarPath(path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// VerifySummary counts the results of VerifyChecksums
+type VerifySummary struct {
+	OK              int
+	Corrupt         int
+	MissingChecksum int
+}
+
+// contextReader is an io.Reader which stops reading once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// VerifyChecksums recomputes the SHA-256 sum of every file under dir and
+// compares it with the one recorded in its sidecar. Files are streamed so
+// memory usage doesn't depend on their size. Mismatches are reported to the
+// log. Verification stops early with ctx.Err() when ctx is cancelled.
+func VerifyChecksums(ctx context.Context, dir string) (VerifySummary, error) {
+	mlog := logger.New()
+
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	var summary VerifySummary
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Temporary files, sidecars and the name index have no checksum
+		if info.IsDir() || isInternalFile(info.Name()) {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(checksumSidecarPath(path))
+		if os.IsNotExist(err) {
+			mlog.Warning.Printf("No checksum for %s", path)
+			summary.MissingChecksum++
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fields := bytes.Fields(content)
+		if len(fields) == 0 {
+			mlog.Critical.Printf("Checksum of %s is empty", path)
+			summary.Corrupt++
+			return nil
+		}
+		expected := string(fields[0])
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var reader io.Reader = f
+		if httpConfig.Encryption {
+			reader, err = utilities.NewDecryptReader(f, httpConfig.EncryptionKey)
+		}
+
+		hasher := sha256.New()
+		if err == nil {
+			_, err = io.Copy(hasher, contextReader{ctx: ctx, r: reader})
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			mlog.Critical.Printf("Cannot read %s: %+v", path, err)
+			summary.Corrupt++
+			return nil
+		}
+
+		actual := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(actual, expected) {
+			mlog.Critical.Printf("Checksum mismatch for %s: expected %s, got %s", path, expected, actual)
+			summary.Corrupt++
+			return nil
+		}
+
+		mlog.Debug.Printf("Checksum of %s is OK", path)
+		summary.OK++
+		return nil
+	})
+
+	return summary, err
+}
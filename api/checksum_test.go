@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChecksumSidecar(t *testing.T) {
+	dir := makeTempDir("TestChecksumSidecar", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "checksum_sidecar = true", t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("foo.txt", "hello", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	sum := sha256.Sum256([]byte("hello"))
+	expected := hex.EncodeToString(sum[:]) + "  foo.txt\n"
+	b, err := ioutil.ReadFile(filepath.Join(dir, "foo.txt.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Fatalf("expected sidecar %q, got %q", expected, b)
+	}
+
+	w = httptest.NewRecorder()
+	DeleteHandler(w, httptest.NewRequest("DELETE", "/foo.txt", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	fileCount(dir, 0, t)
+}
+
+func TestChecksumSidecarDisabled(t *testing.T) {
+	dir := makeTempDir("TestChecksumSidecarDisabled", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("foo.txt", "hello", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	fileCount(dir, 1, t)
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	dir := makeTempDir("TestVerifyChecksums", t)
+	defer os.RemoveAll(dir)
+
+	ok := filepath.Join(dir, "ok.txt")
+	writeFile(ok, "hello", t)
+	sum := sha256.Sum256([]byte("hello"))
+	writeChecksumSidecar(ok, sum[:])
+
+	corrupt := filepath.Join(dir, "corrupt.txt")
+	writeFile(corrupt, "tampered", t)
+	writeChecksumSidecar(corrupt, sum[:])
+
+	writeFile(filepath.Join(dir, "unknown.txt"), "hello", t)
+
+	// Stored files ending in .tmp are verified, internal files aren't
+	stored := filepath.Join(dir, "report.tmp")
+	writeFile(stored, "hello", t)
+	writeChecksumSidecar(stored, sum[:])
+	writeFile(filepath.Join(dir, nameIndexFile), "{}", t)
+	writeFile(filepath.Join(dir, tempName("partial.txt")), "partial", t)
+
+	summary, err := VerifyChecksums(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := VerifySummary{OK: 2, Corrupt: 1, MissingChecksum: 1}
+	if summary != expected {
+		t.Fatalf("expected %+v, got %+v", expected, summary)
+	}
+}
+
+func TestVerifyChecksumsCancelled(t *testing.T) {
+	dir := makeTempDir("TestVerifyChecksumsCancelled", t)
+	defer os.RemoveAll(dir)
+	writeFile(filepath.Join(dir, "foo.txt"), "hello", t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := VerifyChecksums(ctx, dir); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+)
+
+// draining is 1 while the server is draining, e.g. before a planned shutdown
+var draining int32
+
+// SetDraining switches draining mode on or off. While the server is draining,
+// new uploads are refused with 503 so that a load balancer sends them
+// elsewhere, and transfers in progress go on.
+func SetDraining(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&draining, v)
+}
+
+// Draining reports whether the server is draining
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// Drain wraps a handler of uploads so that new requests are refused with 503
+// and a Retry-After header while the server is draining
+func Drain(h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Draining() {
+			refuseDraining(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// DrainDownloads wraps a handler of downloads like Drain, except that requests
+// are only refused if drain_downloads is true
+func DrainDownloads(h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+
+		if httpConfig.DrainDownloads && Draining() {
+			refuseDraining(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// refuseDraining renders the error page of a request refused while draining
+func refuseDraining(w http.ResponseWriter, r *http.Request) {
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(httpConfig.DrainRetryAfter.Seconds())))
+	renderError(w, r, http.StatusServiceUnavailable, "Service unavailable", "The server is under maintenance, please retry later")
+}
+
+// DrainHandler switches draining mode on for POST requests and off for DELETE
+// requests, and reports in JSON whether the server is draining
+func DrainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		SetDraining(true)
+	case http.MethodDelete:
+		SetDraining(false)
+	}
+	logger.New().Info.Printf("%s set draining mode to %t", Username(r), Draining())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Draining bool `json:"draining"`
+	}{
+		Draining: Draining(),
+	})
+}
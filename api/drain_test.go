@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDraining(t *testing.T) {
+	dir := makeTempDir("TestDraining", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `drain_retry_after = "30s"`, t)
+	writeFile(filepath.Join(dir, "a.txt"), "alpha", t)
+
+	upload := Drain(http.HandlerFunc(UploadHandler))
+	download := DrainDownloads(FileServer(dir))
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		upload.ServeHTTP(w, newUploadRequest("b.txt", "beta", "", t))
+		return w
+	}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		download.ServeHTTP(w, httptest.NewRequest("GET", "/a.txt", nil))
+		return w
+	}
+
+	defer SetDraining(false)
+	SetDraining(true)
+	if w := send(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "30" {
+		t.Fatalf("expected status %d with Retry-After, got %d %q", http.StatusServiceUnavailable, w.Code, w.Header().Get("Retry-After"))
+	}
+	fileCount(dir, 1, t)
+	if w := get(); w.Code != http.StatusOK || w.Body.String() != "alpha" {
+		t.Fatalf("expected download to go on, got %d", w.Code)
+	}
+
+	// Downloads can be refused too
+	loadConfig(dir, "drain_downloads = true", t)
+	if w := get(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	SetDraining(false)
+	if w := send(); w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if w := get(); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestDrainHandler(t *testing.T) {
+	defer SetDraining(false)
+
+	for _, test := range []struct {
+		method   string
+		expected string
+	}{
+		{"POST", `{"draining":true}`},
+		{"GET", `{"draining":true}`},
+		{"DELETE", `{"draining":false}`},
+	} {
+		w := httptest.NewRecorder()
+		DrainHandler(w, httptest.NewRequest(test.method, "/admin/drain", nil))
+		if w.Code != http.StatusOK || w.Body.String() != test.expected+"\n" {
+			t.Errorf("%s: unexpected response %d %q", test.method, w.Code, w.Body.String())
+		}
+	}
+}
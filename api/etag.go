@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+// cachedETag is the ETag computed from the content of a file when it had some
+// modification time and size
+type cachedETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+	time    time.Time
+}
+
+var (
+	// etagCacheSize is the maximum number of cached ETags, beyond which the
+	// oldest is dropped
+	etagCacheSize = 1024
+
+	etagCacheMutex sync.Mutex
+	etagCache      = make(map[string]cachedETag)
+)
+
+// contentETag returns the strong ETag of the file at path, described by info,
+// made of the SHA-256 of its content, decrypted if encryption is enabled. It's
+// only computed again once the modification time or the size of the file
+// change.
+func contentETag(path string, info os.FileInfo, httpConfig configurationmanager.HTTPConfig) (string, error) {
+	etagCacheMutex.Lock()
+	c, ok := etagCache[path]
+	etagCacheMutex.Unlock()
+	if ok && c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+		return c.etag, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var content io.Reader = f
+	if httpConfig.Encryption {
+		content, err = utilities.NewDecryptReader(f, httpConfig.EncryptionKey)
+		if err != nil {
+			return "", err
+		}
+	}
+	hasher := sha256.New()
+	if _, err := copyBuffer(hasher, content, httpConfig.CopyBufferSize); err != nil {
+		return "", err
+	}
+	etag := fmt.Sprintf("\"%x\"", hasher.Sum(nil))
+
+	etagCacheMutex.Lock()
+	defer etagCacheMutex.Unlock()
+	if _, ok := etagCache[path]; !ok && len(etagCache) >= etagCacheSize {
+		var oldest string
+		for k, c := range etagCache {
+			if oldest == "" || c.time.Before(etagCache[oldest].time) {
+				oldest = k
+			}
+		}
+		delete(etagCache, oldest)
+	}
+	etagCache[path] = cachedETag{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		etag:    etag,
+		time:    time.Now(),
+	}
+
+	return etag, nil
+}
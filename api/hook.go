@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+)
+
+// runPostUploadCommand runs the post upload command with the path of a stored
+// file as argument, killing it after the configured timeout. Its output is
+// logged. If it fails, it's retried with exponential backoff as configured,
+// then the file is removed when configured to.
+func runPostUploadCommand(path string, httpConfig configurationmanager.HTTPConfig) error {
+	mlog := logger.New()
+
+	start := time.Now()
+	backoff := httpConfig.PostUploadRetryBackoff
+	err := postUploadCommand(path, httpConfig)
+	for retry := 1; err != nil && retry <= httpConfig.PostUploadRetries; retry++ {
+		if httpConfig.PostUploadRetryMaxDuration > 0 && time.Since(start)+backoff > httpConfig.PostUploadRetryMaxDuration {
+			break
+		}
+		mlog.Warning.Printf("Post upload command on %s failed, retry %d of %d in %v: %+v",
+			path, retry, httpConfig.PostUploadRetries, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = postUploadCommand(path, httpConfig)
+	}
+	if err == nil {
+		return nil
+	}
+	mlog.Critical.Printf("Post upload command on %s failed: %+v", path, err)
+
+	if httpConfig.PostUploadDeleteOnFailure {
+		mlog.Warning.Printf("Remove %s since post upload command failed", path)
+		rmErr := os.Remove(path)
+		if rmErr == nil {
+			adjustFileCount(path, -1)
+			rmErr = removeChecksumSidecar(path)
+		}
+		invalidateCaches(path)
+		if rmErr != nil {
+			mlog.Critical.Printf("Cannot remove %s: %+v", path, rmErr)
+		}
+	}
+
+	return err
+}
+
+// postUploadCommand runs the post upload command once on path
+func postUploadCommand(path string, httpConfig configurationmanager.HTTPConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), httpConfig.PostUploadTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, httpConfig.PostUploadCommand, path).CombinedOutput()
+	if len(output) > 0 {
+		logger.New().Info.Printf("Post upload command on %s: %s", path, output)
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return err
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+)
+
+// writeScript writes an executable shell script with body to dir
+func writeScript(dir string, name string, body string, t *testing.T) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPostUploadCommand(t *testing.T) {
+	dir := makeTempDir("TestPostUploadCommand", t)
+	defer os.RemoveAll(dir)
+	scripts := makeTempDir("TestPostUploadCommandScripts", t)
+	defer os.RemoveAll(scripts)
+
+	marker := filepath.Join(scripts, "marker")
+	script := writeScript(scripts, "hook.sh", fmt.Sprintf(`echo "$1" > %s.tmp && mv %s.tmp %s`, marker, marker, marker), t)
+	loadConfig(dir, fmt.Sprintf("post_upload_command = %q", script), t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("a.txt", "content", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	// The command runs in the background
+	deadline := time.Now().Add(5 * time.Second)
+	content, err := ioutil.ReadFile(marker)
+	for os.IsNotExist(err) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		content, err = ioutil.ReadFile(marker)
+	}
+	if expected := filepath.Join(dir, "a.txt") + "\n"; err != nil || string(content) != expected {
+		t.Fatalf("expected command to be run with %q, got %q: %v", expected, content, err)
+	}
+}
+
+func TestPostUploadCommandFailure(t *testing.T) {
+	dir := makeTempDir("TestPostUploadCommandFailure", t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.txt")
+	for _, c := range []struct {
+		script  string
+		timeout time.Duration
+		remove  bool
+	}{
+		{"exit 1", time.Minute, false},
+		{"exit 1", time.Minute, true},
+		{"exec sleep 5", 100 * time.Millisecond, true},
+	} {
+		writeFile(path, "content", t)
+		httpConfig := configurationmanager.HTTPConfig{
+			PostUploadCommand:         writeScript(dir, "hook.sh", c.script, t),
+			PostUploadTimeout:         c.timeout,
+			PostUploadDeleteOnFailure: c.remove,
+		}
+
+		err := runPostUploadCommand(path, httpConfig)
+		if err == nil {
+			t.Fatalf("expected %q to fail", c.script)
+		}
+		if c.timeout < time.Second && err != context.DeadlineExceeded {
+			t.Fatalf("expected %q to time out, got %v", c.script, err)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) != c.remove {
+			t.Fatalf("%q: expected file to be removed to be %t", c.script, c.remove)
+		}
+	}
+
+	// Success leaves the file alone
+	writeFile(path, "content", t)
+	httpConfig := configurationmanager.HTTPConfig{
+		PostUploadCommand:         writeScript(dir, "hook.sh", "exit 0", t),
+		PostUploadTimeout:         time.Minute,
+		PostUploadDeleteOnFailure: true,
+	}
+	if err := runPostUploadCommand(path, httpConfig); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected file to be kept: %v", err)
+	}
+}
+
+func TestPostUploadCommandRetry(t *testing.T) {
+	dir := makeTempDir("TestPostUploadCommandRetry", t)
+	defer os.RemoveAll(dir)
+
+	// The script fails until it has been run succeedAt times
+	path := filepath.Join(dir, "a.txt")
+	counter := filepath.Join(dir, "counter")
+	script := func(succeedAt int) string {
+		os.Remove(counter)
+		return writeScript(dir, "hook.sh", fmt.Sprintf(`echo x >> %s
+[ $(wc -l < %s) -ge %d ]`, counter, counter, succeedAt), t)
+	}
+	runs := func() int {
+		content, _ := ioutil.ReadFile(counter)
+		return len(content) / 2
+	}
+
+	for _, c := range []struct {
+		succeedAt   int
+		retries     int
+		maxDuration time.Duration
+		runs        int
+		ok          bool
+	}{
+		{3, 3, time.Minute, 3, true},
+		{3, 1, time.Minute, 2, false},
+		{1, 0, time.Minute, 1, true},
+		// Retries after 10ms, 20ms and 40ms, the last of which would start
+		// after 50ms
+		{5, 5, 50 * time.Millisecond, 3, false},
+		{5, 4, 0, 5, true},
+	} {
+		writeFile(path, "content", t)
+		httpConfig := configurationmanager.HTTPConfig{
+			PostUploadCommand:          script(c.succeedAt),
+			PostUploadTimeout:          time.Minute,
+			PostUploadDeleteOnFailure:  true,
+			PostUploadRetries:          c.retries,
+			PostUploadRetryBackoff:     10 * time.Millisecond,
+			PostUploadRetryMaxDuration: c.maxDuration,
+		}
+
+		err := runPostUploadCommand(path, httpConfig)
+		if (err == nil) != c.ok || runs() != c.runs {
+			t.Errorf("%+v: expected %d runs and success %t, got %d runs: %v", c, c.runs, c.ok, runs(), err)
+		}
+		// The file is only removed once retries are exhausted
+		if _, err := os.Stat(path); os.IsNotExist(err) == c.ok {
+			t.Errorf("%+v: file removed: %t", c, os.IsNotExist(err))
+		}
+	}
+}
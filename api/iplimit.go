@@ -0,0 +1,76 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+)
+
+var (
+	ipRequestsMutex sync.Mutex
+	// ipRequests counts the requests in progress by client IP
+	ipRequests = make(map[string]int)
+)
+
+// IPLimitMiddleware is an HTTP middleware which rejects requests with 429
+// while max_requests_per_ip other requests of the same client IP are in
+// progress, so that a single client can't hog the server with many parallel
+// downloads
+func IPLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		limit := cm.GetHTTPConfig().MaxRequestsPerIP
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := clientIP(r)
+		if !acquireIP(ip, limit) {
+			renderError(w, r, http.StatusTooManyRequests, "Too many requests",
+				fmt.Sprintf("%d requests from %s are already in progress", limit, ip))
+			return
+		}
+		defer releaseIP(ip)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address of the client of r
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// acquireIP counts a request of ip in progress, unless limit requests of ip
+// already are
+func acquireIP(ip string, limit int) bool {
+	ipRequestsMutex.Lock()
+	defer ipRequestsMutex.Unlock()
+
+	if ipRequests[ip] >= limit {
+		return false
+	}
+	ipRequests[ip]++
+
+	return true
+}
+
+// releaseIP counts a request of ip as done
+func releaseIP(ip string) {
+	ipRequestsMutex.Lock()
+	defer ipRequestsMutex.Unlock()
+
+	ipRequests[ip]--
+	if ipRequests[ip] <= 0 {
+		delete(ipRequests, ip)
+	}
+}
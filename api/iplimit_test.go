@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestIPLimitMiddleware(t *testing.T) {
+	loadConfig("/tmp", "max_requests_per_ip = 2", t)
+
+	// Requests block until released, so they are all in progress at once
+	release := make(chan struct{})
+	var started sync.WaitGroup
+	h := IPLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Done()
+		<-release
+	}))
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/download/a.txt", nil)
+		r.RemoteAddr = remoteAddr
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	var done sync.WaitGroup
+	codes := make(chan int, 3)
+	for _, remoteAddr := range []string{"192.0.2.1:1000", "192.0.2.1:1001", "192.0.2.2:1000"} {
+		started.Add(1)
+		done.Add(1)
+		go func(remoteAddr string) {
+			defer done.Done()
+			codes <- send(remoteAddr).Code
+		}(remoteAddr)
+	}
+	started.Wait()
+
+	// A third request of the first IP is one too many, whatever its port
+	if w := send("192.0.2.1:1002"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	close(release)
+	done.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected status %d, got %d", http.StatusOK, code)
+		}
+	}
+
+	// Completed requests free their slot
+	started.Add(1)
+	if w := send("192.0.2.1:1003"); w.Code != http.StatusOK {
+		t.Errorf("expected status %d after completion, got %d", http.StatusOK, w.Code)
+	}
+	if len(ipRequests) != 0 {
+		t.Errorf("unexpected requests in progress %v", ipRequests)
+	}
+}
@@ -0,0 +1,326 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+)
+
+// listedFile is a file returned by ListHandler. Name is its slash separated
+// path relative to the directory of the user.
+type listedFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// ListHandler returns in JSON the files of the user, including those in
+// subdirectories. Temporary files, checksum sidecars and hidden files are left
+// out.
+func ListHandler(w http.ResponseWriter, r *http.Request) {
+	mlog := logger.New()
+
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	options, err := parseListOptions(r)
+	if err != nil {
+		renderError(w, r, http.StatusBadRequest, "List failed", err.Error())
+		return
+	}
+
+	files, lastModified, err := cachedListFiles(userDirectory(r, httpConfig), httpConfig)
+	if err != nil {
+		mlog.Critical.Printf("%+v", err)
+		renderError(w, r, http.StatusInternalServerError, "List failed", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+
+		// HTTP dates have a resolution of one second
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err == nil && !lastModified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	files = options.filter(files)
+	total := len(files)
+	files = options.apply(files)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Files []listedFile `json:"files"`
+		Total int          `json:"total"`
+	}{
+		Files: files,
+		Total: total,
+	})
+}
+
+// listOptions are the query parameters of ListHandler: sort is name, size or
+// modified, order is asc or desc, and limit and offset select a page. A limit
+// of 0 means no limit.
+//
+// Files can be filtered by q, a glob pattern matched against base names if it
+// contains *, ? or [, otherwise a substring of names, case-insensitive unless
+// case_sensitive is true, by size with min_size and max_size in bytes and by
+// modification time with modified_after and modified_before in RFC 3339.
+type listOptions struct {
+	sort   string
+	desc   bool
+	limit  int
+	offset int
+
+	query          string
+	glob           bool
+	caseSensitive  bool
+	minSize        int64
+	maxSize        int64
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+}
+
+// parseListOptions reads the listing options of r, by default all files in
+// ascending order of name
+func parseListOptions(r *http.Request) (listOptions, error) {
+	query := r.URL.Query()
+	options := listOptions{sort: "name"}
+
+	if v := query.Get("sort"); v != "" {
+		if v != "name" && v != "size" && v != "modified" {
+			return options, fmt.Errorf("sort must be name, size or modified")
+		}
+		options.sort = v
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		options.desc = true
+	default:
+		return options, fmt.Errorf("order must be asc or desc")
+	}
+
+	for key, value := range map[string]*int{"limit": &options.limit, "offset": &options.offset} {
+		v := query.Get(key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return options, fmt.Errorf("%s must be a non-negative integer", key)
+		}
+		*value = n
+	}
+
+	options.caseSensitive, _ = strconv.ParseBool(query.Get("case_sensitive"))
+	options.query = query.Get("q")
+	if !options.caseSensitive {
+		options.query = strings.ToLower(options.query)
+	}
+	options.glob = strings.ContainsAny(options.query, "*?[")
+	if _, err := path.Match(options.query, ""); options.glob && err != nil {
+		return options, fmt.Errorf("q is not a valid pattern")
+	}
+
+	options.maxSize = -1
+	for key, value := range map[string]*int64{"min_size": &options.minSize, "max_size": &options.maxSize} {
+		v := query.Get(key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return options, fmt.Errorf("%s must be a non-negative integer", key)
+		}
+		*value = n
+	}
+
+	for key, value := range map[string]*time.Time{"modified_after": &options.modifiedAfter, "modified_before": &options.modifiedBefore} {
+		v := query.Get(key)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return options, fmt.Errorf("%s must be a time such as 2006-01-02T15:04:05Z", key)
+		}
+		*value = t
+	}
+
+	return options, nil
+}
+
+// filter returns the files matching the query, size and time filters
+func (o listOptions) filter(files []listedFile) []listedFile {
+	matched := []listedFile{}
+	for _, f := range files {
+		name := f.Name
+		if !o.caseSensitive {
+			name = strings.ToLower(name)
+		}
+
+		switch {
+		case o.glob:
+			if ok, _ := path.Match(o.query, path.Base(name)); !ok {
+				continue
+			}
+		case !strings.Contains(name, o.query):
+			continue
+		}
+
+		if f.Size < o.minSize || (o.maxSize >= 0 && f.Size > o.maxSize) {
+			continue
+		}
+		if (!o.modifiedAfter.IsZero() && !f.Modified.After(o.modifiedAfter)) ||
+			(!o.modifiedBefore.IsZero() && !f.Modified.Before(o.modifiedBefore)) {
+			continue
+		}
+
+		matched = append(matched, f)
+	}
+
+	return matched
+}
+
+// apply sorts files and returns the requested page. Files with the same size
+// or modification time are ordered by name so that pages are stable.
+func (o listOptions) apply(files []listedFile) []listedFile {
+	less := func(a listedFile, b listedFile) bool {
+		switch {
+		case o.sort == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case o.sort == "modified" && !a.Modified.Equal(b.Modified):
+			return a.Modified.Before(b.Modified)
+		}
+		return a.Name < b.Name
+	}
+	sort.Slice(files, func(i int, j int) bool {
+		if o.desc {
+			return less(files[j], files[i])
+		}
+		return less(files[i], files[j])
+	})
+
+	if o.offset >= len(files) {
+		return []listedFile{}
+	}
+	files = files[o.offset:]
+	if o.limit > 0 && o.limit < len(files) {
+		files = files[:o.limit]
+	}
+
+	return files
+}
+
+// listFiles walks dir and returns its visible files in lexical order, and the
+// most recent modification time among them and the directories containing
+// them, which changes when a file is removed too. A directory which doesn't
+// exist yet is empty.
+func listFiles(dir string, httpConfig configurationmanager.HTTPConfig) ([]listedFile, time.Time, error) {
+	files := []listedFile{}
+	var lastModified time.Time
+	err := walk(dir, httpConfig.WalkConcurrency, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			lastModified = info.ModTime()
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if isHidden(name, httpConfig.HiddenPatterns) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if info.ModTime().After(lastModified) {
+				lastModified = info.ModTime()
+			}
+			// Files below would be deeper than the limit
+			if httpConfig.MaxPathDepth > 0 && pathDepth(name) >= httpConfig.MaxPathDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+
+		files = append(files, listedFile{
+			Name:     name,
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC(),
+		})
+		return nil
+	})
+
+	return files, lastModified, err
+}
+
+// isHidden reports whether name, a slash separated path relative to a served
+// directory, must not be exposed. Internal files, i.e. temporary files,
+// checksum sidecars and name indexes, are always hidden wherever they are, e.g.
+// in the directories of users under a served directory. Otherwise a file is
+// hidden when an element of its path matches one of patterns, so the content
+// of a hidden directory is hidden too.
+func isHidden(name string, patterns []string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if isInternalFile(path.Base(name)) {
+		return true
+	}
+
+	for _, element := range strings.Split(name, "/") {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, element); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Hidden wraps a handler of stored files so that requests for hidden files get
+// the error page with a 404 status, as if they didn't exist
+func Hidden(action string, h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+
+		name, _ := resolvePath("", r.URL.Path)
+		if name != "" && isHidden(name, httpConfig.HiddenPatterns) {
+			renderError(w, r, http.StatusNotFound, fmt.Sprintf("%s %s failed", action, name), fmt.Sprintf("%s does not exist", name))
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
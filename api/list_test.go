@@ -0,0 +1,343 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func list(t *testing.T) []string {
+	names, _ := listQuery("", t)
+	return names
+}
+
+// listQuery requests the listing with the given query string and returns the
+// names of the listed files and the total number of files
+func listQuery(query string, t *testing.T) ([]string, int) {
+	w := httptest.NewRecorder()
+	ListHandler(w, httptest.NewRequest("GET", "/list?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d for %q, got %d", http.StatusOK, query, w.Code)
+	}
+
+	var response struct {
+		Files []listedFile `json:"files"`
+		Total int          `json:"total"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+
+	names := []string{}
+	for _, f := range response.Files {
+		names = append(names, f.Name)
+	}
+	return names, response.Total
+}
+
+func TestList(t *testing.T) {
+	dir := makeTempDir("TestList", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	writeFile(filepath.Join(dir, "b.txt"), "12345", t)
+	writeFile(filepath.Join(dir, "b.txt"+checksumSuffix), "sum", t)
+	writeFile(filepath.Join(dir, tempName("c.txt")), "partial", t)
+	writeFile(filepath.Join(dir, "sub", "a.txt"), "1", t)
+
+	names := list(t)
+	if len(names) != 2 || names[0] != "b.txt" || names[1] != "sub/a.txt" {
+		t.Fatalf("unexpected listing %q", names)
+	}
+}
+
+func TestStoredTmpFileVisible(t *testing.T) {
+	dir := makeTempDir("TestStoredTmpFileVisible", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("report.tmp", "content", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	writeFile(filepath.Join(dir, tempName("other.txt")), "partial", t)
+
+	if names := list(t); len(names) != 1 || names[0] != "report.tmp" {
+		t.Fatalf("unexpected listing %q", names)
+	}
+
+	h := http.StripPrefix("/download/", Hidden("Download", http.FileServer(http.Dir(dir))))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/download/report.tmp", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("expected report.tmp to be downloaded, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ArchiveHandler(w, httptest.NewRequest("GET", "/archive?files=report.tmp", nil))
+	if files := unzip(w.Body.Bytes(), t); files["report.tmp"] != "content" {
+		t.Fatalf("expected report.tmp to be archived, got %v", files)
+	}
+}
+
+func TestInternalFilesHidden(t *testing.T) {
+	dir := makeTempDir("TestInternalFilesHidden", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	// Files of per-user directories seen from the top directory
+	os.MkdirAll(filepath.Join(dir, "alice"), 0755)
+	writeFile(filepath.Join(dir, "alice", "a_b.txt"), "content", t)
+	writeFile(filepath.Join(dir, "alice", "a_b.txt"+checksumSuffix), "sum", t)
+	writeFile(filepath.Join(dir, "alice", nameIndexFile), `{"a_b.txt": "a b.txt"}`, t)
+
+	if names := list(t); len(names) != 1 || names[0] != "alice/a_b.txt" {
+		t.Fatalf("unexpected listing %q", names)
+	}
+
+	h := http.StripPrefix("/download/", Hidden("Download", http.FileServer(http.Dir(dir))))
+	for p, expected := range map[string]int{
+		"/download/alice/a_b.txt":                  http.StatusOK,
+		"/download/alice/" + nameIndexFile:         http.StatusNotFound,
+		"/download/alice/a_b.txt" + checksumSuffix: http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if w.Code != expected {
+			t.Errorf("expected status %d for %s, got %d", expected, p, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	ArchiveHandler(w, httptest.NewRequest("GET", "/archive?files=alice/"+nameIndexFile, nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestHiddenPatterns(t *testing.T) {
+	dir := makeTempDir("TestHiddenPatterns", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `hidden_patterns = [".*", "*.bak"]`, t)
+
+	os.MkdirAll(filepath.Join(dir, ".git"), 0755)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	writeFile(filepath.Join(dir, "a.txt"), "a", t)
+	writeFile(filepath.Join(dir, ".env"), "secret", t)
+	writeFile(filepath.Join(dir, ".git", "config"), "config", t)
+	writeFile(filepath.Join(dir, "sub", "b.bak"), "backup", t)
+	writeFile(filepath.Join(dir, "sub", "b.txt"), "b", t)
+	writeFile(filepath.Join(dir, "sub", tempName("b.txt")), "partial", t)
+
+	names := list(t)
+	if len(names) != 2 || names[0] != "a.txt" || names[1] != "sub/b.txt" {
+		t.Fatalf("unexpected listing %q", names)
+	}
+
+	h := http.StripPrefix("/download/", Hidden("Download", http.FileServer(http.Dir(dir))))
+	for p, expected := range map[string]int{
+		"/download/a.txt":                    http.StatusOK,
+		"/download/sub/b.txt":                http.StatusOK,
+		"/download/.env":                     http.StatusNotFound,
+		"/download/.git/config":              http.StatusNotFound,
+		"/download/sub/b.bak":                http.StatusNotFound,
+		"/download/sub/../.env":              http.StatusNotFound,
+		"/download/sub/" + tempName("b.txt"): http.StatusNotFound,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = p
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Fatalf("expected status %d for %s, got %d", expected, p, w.Code)
+		}
+	}
+}
+
+func TestListIfModifiedSince(t *testing.T) {
+	dir := makeTempDir("TestListIfModifiedSince", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	get := func(since string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/list", nil)
+		if since != "" {
+			r.Header.Set("If-Modified-Since", since)
+		}
+		w := httptest.NewRecorder()
+		ListHandler(w, r)
+		return w
+	}
+
+	old := time.Now().Add(-time.Hour)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	writeFile(filepath.Join(dir, "sub", "a.txt"), "a", t)
+	for _, p := range []string{filepath.Join(dir, "sub", "a.txt"), filepath.Join(dir, "sub"), dir} {
+		os.Chtimes(p, old, old)
+	}
+
+	w := get("")
+	lastModified := w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || lastModified != old.UTC().Format(http.TimeFormat) {
+		t.Fatalf("unexpected response %d with Last-Modified %q", w.Code, lastModified)
+	}
+
+	// Unchanged
+	if w := get(lastModified); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+
+	// A file is modified
+	newer := old.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "sub", "a.txt"), newer, newer)
+	if w := get(lastModified); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	lastModified = newer.UTC().Format(http.TimeFormat)
+	if w := get(lastModified); w.Code != http.StatusNotModified {
+		t.Fatalf("expected status %d, got %d", http.StatusNotModified, w.Code)
+	}
+
+	// A file is removed
+	os.Remove(filepath.Join(dir, "sub", "a.txt"))
+	if w := get(lastModified); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestListMaxPathDepth(t *testing.T) {
+	dir := makeTempDir("TestListMaxPathDepth", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "max_path_depth = 2", t)
+
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	writeFile(filepath.Join(dir, "1.txt"), "1", t)
+	writeFile(filepath.Join(dir, "a", "2.txt"), "2", t)
+	writeFile(filepath.Join(dir, "a", "b", "3.txt"), "3", t)
+
+	names := list(t)
+	if len(names) != 2 || names[0] != "1.txt" || names[1] != "a/2.txt" {
+		t.Fatalf("unexpected listing %q", names)
+	}
+}
+
+func TestListSortAndPagination(t *testing.T) {
+	dir := makeTempDir("TestListSortAndPagination", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	// Names, sizes and modification times are in different orders, and b and
+	// d have the same size and time
+	now := time.Now().Truncate(time.Second)
+	for _, f := range []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"a.txt", 3, time.Minute},
+		{"b.txt", 1, 3 * time.Minute},
+		{"c.txt", 2, 2 * time.Minute},
+		{"d.txt", 1, 3 * time.Minute},
+	} {
+		path := filepath.Join(dir, f.name)
+		writeFile(path, strings.Repeat("x", f.size), t)
+		os.Chtimes(path, now.Add(-f.age), now.Add(-f.age))
+	}
+
+	for query, expected := range map[string]string{
+		"":                           "a.txt b.txt c.txt d.txt",
+		"sort=name&order=desc":       "d.txt c.txt b.txt a.txt",
+		"sort=size":                  "b.txt d.txt c.txt a.txt",
+		"sort=size&order=desc":       "a.txt c.txt d.txt b.txt",
+		"sort=modified":              "b.txt d.txt c.txt a.txt",
+		"sort=modified&order=desc":   "a.txt c.txt d.txt b.txt",
+		"limit=2":                    "a.txt b.txt",
+		"limit=2&offset=2":           "c.txt d.txt",
+		"limit=3&offset=3":           "d.txt",
+		"offset=4":                   "",
+		"offset=10":                  "",
+		"limit=0&offset=1":           "b.txt c.txt d.txt",
+		"sort=size&limit=2&offset=1": "d.txt c.txt",
+	} {
+		names, total := listQuery(query, t)
+		if strings.Join(names, " ") != expected || total != 4 {
+			t.Fatalf("expected %q and a total of 4 for %q, got %q and %d", expected, query, names, total)
+		}
+	}
+
+	for _, query := range []string{"sort=type", "order=up", "limit=-1", "offset=x"} {
+		w := httptest.NewRecorder()
+		ListHandler(w, httptest.NewRequest("GET", "/list?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %q, got %d", http.StatusBadRequest, query, w.Code)
+		}
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	dir := makeTempDir("TestListFilter", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	os.MkdirAll(filepath.Join(dir, "2024"), 0755)
+	for _, f := range []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"Report-Q1.pdf", 10, 3 * time.Hour},
+		{"report-q2.pdf", 20, 2 * time.Hour},
+		{"2024/report-q3.txt", 30, time.Hour},
+		{"notes.txt", 40, 0},
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(f.name))
+		writeFile(path, strings.Repeat("x", f.size), t)
+		os.Chtimes(path, now.Add(-f.age), now.Add(-f.age))
+	}
+
+	at := func(age time.Duration) string {
+		return url.QueryEscape(now.Add(-age).Format(time.RFC3339))
+	}
+	for query, expected := range map[string]string{
+		// Glob on base names
+		"q=report*":                     "2024/report-q3.txt Report-Q1.pdf report-q2.pdf",
+		"q=report*.pdf":                 "Report-Q1.pdf report-q2.pdf",
+		"q=report*&case_sensitive=true": "2024/report-q3.txt report-q2.pdf",
+		"q=*.TXT":                       "2024/report-q3.txt notes.txt",
+		"q=report-q[12].pdf":            "Report-Q1.pdf report-q2.pdf",
+		// Substring of names
+		"q=q1":                    "Report-Q1.pdf",
+		"q=2024/":                 "2024/report-q3.txt",
+		"q=Q&case_sensitive=true": "Report-Q1.pdf",
+		"q=nothing":               "",
+		// Ranges, inclusive for sizes and exclusive for times
+		"min_size=20":                       "2024/report-q3.txt notes.txt report-q2.pdf",
+		"max_size=20":                       "Report-Q1.pdf report-q2.pdf",
+		"min_size=20&max_size=30":           "2024/report-q3.txt report-q2.pdf",
+		"modified_after=" + at(2*time.Hour): "2024/report-q3.txt notes.txt",
+		"modified_before=" + at(time.Hour):  "Report-Q1.pdf report-q2.pdf",
+		"q=report&min_size=15&modified_before=" + at(30*time.Minute): "2024/report-q3.txt report-q2.pdf",
+	} {
+		names, total := listQuery(query, t)
+		if strings.Join(names, " ") != expected || total != len(names) {
+			t.Fatalf("expected %q for %q, got %q and a total of %d", expected, query, names, total)
+		}
+	}
+
+	for _, query := range []string{"q=[a-", "min_size=-1", "max_size=x", "modified_after=yesterday"} {
+		w := httptest.NewRecorder()
+		ListHandler(w, httptest.NewRequest("GET", "/list?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for %q, got %d", http.StatusBadRequest, query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+)
+
+// magicSignature is a sequence of bytes found at offset in files of a format
+type magicSignature struct {
+	offset int
+	magic  string
+}
+
+// magicSignatures maps lowercase extensions to the signatures of their
+// format, one of which files with the extension must start with. Extensions
+// missing here aren't checked.
+var magicSignatures = map[string][]magicSignature{
+	".png":  {{0, "\x89PNG\r\n\x1a\n"}},
+	".jpg":  {{0, "\xff\xd8\xff"}},
+	".jpeg": {{0, "\xff\xd8\xff"}},
+	".gif":  {{0, "GIF87a"}, {0, "GIF89a"}},
+	".pdf":  {{0, "%PDF-"}},
+	// Empty and spanned archives have their own signatures
+	".zip": {{0, "PK\x03\x04"}, {0, "PK\x05\x06"}, {0, "PK\x07\x08"}},
+	".gz":  {{0, "\x1f\x8b"}},
+	".tgz": {{0, "\x1f\x8b"}},
+	".7z":  {{0, "7z\xbc\xaf\x27\x1c"}},
+	".tar": {{257, "ustar"}},
+}
+
+// magicMatches reports whether head, the beginning of a file stored as
+// filename, has a signature of the format of its extension
+func magicMatches(filename string, head []byte) bool {
+	signatures, ok := magicSignatures[strings.ToLower(path.Ext(filename))]
+	if !ok {
+		return true
+	}
+	for _, s := range signatures {
+		if len(head) >= s.offset+len(s.magic) && bytes.Equal(head[s.offset:s.offset+len(s.magic)], []byte(s.magic)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkMagic verifies that u starts with a signature of the format of its
+// extension when verify_magic_bytes is enabled
+func checkMagic(u upload, httpConfig configurationmanager.HTTPConfig) error {
+	if !httpConfig.VerifyMagicBytes || magicMatches(u.filename, u.head) {
+		return nil
+	}
+
+	return httpError{
+		status: http.StatusUnsupportedMediaType,
+		code:   codeUnsupportedType,
+		err:    fmt.Errorf("content does not start with the signature of %s files", strings.ToLower(path.Ext(u.filename))),
+	}
+}
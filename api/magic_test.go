@@ -0,0 +1,81 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMagicMatches(t *testing.T) {
+	tar := strings.Repeat("\x00", 257) + "ustar\x0000"
+	tests := []struct {
+		filename string
+		head     string
+		matches  bool
+	}{
+		{"image.png", "\x89PNG\r\n\x1a\n\x00\x00", true},
+		{"IMAGE.PNG", "\x89PNG\r\n\x1a\n", true},
+		{"image.png", "\xff\xd8\xff\xe0", false},
+		{"photo.jpeg", "\xff\xd8\xff\xe0", true},
+		{"photo.jpg", "GIF89a", false},
+		{"anim.gif", "GIF87a", true},
+		{"doc.pdf", "%PDF-1.7\n", true},
+		{"doc.pdf", "<html>", false},
+		{"archive.zip", "PK\x03\x04", true},
+		{"empty.zip", "PK\x05\x06", true},
+		{"archive.zip", "PK", false},
+		{"archive.tar", tar, true},
+		{"archive.tar", tar[:258], false},
+		{"archive.tar.gz", "\x1f\x8b\x08", true},
+		{"notes.txt", "\x89PNG\r\n\x1a\n", true},
+		{"program", "\x7fELF", true},
+	}
+	for _, test := range tests {
+		if matches := magicMatches(test.filename, []byte(test.head)); matches != test.matches {
+			t.Errorf("%s starting with %q: expected %t, got %t", test.filename, test.head, test.matches, matches)
+		}
+	}
+}
+
+func TestUploadVerifyMagicBytes(t *testing.T) {
+	dir := makeTempDir("TestUploadVerifyMagicBytes", t)
+	defer os.RemoveAll(dir)
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 1024)
+	script := "#!/bin/sh\nrm -rf /\n"
+	tests := []struct {
+		verify   bool
+		name     string
+		content  string
+		filename string
+		status   int
+	}{
+		{true, "image.png", png, "", http.StatusCreated},
+		{true, "image.png", script, "", http.StatusUnsupportedMediaType},
+		// The signature is checked against the final name
+		{true, "script", script, "image.png", http.StatusUnsupportedMediaType},
+		{true, "doc.pdf", "%PDF-1.4\n" + script, "", http.StatusCreated},
+		{true, "doc.pdf", png, "", http.StatusUnsupportedMediaType},
+		{true, "photo.jpg", "\xff\xd8\xff\xe0" + script, "", http.StatusCreated},
+		{true, "photo.jpg", png, "", http.StatusUnsupportedMediaType},
+		{true, "archive.zip", "PK\x03\x04" + script, "", http.StatusCreated},
+		{true, "archive.zip", "", "", http.StatusUnsupportedMediaType},
+		{true, "script.sh", script, "", http.StatusCreated},
+		{false, "image.png", script, "", http.StatusCreated},
+	}
+	for _, test := range tests {
+		loadConfig(dir, fmt.Sprintf("verify_magic_bytes = %t", test.verify), t)
+
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(test.name, test.content, test.filename, t))
+		if w.Code != test.status {
+			t.Errorf("verify_magic_bytes = %t, %s as %q: expected status %d, got %d",
+				test.verify, test.name, test.filename, test.status, w.Code)
+		}
+	}
+	// image.png is stored twice
+	fileCount(dir, 5, t)
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+// nameIndexFile is the file at the top of the directory of a user mapping the
+// names of stored files to the names they were uploaded under, when they
+// differ
+const nameIndexFile = ".fileserver-names.json"
+
+// collisionSuffixRoom is the longest suffix expected to be added by
+// utilities.UniqueFilename to names colliding after sanitization
+const collisionSuffixRoom = "(999999)"
+
+// nameIndexMutex serializes updates of name indexes
+var nameIndexMutex sync.Mutex
+
+// readNameIndex returns the name index of dir, which is empty if it doesn't
+// exist yet
+func readNameIndex(dir string) (map[string]string, error) {
+	index := make(map[string]string)
+	data, err := ioutil.ReadFile(filepath.Join(dir, nameIndexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return index, json.Unmarshal(data, &index)
+}
+
+// originalName returns the name the file stored as filename in dir was
+// uploaded under. Files missing from the index were uploaded under their
+// stored name.
+func originalName(dir string, filename string) (string, error) {
+	nameIndexMutex.Lock()
+	defer nameIndexMutex.Unlock()
+
+	index, err := readNameIndex(dir)
+	if err != nil {
+		return "", err
+	}
+	if original, ok := index[filename]; ok {
+		return original, nil
+	}
+
+	return filename, nil
+}
+
+// storedName returns the name of an existing file stored in the directory
+// named parent, relative to dir, which was uploaded under original, or an
+// empty name if there is none
+func storedName(dir string, parent string, original string) (string, error) {
+	nameIndexMutex.Lock()
+	index, err := readNameIndex(dir)
+	nameIndexMutex.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	names := []string{}
+	for filename, o := range index {
+		if o == original && path.Dir(filename) == parent {
+			names = append(names, filename)
+		}
+	}
+	sort.Strings(names)
+	for _, filename := range names {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(filename)))
+		if err == nil {
+			return filename, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	return "", nil
+}
+
+// recordOriginalName records in the name index of dir that the file stored as
+// filename was uploaded under original. The index is only written if it
+// changes.
+func recordOriginalName(dir string, filename string, original string) error {
+	nameIndexMutex.Lock()
+	defer nameIndexMutex.Unlock()
+
+	index, err := readNameIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	previous, ok := index[filename]
+	if original == filename {
+		if !ok {
+			return nil
+		}
+		delete(index, filename)
+	} else {
+		if ok && previous == original {
+			return nil
+		}
+		index[filename] = original
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return utilities.WriteFileAtomic(filepath.Join(dir, nameIndexFile), data, 0644)
+}
+
+// resolveCollision applies the filename collision policy to u, to be stored in
+// dir, when its sanitized name is the name of an existing file uploaded under
+// another name. u is renamed to the name an earlier upload of the same name
+// was stored as, or a free name given by utilities.UniqueFilename, or
+// rejected with 409.
+func resolveCollision(dir string, u *upload, httpConfig configurationmanager.HTTPConfig) error {
+	if httpConfig.FilenameCollisionPolicy == configurationmanager.FilenameCollisionOverwrite {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(u.filename))); os.IsNotExist(err) {
+		return nil
+	}
+	original, err := originalName(dir, u.filename)
+	if err != nil || original == u.original {
+		return err
+	}
+
+	if httpConfig.FilenameCollisionPolicy == configurationmanager.FilenameCollisionReject {
+		return httpError{
+			status: http.StatusConflict,
+			code:   codeNameCollision,
+			err:    fmt.Errorf("%s is already stored from %s", u.filename, original),
+		}
+	}
+
+	// Uploading the same name again overwrites its earlier upload
+	parent := path.Dir(u.filename)
+	filename, err := storedName(dir, parent, u.original)
+	if err != nil {
+		return err
+	}
+
+	if filename == "" {
+		// Leave room for the suffix within the length limit
+		base := path.Base(u.filename)
+		if len(base) > httpConfig.MaxFilenameLength-len(collisionSuffixRoom) {
+			base = utilities.TruncateFilename(base, httpConfig.MaxFilenameLength-len(collisionSuffixRoom))
+		}
+		base, err = utilities.UniqueFilename(filepath.Join(dir, filepath.FromSlash(parent)), base)
+		if err != nil {
+			return err
+		}
+		filename = path.Join(parent, base)
+	}
+	u.filename = filename
+
+	return activate(u, dir, httpConfig)
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFilenameCollision(t *testing.T) {
+	dir := makeTempDir("TestFilenameCollision", t)
+	defer os.RemoveAll(dir)
+
+	send := func(name string, content string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(name, content, "", t))
+		return w
+	}
+	location := func(w *httptest.ResponseRecorder) string {
+		l, _ := url.PathUnescape(w.Header().Get("Location"))
+		return l
+	}
+	stored := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		return string(data)
+	}
+
+	// "a b.txt" and "a_b.txt" are both stored as a_b.txt
+	loadConfig(dir, `filename_collision_policy = "reject"`, t)
+	if w := send("a b.txt", "first"); w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if w := send("a_b.txt", "second"); w.Code != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+	if stored("a_b.txt") != "first" {
+		t.Fatalf("a_b.txt was overwritten")
+	}
+	// The same name overwrites
+	if w := send("a b.txt", "third"); w.Code != http.StatusCreated || stored("a_b.txt") != "third" {
+		t.Fatalf("expected a_b.txt to be overwritten, got status %d", w.Code)
+	}
+
+	loadConfig(dir, `filename_collision_policy = "suffix"`, t)
+	w := send("a_b.txt", "fourth")
+	if w.Code != http.StatusCreated || location(w) != "/download/a_b(1).txt" {
+		t.Fatalf("expected a_b(1).txt to be stored, got status %d and location %q", w.Code, location(w))
+	}
+	if stored("a_b.txt") != "third" || stored("a_b(1).txt") != "fourth" {
+		t.Fatalf("unexpected contents %q and %q", stored("a_b.txt"), stored("a_b(1).txt"))
+	}
+	// Uploading the suffixed name again overwrites its earlier upload
+	if w := send("a_b.txt", "fifth"); location(w) != "/download/a_b(1).txt" || stored("a_b(1).txt") != "fifth" {
+		t.Fatalf("expected a_b(1).txt to be overwritten, got location %q", location(w))
+	}
+	if w := send("a?b.txt", "sixth"); location(w) != "/download/a_b(2).txt" {
+		t.Fatalf("expected a_b(2).txt to be stored, got location %q", location(w))
+	}
+
+	// The index is hidden
+	if files := list(t); !reflect.DeepEqual(files, []string{"a_b(1).txt", "a_b(2).txt", "a_b.txt"}) {
+		t.Errorf("unexpected files %v", files)
+	}
+
+	// Suffixed names stay within the length limit
+	loadConfig(dir, `filename_collision_policy = "suffix"
+max_filename_length = 16`, t)
+	send("long name.txt", "long")
+	for i := 0; i < 2; i++ {
+		w := send("long?name.txt", "other")
+		name := location(w)[len("/download/"):]
+		if w.Code != http.StatusCreated || len(name) > 16 || name == "long_name.txt" || stored(name) != "other" {
+			t.Fatalf("unexpected status %d and name %q", w.Code, name)
+		}
+	}
+	if stored("long_name.txt") != "long" {
+		t.Fatalf("long_name.txt was overwritten")
+	}
+
+	// Collisions are ignored by default
+	loadConfig(dir, "", t)
+	if w := send("a?b.txt", "seventh"); w.Code != http.StatusCreated || stored("a_b.txt") != "seventh" {
+		t.Fatalf("expected a_b.txt to be overwritten, got status %d", w.Code)
+	}
+}
+
+func TestUploadInternalNames(t *testing.T) {
+	dir := makeTempDir("TestUploadInternalNames", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `filename_collision_policy = "suffix"
+filename_path_policy = "subdirectory"`, t)
+
+	send := func(name string, content string) int {
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(name, content, "", t))
+		return w.Code
+	}
+
+	if code := send("a b.txt", "first"); code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, code)
+	}
+	for _, name := range []string{nameIndexFile, "sub/" + nameIndexFile, "a_b.txt" + checksumSuffix, tempName("a_b.txt")} {
+		if code := send(name, "not json"); code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d", http.StatusBadRequest, name, code)
+		}
+	}
+
+	// The name index is intact
+	if code := send("a_b.txt", "second"); code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, code)
+	}
+	if original, err := originalName(dir, "a_b.txt"); err != nil || original != "a b.txt" {
+		t.Fatalf("unexpected original name %q, %v", original, err)
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+)
+
+// ReadyHandler reports whether the server can take uploads. A probe file is
+// written to the file server directory, and to the upload temporary directory
+// if any, read back and removed, so that a full disk or a filesystem gone
+// read-only is noticed where a stat wouldn't. It answers 503 if a step fails
+// or the server is draining.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	mlog := logger.New()
+
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	if Draining() {
+		refuseDraining(w, r)
+		return
+	}
+
+	dirs := []string{httpConfig.FileServerDirectory}
+	if httpConfig.UploadTempDirectory != "" {
+		dirs = append(dirs, httpConfig.UploadTempDirectory)
+	}
+	for _, dir := range dirs {
+		if err := probeDirectory(dir); err != nil {
+			mlog.Critical.Printf("Readiness probe of %s failed: %+v", dir, err)
+			renderError(w, r, http.StatusServiceUnavailable, "Service unavailable", "The server cannot store files")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+	}{
+		Status: "ready",
+	})
+}
+
+// probeDirectory writes a probe file to dir, reads it back and removes it.
+// The probe is named like the temporary file of an upload so that it's never
+// listed, and a probe left behind by a crash is purged with them.
+func probeDirectory(dir string) error {
+	content := []byte(uuid.New().String())
+	path := filepath.Join(dir, fmt.Sprintf(".fileserver-go-ready.%s.tmp", content))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	_, err = f.Write(content)
+	if err == nil {
+		// Some filesystems only report a full disk when data is flushed
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, content) {
+		return errors.New("probe file was read back altered")
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyHandler(t *testing.T) {
+	dir := makeTempDir("TestReadyHandler", t)
+	defer os.RemoveAll(dir)
+	readOnly := filepath.Join(dir, "read-only")
+	os.Mkdir(readOnly, 0555)
+	notDir := filepath.Join(dir, "file")
+	writeFile(notDir, "content", t)
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		ReadyHandler(w, httptest.NewRequest("GET", "/ready", nil))
+		return w.Code
+	}
+
+	loadConfig(dir, "", t)
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	// The probe is cleaned up
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("expected the probe to be removed, got %d files", len(files))
+	}
+
+	for _, c := range []struct {
+		dir   string
+		extra string
+	}{
+		{notDir, ""},
+		{filepath.Join(dir, "missing"), ""},
+		{dir, `upload_temp_directory = "` + notDir + `"`},
+	} {
+		loadConfig(c.dir, c.extra, t)
+		if code := ready(); code != http.StatusServiceUnavailable {
+			t.Errorf("%+v: expected status %d, got %d", c, http.StatusServiceUnavailable, code)
+		}
+	}
+
+	// Permissions don't apply to root
+	if os.Geteuid() != 0 {
+		loadConfig(readOnly, "", t)
+		if code := ready(); code != http.StatusServiceUnavailable {
+			t.Errorf("read-only directory: expected status %d, got %d", http.StatusServiceUnavailable, code)
+		}
+	}
+
+	loadConfig(dir, "", t)
+	SetDraining(true)
+	defer SetDraining(false)
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("draining: expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+// shareClaims is the payload of a share token. Name is the slash separated path
+// of the shared file relative to the file server directory.
+type shareClaims struct {
+	Name    string `json:"f"`
+	Expires int64  `json:"e"`
+	Once    bool   `json:"o,omitempty"`
+	Nonce   string `json:"n"`
+}
+
+var (
+	// usedShares holds the nonce of single use tokens which were used, until
+	// they expire
+	usedShares      = make(map[string]time.Time)
+	usedSharesMutex sync.Mutex
+)
+
+// ShareHandler creates a link to download the file named by the form value
+// filename without authentication until the share TTL elapses. If the form
+// value once is true, the link can only be used once.
+func ShareHandler(w http.ResponseWriter, r *http.Request) {
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	if len(httpConfig.ShareKey) == 0 {
+		renderError(w, r, http.StatusNotFound, "Not found", "Sharing is disabled")
+		return
+	}
+
+	name, localPath := resolvePath(userDirectory(r, httpConfig), r.FormValue("filename"))
+	info, err := os.Stat(localPath)
+	if err != nil || !info.Mode().IsRegular() || isHidden(name, httpConfig.HiddenPatterns) {
+		renderError(w, r, http.StatusNotFound, fmt.Sprintf("Share %s failed", name), fmt.Sprintf("%s does not exist", name))
+		return
+	}
+
+	once, _ := strconv.ParseBool(r.FormValue("once"))
+	expires := time.Now().Add(httpConfig.ShareTTL)
+	claims := shareClaims{
+		Name:    path.Join(userPrefix(r, httpConfig), name),
+		Expires: expires.Unix(),
+		Once:    once,
+		Nonce:   uuid.New().String(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		renderError(w, r, http.StatusInternalServerError, fmt.Sprintf("Share %s failed", name), fmt.Sprintf("%+v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}{
+		URL:     "/shared/" + utilities.SignToken(payload, httpConfig.ShareKey),
+		Expires: expires.UTC(),
+	})
+}
+
+// SharedHandler wraps a file server rooted at the file server directory so that
+// it serves the file of the share token in the request path. Requests bypass
+// authentication because the token is the credential. Invalid tokens get 403,
+// expired and already used tokens get 410.
+func SharedHandler(h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+
+		if len(httpConfig.ShareKey) == 0 {
+			renderError(w, r, http.StatusNotFound, "Not found", "Sharing is disabled")
+			return
+		}
+
+		var claims shareClaims
+		payload, err := utilities.VerifyToken(r.URL.Path, httpConfig.ShareKey)
+		if err == nil {
+			err = json.Unmarshal(payload, &claims)
+		}
+		if err != nil {
+			renderError(w, r, http.StatusForbidden, "Download failed", "The link is invalid")
+			return
+		}
+
+		expires := time.Unix(claims.Expires, 0)
+		if !time.Now().Before(expires) {
+			renderError(w, r, http.StatusGone, "Download failed", "The link has expired")
+			return
+		}
+		if claims.Once && !useShare(claims.Nonce, expires) {
+			renderError(w, r, http.StatusGone, "Download failed", "The link was already used")
+			return
+		}
+
+		shared := new(http.Request)
+		*shared = *r
+		shared.URL = new(url.URL)
+		*shared.URL = *r.URL
+		shared.URL.Path = claims.Name
+		shared.URL.RawPath = ""
+
+		h.ServeHTTP(w, shared)
+	})
+}
+
+// useShare records that the single use token with nonce was used and reports
+// whether it's the first time. Records of expired tokens are dropped since
+// those tokens are rejected anyway.
+func useShare(nonce string, expires time.Time) bool {
+	usedSharesMutex.Lock()
+	defer usedSharesMutex.Unlock()
+
+	now := time.Now()
+	for n, e := range usedShares {
+		if !now.Before(e) {
+			delete(usedShares, n)
+		}
+	}
+
+	if _, ok := usedShares[nonce]; ok {
+		return false
+	}
+	usedShares[nonce] = expires
+	return true
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+const testShareKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// share requests a share link of filename and returns its path
+func share(filename string, once bool, t *testing.T) string {
+	form := url.Values{"filename": {filename}}
+	if once {
+		form.Set("once", "true")
+	}
+	r := httptest.NewRequest("POST", "/share", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ShareHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var response struct {
+		URL     string    `json:"url"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	return response.URL
+}
+
+// download requests a share link and returns the response
+func download(link string, dir string) *httptest.ResponseRecorder {
+	h := http.StripPrefix("/shared/", SharedHandler(http.FileServer(http.Dir(dir))))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", link, nil))
+	return w
+}
+
+func TestShare(t *testing.T) {
+	dir := makeTempDir("TestShare", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `share_key = "`+testShareKey+`"`, t)
+
+	writeFile(filepath.Join(dir, "a.txt"), "content", t)
+
+	link := share("a.txt", false, t)
+	for i := 0; i < 2; i++ {
+		w := download(link, dir)
+		if w.Code != http.StatusOK || w.Body.String() != "content" {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	// Single use links
+	link = share("a.txt", true, t)
+	if w := download(link, dir); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if w := download(link, dir); w.Code != http.StatusGone {
+		t.Fatalf("expected status %d, got %d", http.StatusGone, w.Code)
+	}
+
+	// Missing files can't be shared
+	r := httptest.NewRequest("POST", "/share?filename=missing.txt", nil)
+	w := httptest.NewRecorder()
+	ShareHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestShareInvalidToken(t *testing.T) {
+	dir := makeTempDir("TestShareInvalidToken", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `share_key = "`+testShareKey+`"`, t)
+
+	writeFile(filepath.Join(dir, "a.txt"), "content", t)
+	writeFile(filepath.Join(dir, "b.txt"), "secret", t)
+	key := configurationmanager.New().GetHTTPConfig().ShareKey
+
+	link := share("a.txt", false, t)
+	signature := link[strings.Index(link, "."):]
+
+	// The payload is changed to another file but the signature is kept
+	forged, _ := json.Marshal(shareClaims{Name: "b.txt", Expires: time.Now().Add(time.Hour).Unix()})
+	tampered := "/shared/" + strings.SplitN(utilities.SignToken(forged, key), ".", 2)[0] + signature
+
+	// Signed with another key
+	otherKey := utilities.SignToken(forged, []byte("0123456789abcdef0123456789abcdef"))
+
+	for _, l := range []string{tampered, "/shared/" + otherKey, "/shared/garbage", link + "x"} {
+		if w := download(l, dir); w.Code != http.StatusForbidden {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusForbidden, l, w.Code)
+		}
+	}
+
+	expired, _ := json.Marshal(shareClaims{Name: "a.txt", Expires: time.Now().Add(-time.Second).Unix()})
+	if w := download("/shared/"+utilities.SignToken(expired, key), dir); w.Code != http.StatusGone {
+		t.Fatalf("expected status %d, got %d", http.StatusGone, w.Code)
+	}
+}
+
+func TestShareDisabled(t *testing.T) {
+	dir := makeTempDir("TestShareDisabled", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	writeFile(filepath.Join(dir, "a.txt"), "content", t)
+
+	w := httptest.NewRecorder()
+	ShareHandler(w, httptest.NewRequest("POST", "/share?filename=a.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	payload, _ := json.Marshal(shareClaims{Name: "a.txt", Expires: time.Now().Add(time.Hour).Unix()})
+	if w := download("/shared/"+utilities.SignToken(payload, nil), dir); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
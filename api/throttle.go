@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+)
+
+// Throttle wraps a handler of downloads on route so that each response is sent
+// at no more than the rate limit of the route, download_rate_limit unless it's
+// overridden in download_rate_limits
+func Throttle(route string, h http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cm := configurationmanager.New()
+		httpConfig := cm.GetHTTPConfig()
+
+		limit := httpConfig.DownloadRateLimit
+		if l, ok := httpConfig.DownloadRateLimits[route]; ok {
+			limit = l
+		}
+		if limit > 0 {
+			w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), limit: limit, bufferSize: httpConfig.CopyBufferSize}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// throttledWriter writes the body of a response at no more than limit bytes
+// per second on average since its first write. Writing is given up if ctx is
+// done, e.g. when the client is gone.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx        context.Context
+	limit      int64
+	bufferSize int
+	start      time.Time
+	written    int64
+}
+
+// ReadFrom copies src through a pooled buffer of copy_buffer_size bytes. It
+// hides io.ReaderFrom of the wrapped writer, which would send src at full
+// speed.
+func (w *throttledWriter) ReadFrom(src io.Reader) (int64, error) {
+	return copyBuffer(w, src, w.bufferSize)
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	if w.start.IsZero() {
+		w.start = time.Now()
+	}
+
+	// Large writes are split into a tenth of a second worth of bytes each, so
+	// that the response flows steadily rather than in bursts
+	chunkSize := w.limit / 10
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.written += int64(n)
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+
+		if err := w.wait(); err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// wait sleeps until the bytes written so far are due at the rate limit
+func (w *throttledWriter) wait() error {
+	// Split in seconds and a remainder to avoid overflowing durations
+	due := time.Duration(w.written/w.limit)*time.Second + time.Duration(w.written%w.limit)*time.Second/time.Duration(w.limit)
+	d := time.Until(w.start.Add(due))
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+)
+
+func TestThrottle(t *testing.T) {
+	dir := makeTempDir("TestThrottle", t)
+	defer os.RemoveAll(dir)
+	content := strings.Repeat("x", 1500)
+	writeFile(filepath.Join(dir, "file.txt"), content, t)
+
+	download := func(route string) time.Duration {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		Throttle(route, FileServer(dir)).ServeHTTP(w, httptest.NewRequest("GET", "/file.txt", nil))
+		if w.Code != http.StatusOK || w.Body.String() != content {
+			t.Fatalf("%s: unexpected response %d of %d bytes", route, w.Code, w.Body.Len())
+		}
+		return time.Since(start)
+	}
+
+	loadConfig(dir, `download_rate_limit = "1KB"
+[http.download_rate_limits]
+shared = "0"
+archive = "1MB"`, t)
+	// 1500 bytes at 1024 bytes per second
+	if d := download(configurationmanager.RouteDownload); d < 1400*time.Millisecond {
+		t.Errorf("download took %v only", d)
+	}
+	for _, route := range []string{configurationmanager.RouteShared, configurationmanager.RouteArchive} {
+		if d := download(route); d > 500*time.Millisecond {
+			t.Errorf("%s: download took %v", route, d)
+		}
+	}
+
+	// Throttled downloads stop when the client is gone
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/file.txt", nil)
+	ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	Throttle(configurationmanager.RouteDownload, FileServer(dir)).ServeHTTP(w, r.WithContext(ctx))
+	if d := time.Since(start); d > time.Second || w.Body.Len() == len(content) {
+		t.Errorf("download took %v and sent %d bytes", d, w.Body.Len())
+	}
+}
@@ -0,0 +1,1020 @@
+package api
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/anhdowastaken/fileserver-go/audit"
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+// syncer is implemented by files which can be flushed to stable storage
+type syncer interface {
+	Sync() error
+}
+
+var (
+	// syncFile flushes an uploaded file to stable storage. It exists so it can
+	// be mocked out by tests.
+	syncFile = func(f syncer) error {
+		return f.Sync()
+	}
+
+	// syncDir flushes the entries of directory dir to stable storage. It
+	// exists so it can be mocked out by tests.
+	syncDir = func(dir string) error {
+		d, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+
+		return d.Sync()
+	}
+)
+
+// activeUploads is the set of paths being uploaded to, so that a concurrent
+// upload to the same path can be rejected instead of corrupting the first
+var activeUploads sync.Map
+
+// beginUpload marks path as being uploaded to. It returns a 409 error if it
+// already is.
+func beginUpload(path string, httpConfig configurationmanager.HTTPConfig) error {
+	if !httpConfig.RejectConcurrentUploads {
+		return nil
+	}
+	if _, loaded := activeUploads.LoadOrStore(path, struct{}{}); loaded {
+		return httpError{
+			status: http.StatusConflict,
+			code:   codeUploadInProgress,
+			err:    fmt.Errorf("%s is already being uploaded", filepath.Base(path)),
+		}
+	}
+
+	return nil
+}
+
+// endUpload clears the mark of path set by beginUpload
+func endUpload(path string) {
+	activeUploads.Delete(path)
+}
+
+// Codes of upload errors, sent with the error so that clients can tell which
+// stage of the upload failed
+const (
+	// codeParseFailed means the form is malformed
+	codeParseFailed = "parse_failed"
+	// codeInvalidForm means the form exceeds limits on its fields
+	codeInvalidForm = "invalid_form"
+	// codeMissingFile means the form has no file
+	codeMissingFile = "missing_file"
+	// codeInvalidFilename means the name of the file can't be stored
+	codeInvalidFilename = "invalid_filename"
+	// codeTooLarge means the file exceeds its maximum size
+	codeTooLarge = "too_large"
+	// codeSizeMismatch means the file is larger than the size declared in the
+	// form
+	codeSizeMismatch = "size_mismatch"
+	// codeEmptyFile means the file is empty and empty files are rejected
+	codeEmptyFile = "empty_file"
+	// codeUnsupportedType means the content doesn't match the extension
+	codeUnsupportedType = "unsupported_type"
+	// codeUploadInProgress means the same name is being uploaded
+	codeUploadInProgress = "upload_in_progress"
+	// codeNameCollision means the sanitized name is taken by another name
+	codeNameCollision = "name_collision"
+	// codePreconditionFailed means the file was modified after
+	// If-Unmodified-Since
+	codePreconditionFailed = "precondition_failed"
+	// codeImmutable means the file can't be changed yet
+	codeImmutable = "immutable"
+	// codeQuotaExceeded means the quota of the user would be exceeded
+	codeQuotaExceeded = "quota_exceeded"
+	// codeTooManyFiles means the maximum number of files would be exceeded
+	codeTooManyFiles = "too_many_files"
+	// codeLowDiskSpace means the free space of the disk would fall below
+	// MinFreeSpace
+	codeLowDiskSpace = "low_disk_space"
+	// codeReceiveFailed means the content couldn't be read from the client
+	codeReceiveFailed = "receive_failed"
+	// codeWriteFailed means the file couldn't be written
+	codeWriteFailed = "write_failed"
+	// codeRenameFailed means the file couldn't be moved in place
+	codeRenameFailed = "rename_failed"
+)
+
+// withCode returns err as an httpError with status and code, unless it's nil
+// or already an httpError
+func withCode(err error, status int, code string) error {
+	if _, ok := err.(httpError); ok || err == nil {
+		return err
+	}
+
+	return httpError{status: status, code: code, err: err}
+}
+
+// recordingReader records the error of the last read of r, to tell failures
+// to receive content from failures to store it
+type recordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.err = err
+	return n, err
+}
+
+var (
+	// errFileTooLarge is returned by sizeLimitReader when the content exceeds
+	// the maximum size of the file
+	errFileTooLarge = errors.New("file is too large")
+	// errSizeMismatch is returned by sizeLimitReader when the content exceeds
+	// its declared size
+	errSizeMismatch = errors.New("file is larger than declared")
+)
+
+// sizeLimitReader reads from r until more than n bytes are read, then fails
+// with err
+type sizeLimitReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, l.err
+	}
+
+	return n, err
+}
+
+// upload describes a file received by UploadHandler
+type upload struct {
+	// filename is the sanitized name the file is stored as
+	filename string
+	// tmpPath is where the content is written before being moved in place
+	tmpPath string
+	// size is the number of bytes received
+	size int64
+	// sha256 is the SHA-256 sum of the content
+	sha256 []byte
+	// contentType is the type sniffed from the beginning of the content
+	contentType string
+	// head is the beginning of the content, up to 512 bytes
+	head []byte
+	// active is the path marked by beginUpload for the upload, if any
+	active string
+	// original is the name sent by the client, before sanitization
+	original string
+}
+
+// UploadHandler stores the file posted in a multipart form to the file server
+// directory. The form is read part by part so the file is streamed to disk
+// and the other fields are bounded in number and size. PUT requests store
+// their raw body instead, as the file named by the request path.
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	mlog := logger.New()
+
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	dir := userDirectory(r, httpConfig)
+	err := os.MkdirAll(dir, httpConfig.DirMode)
+	if err == nil && httpConfig.UploadTempDirectory != "" {
+		err = os.MkdirAll(httpConfig.UploadTempDirectory, httpConfig.DirMode)
+	}
+	err = withCode(err, http.StatusInternalServerError, codeWriteFailed)
+
+	if err == nil {
+		err = checkDeclaredSize(r, dir, httpConfig)
+	}
+
+	var u upload
+	defer func() {
+		if u.active != "" {
+			endUpload(u.active)
+		}
+	}()
+	if err == nil && r.Method == http.MethodPut {
+		u, err = receiveRawUpload(r, dir, httpConfig)
+	} else if err == nil {
+		u, err = receiveUpload(r, dir, httpConfig)
+	}
+	if err == nil {
+		err = resolveCollision(dir, &u, httpConfig)
+	}
+	if err == nil {
+		err = checkUnmodifiedSince(r, filepath.Join(dir, u.filename))
+	}
+	if err == nil {
+		err = checkImmutable(filepath.Join(dir, u.filename), httpConfig)
+	}
+	if err == nil {
+		err = checkQuota(r, dir, u, httpConfig)
+	}
+	if err == nil {
+		err = checkFileCount(dir, u, httpConfig)
+	}
+	if err == nil {
+		// The received file already takes its space on the disk
+		err = checkFreeSpace(dir, 0, httpConfig)
+	}
+	if err == nil {
+		localFilePath := filepath.Join(dir, filepath.FromSlash(u.filename))
+		_, statErr := os.Lstat(localFilePath)
+		err = os.MkdirAll(filepath.Dir(localFilePath), httpConfig.DirMode)
+		if err == nil {
+			err = utilities.MoveFile(u.tmpPath, localFilePath)
+		}
+		if err == nil && os.IsNotExist(statErr) {
+			adjustFileCount(localFilePath, 1)
+		}
+		err = withCode(err, http.StatusInternalServerError, codeRenameFailed)
+		if err == nil && httpConfig.FilenameCollisionPolicy != configurationmanager.FilenameCollisionOverwrite {
+			err = recordOriginalName(dir, u.filename, u.original)
+		}
+		if err == nil && httpConfig.ChecksumSidecar {
+			err = writeChecksumSidecar(localFilePath, u.sha256)
+		}
+		if err == nil && httpConfig.DurableUpload {
+			// The new directory entry isn't durable until the directory is
+			err = syncDir(filepath.Dir(localFilePath))
+		}
+		invalidateCaches(localFilePath)
+	}
+	// Other failures are failures to access the file system
+	err = withCode(err, http.StatusInternalServerError, codeWriteFailed)
+	if err != nil && u.tmpPath != "" {
+		os.Remove(u.tmpPath)
+	}
+
+	if err != nil {
+		mlog.Critical.Printf("%+v", err)
+		renderHTTPError(w, r, fmt.Sprintf("Upload %s failed", u.filename), err)
+	} else {
+		err = audit.New().Log(audit.Record{
+			User:     Username(r),
+			Action:   audit.UPLOAD,
+			Filename: u.filename,
+			Size:     u.size,
+			SHA256:   hex.EncodeToString(u.sha256),
+		})
+		if err != nil {
+			mlog.Critical.Printf("Cannot record upload of %s in audit log: %+v", u.filename, err)
+		}
+
+		if httpConfig.PostUploadCommand != "" {
+			go runPostUploadCommand(filepath.Join(dir, u.filename), httpConfig)
+		}
+
+		tmpl := template.Must(parseTemplate("success.html"))
+		data := struct {
+			Filename  string
+			RequestID string
+		}{
+			Filename:  u.filename,
+			RequestID: requestID(w),
+		}
+
+		// Point API clients at the canonical download URL of the stored file
+		w.Header().Set("Location", "/download/"+(&url.URL{Path: u.filename}).EscapedPath())
+		setHTMLContentType(w)
+		w.WriteHeader(http.StatusCreated)
+		tmpl.Execute(w, data)
+	}
+}
+
+// receiveUpload reads the multipart form of r and streams its file part to a
+// temporary file in dir. The stored name is taken from the "filename" field if any,
+// otherwise from the name of the file part. Fields may come in any order, but
+// sending "filename" before the file avoids renaming the temporary file. A
+// "size" field before the file declares its size in bytes, so that a file too
+// large or over quota is rejected before its content is read, and content
+// larger than declared is rejected.
+func receiveUpload(r *http.Request, dir string, httpConfig configurationmanager.HTTPConfig) (upload, error) {
+	var u upload
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return u, httpError{status: http.StatusBadRequest, code: codeParseFailed, err: err}
+	}
+
+	newFilename := r.URL.Query().Get("filename")
+	// declared is the size of the file given by the "size" field, if any
+	declared := int64(-1)
+	received := false
+	parts := 0
+	// memory is the total size of the fields read in memory, the file is
+	// streamed to disk instead
+	memory := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return u, httpError{status: http.StatusBadRequest, code: codeParseFailed, err: err}
+		}
+
+		parts++
+		if parts > httpConfig.MaxFormParts {
+			return u, httpError{
+				status: http.StatusBadRequest,
+				code:   codeInvalidForm,
+				err:    fmt.Errorf("form has more than %d parts", httpConfig.MaxFormParts),
+			}
+		}
+
+		if isFilePart(part, httpConfig) {
+			if received {
+				return u, httpError{status: http.StatusBadRequest, code: codeInvalidForm, err: errors.New("form has more than one file")}
+			}
+			received = true
+
+			name := newFilename
+			if name == "" {
+				name = part.FileName()
+			}
+			if declared >= 0 {
+				if err := checkFileDeclaredSize(r, dir, name, declared, httpConfig); err != nil {
+					return u, err
+				}
+			}
+			u, err = receiveFile(part, name, declared, dir, httpConfig)
+			if err != nil {
+				return u, err
+			}
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, int64(httpConfig.MaxFormFieldSize)+1))
+		if err != nil {
+			return u, httpError{status: http.StatusBadRequest, code: codeParseFailed, err: err}
+		}
+		if len(value) > httpConfig.MaxFormFieldSize {
+			return u, httpError{
+				status: http.StatusBadRequest,
+				code:   codeInvalidForm,
+				err:    fmt.Errorf("form field %q is larger than %d bytes", part.FormName(), httpConfig.MaxFormFieldSize),
+			}
+		}
+		memory += len(value)
+		if memory > httpConfig.MultipartMemory {
+			return u, httpError{
+				status: http.StatusBadRequest,
+				code:   codeInvalidForm,
+				err:    fmt.Errorf("form fields are larger than %d bytes", httpConfig.MultipartMemory),
+			}
+		}
+		if part.FormName() == "filename" && len(value) > 0 {
+			newFilename = string(value)
+		}
+		if part.FormName() == "size" && !received {
+			declared, err = strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+			if err != nil || declared < 0 {
+				return u, httpError{
+					status: http.StatusBadRequest,
+					code:   codeInvalidForm,
+					err:    fmt.Errorf("size %q is not a number of bytes", value),
+				}
+			}
+		}
+	}
+
+	if !received {
+		return u, httpError{status: http.StatusBadRequest, code: codeMissingFile, err: http.ErrMissingFile}
+	}
+
+	// The filename field came after the file
+	if newFilename != "" {
+		u.filename, err = uploadFilename(newFilename, httpConfig)
+		if err != nil {
+			return u, err
+		}
+		u.original = newFilename
+		if err := checkFileSize(u, httpConfig); err != nil {
+			return u, err
+		}
+		if err := activate(&u, dir, httpConfig); err != nil {
+			return u, err
+		}
+	}
+
+	return u, checkContent(u, httpConfig)
+}
+
+// receiveRawUpload receives the body of a PUT request as the content of the
+// file named by the request path, into a temporary file in dir
+func receiveRawUpload(r *http.Request, dir string, httpConfig configurationmanager.HTTPConfig) (upload, error) {
+	name := rawUploadName(r)
+	if name == "" {
+		return upload{}, httpError{status: http.StatusBadRequest, code: codeInvalidFilename, err: errors.New("filename is missing")}
+	}
+
+	u, err := receiveFile(r.Body, name, -1, dir, httpConfig)
+	if err != nil {
+		return u, err
+	}
+
+	return u, checkContent(u, httpConfig)
+}
+
+// rawUploadName returns the name of the file sent in the body of PUT request r
+func rawUploadName(r *http.Request) string {
+	return strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+}
+
+// formPartOverhead is the room allowed for the headers and boundary of each
+// part of a multipart form when estimating the size of its file
+const formPartOverhead = 1024
+
+// checkDeclaredSize rejects the upload of r if its Content-Length already
+// exceeds the size limit, or the quota for a PUT request, so the body is never
+// read. A client sending Expect: 100-continue then doesn't send it at all,
+// since the server only answers 100 Continue once the body is read. The body
+// of a form carries other fields too, so it's only rejected when even the
+// largest file allowed and all the fields couldn't make up its length. The
+// name in a form isn't known before its body is read, so the quota is only
+// checked for PUT requests.
+func checkDeclaredSize(r *http.Request, dir string, httpConfig configurationmanager.HTTPConfig) error {
+	if err := checkFreeSpace(dir, r.ContentLength, httpConfig); err != nil {
+		return err
+	}
+	if r.ContentLength <= 0 {
+		return nil
+	}
+
+	if r.Method == http.MethodPut {
+		return checkFileDeclaredSize(r, dir, rawUploadName(r), r.ContentLength, httpConfig)
+	}
+
+	limit := int64(httpConfig.MaxFileSize) * 1024 * 1024
+	for _, n := range httpConfig.ExtensionMaxFileSize {
+		if n > limit {
+			limit = n
+		}
+	}
+	overhead := int64(httpConfig.MultipartMemory) + int64(httpConfig.MaxFormParts)*formPartOverhead
+	if r.ContentLength-overhead > limit {
+		return httpError{
+			status: http.StatusRequestEntityTooLarge,
+			code:   codeTooLarge,
+			err:    fmt.Errorf("request body of %d bytes is too large", r.ContentLength),
+		}
+	}
+
+	return nil
+}
+
+// checkFileDeclaredSize rejects the upload of a file named name in dir before
+// its content is read if its declared size already exceeds the size limit or
+// the quota
+func checkFileDeclaredSize(r *http.Request, dir string, name string, size int64, httpConfig configurationmanager.HTTPConfig) error {
+	filename, err := uploadFilename(name, httpConfig)
+	if err != nil || filename == "" {
+		// Reported once the upload is received
+		return nil
+	}
+	if size > maxFileSize(filename, httpConfig) {
+		return fileTooLarge(filename, httpConfig)
+	}
+
+	return checkQuotaSize(r, dir, filename, size, httpConfig)
+}
+
+// isUploadTemp reports whether name, the base name of a file, is a temporary
+// file written by the server, i.e. <name>.<uuid>.tmp like the temporary files
+// of uploads in progress. Files stored by users may end in .tmp too.
+func isUploadTemp(name string) bool {
+	stem := strings.TrimSuffix(name, ".tmp")
+	if stem == name || len(stem) <= 36 || stem[len(stem)-37] != '.' {
+		return false
+	}
+	_, err := uuid.Parse(stem[len(stem)-36:])
+
+	return err == nil
+}
+
+// isInternalFile reports whether name, the base name of a file, is a file of
+// the server rather than a stored file: a temporary file, a checksum sidecar
+// or the name index. Such files don't count in quotas, usages and the number
+// of files.
+func isInternalFile(name string) bool {
+	return isUploadTemp(name) || strings.HasSuffix(name, checksumSuffix) || name == nameIndexFile
+}
+
+// receiveFile streams content to a temporary file in dir, or in the upload
+// temporary directory if it's configured, for a file stored as name. If
+// declared isn't negative, content larger than declared bytes is rejected.
+func receiveFile(content io.Reader, name string, declared int64, dir string, httpConfig configurationmanager.HTTPConfig) (upload, error) {
+	var u upload
+	var err error
+
+	u.filename, err = uploadFilename(name, httpConfig)
+	if err != nil {
+		return u, err
+	}
+	u.original = name
+	if err := activate(&u, dir, httpConfig); err != nil {
+		return u, err
+	}
+
+	// Keep the temporary file at the top of dir, which exists, and its name
+	// within the length limit as well. It's unique so that uploads of the same
+	// name never write the same temporary file.
+	suffix := fmt.Sprintf(".%s.tmp", uuid.New().String())
+	localFilenameTmp := strings.Replace(u.filename, "/", "_", -1)
+	localFilenameTmp = utilities.TruncateFilename(localFilenameTmp, httpConfig.MaxFilenameLength-len(suffix)) + suffix
+	tmpDir := dir
+	if httpConfig.UploadTempDirectory != "" {
+		tmpDir = httpConfig.UploadTempDirectory
+	}
+	u.tmpPath = filepath.Join(tmpDir, localFilenameTmp)
+
+	logger.New().Debug.Printf("Save %s", filepath.Join(dir, u.filename))
+
+	// Sniff the type on the way to disk, peeked bytes are still read
+	buffered := bufio.NewReaderSize(content, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return u, httpError{status: http.StatusBadRequest, code: codeReceiveFailed, err: err}
+	}
+	u.contentType = http.DetectContentType(head)
+	u.head = append([]byte{}, head...)
+
+	// The size is checked while receiving since the body may be chunked
+	// without Content-Length
+	var src io.Reader = &sizeLimitReader{r: buffered, n: maxFileSize(u.filename, httpConfig), err: errFileTooLarge}
+	if declared >= 0 {
+		src = &sizeLimitReader{r: src, n: declared, err: errSizeMismatch}
+	}
+	limited := &recordingReader{r: src}
+	u.size, u.sha256, err = saveFile(limited, u.tmpPath, httpConfig)
+	if err == errFileTooLarge {
+		return u, fileTooLarge(u.filename, httpConfig)
+	}
+	if err == errSizeMismatch {
+		return u, httpError{
+			status: http.StatusBadRequest,
+			code:   codeSizeMismatch,
+			err:    fmt.Errorf("file is larger than the declared %d bytes", declared),
+		}
+	}
+	if err != nil && err == limited.err {
+		return u, httpError{status: http.StatusBadRequest, code: codeReceiveFailed, err: err}
+	}
+	if err == nil && u.size == 0 && httpConfig.EmptyUploadPolicy == configurationmanager.EmptyUploadReject {
+		return u, httpError{status: http.StatusBadRequest, code: codeEmptyFile, err: errors.New("file is empty")}
+	}
+
+	return u, withCode(err, http.StatusInternalServerError, codeWriteFailed)
+}
+
+// activate marks the path u is stored at in dir as being uploaded to, in place
+// of the path marked before if the name changed
+func activate(u *upload, dir string, httpConfig configurationmanager.HTTPConfig) error {
+	path := filepath.Join(dir, filepath.FromSlash(u.filename))
+	if path == u.active {
+		return nil
+	}
+	if err := beginUpload(path, httpConfig); err != nil {
+		return err
+	}
+	if u.active != "" {
+		endUpload(u.active)
+	}
+	if httpConfig.RejectConcurrentUploads {
+		u.active = path
+	}
+
+	return nil
+}
+
+// maxFileSize returns the maximum size in bytes of a file stored as filename,
+// the limit of its extension if one is configured, otherwise MaxFileSize
+func maxFileSize(filename string, httpConfig configurationmanager.HTTPConfig) int64 {
+	if n, ok := httpConfig.ExtensionMaxFileSize[strings.ToLower(path.Ext(filename))]; ok {
+		return n
+	}
+
+	return int64(httpConfig.MaxFileSize) * 1024 * 1024
+}
+
+// fileTooLarge returns the error of a file stored as filename exceeding its
+// maximum size
+func fileTooLarge(filename string, httpConfig configurationmanager.HTTPConfig) error {
+	err := fmt.Errorf("file is larger than %d MB", httpConfig.MaxFileSize)
+	ext := strings.ToLower(path.Ext(filename))
+	if n, ok := httpConfig.ExtensionMaxFileSize[ext]; ok {
+		err = fmt.Errorf("%s file is larger than %d bytes", ext, n)
+	}
+
+	return httpError{status: http.StatusRequestEntityTooLarge, code: codeTooLarge, err: err}
+}
+
+// checkFileSize verifies that u is within the maximum size of its name, which
+// may differ from the one it was received as when the filename field came
+// after the file
+func checkFileSize(u upload, httpConfig configurationmanager.HTTPConfig) error {
+	if u.size > maxFileSize(u.filename, httpConfig) {
+		return fileTooLarge(u.filename, httpConfig)
+	}
+
+	return nil
+}
+
+// checkContent verifies that the content of u matches its extension, as far
+// as strict_mime and verify_magic_bytes require
+func checkContent(u upload, httpConfig configurationmanager.HTTPConfig) error {
+	if err := checkMIME(u, httpConfig); err != nil {
+		return err
+	}
+
+	return checkMagic(u, httpConfig)
+}
+
+// checkMIME verifies that the sniffed type of u matches its extension when
+// strict MIME checking is enabled
+func checkMIME(u upload, httpConfig configurationmanager.HTTPConfig) error {
+	if !httpConfig.StrictMIME {
+		return nil
+	}
+
+	expected := mime.TypeByExtension(filepath.Ext(u.filename))
+	if !mimeMatches(expected, u.contentType) {
+		return httpError{
+			status: http.StatusUnsupportedMediaType,
+			code:   codeUnsupportedType,
+			err:    fmt.Errorf("content of type %s does not match extension of %s", u.contentType, u.filename),
+		}
+	}
+
+	return nil
+}
+
+// mimeMatches reports whether content sniffed as type detected is plausible
+// for a file whose extension has type expected. Sniffing only recognizes a few
+// formats, so a binary type is only compared when the content is recognized.
+// Text types require text content.
+func mimeMatches(expected string, detected string) bool {
+	expected, _, _ = mime.ParseMediaType(expected)
+	detected, _, _ = mime.ParseMediaType(detected)
+	if expected == "" || expected == detected {
+		return true
+	}
+
+	if strings.HasPrefix(expected, "text/") ||
+		strings.HasSuffix(expected, "+xml") || strings.HasSuffix(expected, "+json") ||
+		expected == "application/json" || expected == "application/xml" || expected == "application/javascript" {
+		return strings.HasPrefix(detected, "text/")
+	}
+
+	// Office documents, archives and so on are zip files or unrecognized
+	return detected == "application/octet-stream" || detected == "application/zip"
+}
+
+// uploadFilename returns the name a file is stored as given the name sent by
+// the client, applying the configured policy for names containing a path.
+// Names of internal files of the server are rejected, since such files are
+// hidden and overwriting them would break the server.
+func uploadFilename(name string, httpConfig configurationmanager.HTTPConfig) (string, error) {
+	var elements []string
+	switch httpConfig.FilenamePathPolicy {
+	case configurationmanager.FilenamePathBase:
+		// Browsers of old Windows versions send the full local path
+		elements = []string{name[strings.LastIndexAny(name, `/\`)+1:]}
+	case configurationmanager.FilenamePathReject:
+		if strings.ContainsAny(name, `/\`) {
+			return "", httpError{
+				status: http.StatusBadRequest,
+				code:   codeInvalidFilename,
+				err:    fmt.Errorf("filename %q contains a path", name),
+			}
+		}
+		elements = []string{name}
+	case configurationmanager.FilenamePathSubdirectory:
+		for _, element := range strings.Split(name, "/") {
+			if element == ".." {
+				return "", httpError{
+					status: http.StatusBadRequest,
+					code:   codeInvalidFilename,
+					err:    fmt.Errorf("filename %q goes up a directory", name),
+				}
+			}
+			if element != "" && element != "." {
+				elements = append(elements, element)
+			}
+		}
+	default:
+		elements = []string{name}
+	}
+
+	for i, element := range elements {
+		element = utilities.SanitizeFilename(element)
+		switch httpConfig.FilenameCase {
+		case configurationmanager.FilenameCaseLower:
+			element = strings.ToLower(element)
+		case configurationmanager.FilenameCaseASCII:
+			element = strings.ToLower(utilities.ASCIIFilename(element))
+		}
+		if len(element) > httpConfig.MaxFilenameLength {
+			if !httpConfig.TruncateFilename {
+				return element, httpError{
+					status: http.StatusBadRequest,
+					code:   codeInvalidFilename,
+					err:    fmt.Errorf("filename is longer than %d bytes", httpConfig.MaxFilenameLength),
+				}
+			}
+			element = utilities.TruncateFilename(element, httpConfig.MaxFilenameLength)
+		}
+		if isInternalFile(element) {
+			return element, httpError{
+				status: http.StatusBadRequest,
+				code:   codeInvalidFilename,
+				err:    fmt.Errorf("filename %q is reserved for files of the server", element),
+			}
+		}
+		elements[i] = element
+	}
+
+	filename := strings.Join(elements, "/")
+	if filename == "" {
+		return "", httpError{status: http.StatusBadRequest, code: codeInvalidFilename, err: errors.New("filename is missing")}
+	}
+
+	return filename, checkPathDepth(filename, httpConfig)
+}
+
+// checkPathDepth verifies that name, a slash separated path relative to the
+// directory of the user, has at most MaxPathDepth elements
+func checkPathDepth(name string, httpConfig configurationmanager.HTTPConfig) error {
+	if httpConfig.MaxPathDepth > 0 && pathDepth(name) > httpConfig.MaxPathDepth {
+		return httpError{
+			status: http.StatusBadRequest,
+			code:   codeInvalidFilename,
+			err:    fmt.Errorf("path of %s is deeper than %d", name, httpConfig.MaxPathDepth),
+		}
+	}
+
+	return nil
+}
+
+// pathDepth returns the number of elements of the slash separated path name
+func pathDepth(name string) int {
+	return strings.Count(strings.Trim(path.Clean("/"+name), "/"), "/") + 1
+}
+
+// saveFile writes the content of src to path, applying the configured
+// permission and encryption. It returns the number of bytes read from src and
+// their SHA-256 sum.
+func saveFile(src io.Reader, path string, httpConfig configurationmanager.HTTPConfig) (int64, []byte, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	if httpConfig.FileMode != 0 {
+		err = f.Chmod(httpConfig.FileMode)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var out io.Writer = f
+	var ew io.WriteCloser
+	if httpConfig.Encryption {
+		ew, err = utilities.NewEncryptWriter(f, httpConfig.EncryptionKey)
+		if err != nil {
+			return 0, nil, err
+		}
+		out = ew
+	}
+
+	hashing := utilities.NewHashingReader(src)
+	size, err := copyBuffer(out, hashing, httpConfig.CopyBufferSize)
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err == nil && httpConfig.DurableUpload {
+		err = syncFile(f)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+
+	return size, hashing.SHA256(), err
+}
+
+// checkUnmodifiedSince verifies that the file at path, which an upload would
+// replace, wasn't modified after the If-Unmodified-Since header of r. Invalid
+// dates are ignored.
+func checkUnmodifiedSince(r *http.Request, path string) error {
+	since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+	if err != nil {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// HTTP dates have a resolution of one second
+	if info.ModTime().Truncate(time.Second).After(since) {
+		return httpError{
+			status: http.StatusPreconditionFailed,
+			code:   codePreconditionFailed,
+			err:    fmt.Errorf("%s was modified after %s", filepath.Base(path), since.Format(http.TimeFormat)),
+		}
+	}
+
+	return nil
+}
+
+// userQuota returns the storage quota in bytes of the user of r, or 0 if the
+// user has no quota
+func userQuota(r *http.Request, httpConfig configurationmanager.HTTPConfig) int64 {
+	username := Username(r)
+	if username == "" {
+		return 0
+	}
+
+	quota := httpConfig.DefaultQuota
+	for _, v := range httpConfig.Authen {
+		if v.Username == username && v.Quota != 0 {
+			quota = v.Quota
+			break
+		}
+	}
+	if quota < 0 {
+		return 0
+	}
+
+	return int64(quota) * 1024 * 1024
+}
+
+// directorySize returns the total size of the files stored under dir, ignoring
+// internal files
+func directorySize(dir string, httpConfig configurationmanager.HTTPConfig) (int64, error) {
+	var size int64
+	err := walk(dir, httpConfig.WalkConcurrency, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !isInternalFile(info.Name()) {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// checkQuota verifies that storing u in dir keeps the user of r within quota.
+// A file being overwritten doesn't count.
+func checkQuota(r *http.Request, dir string, u upload, httpConfig configurationmanager.HTTPConfig) error {
+	// The size on disk may differ from the size received, e.g. if encrypted
+	info, err := os.Stat(u.tmpPath)
+	if err != nil {
+		return err
+	}
+
+	return checkQuotaSize(r, dir, u.filename, info.Size(), httpConfig)
+}
+
+// checkQuotaSize verifies that storing size bytes as filename in dir keeps the
+// user of r within quota. A file being overwritten doesn't count.
+func checkQuotaSize(r *http.Request, dir string, filename string, size int64, httpConfig configurationmanager.HTTPConfig) error {
+	quota := userQuota(r, httpConfig)
+	if quota == 0 {
+		return nil
+	}
+
+	used, err := directorySize(dir, httpConfig)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(filepath.Join(dir, filename)); err == nil {
+		used -= info.Size()
+	}
+
+	if used+size > quota {
+		return httpError{
+			status: http.StatusInsufficientStorage,
+			code:   codeQuotaExceeded,
+			err:    fmt.Errorf("quota of %d bytes is exceeded", quota),
+		}
+	}
+
+	return nil
+}
+
+// checkFileCount verifies that storing u in dir keeps the number of files in
+// the file server directory within MaxFileCount. Overwriting a file doesn't
+// change the number of files.
+func checkFileCount(dir string, u upload, httpConfig configurationmanager.HTTPConfig) error {
+	if httpConfig.MaxFileCount <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, u.filename)); err == nil {
+		return nil
+	}
+
+	count, err := cachedCountFiles(httpConfig.FileServerDirectory, httpConfig)
+	if err != nil {
+		return err
+	}
+
+	if count >= httpConfig.MaxFileCount {
+		return httpError{
+			status: http.StatusInsufficientStorage,
+			code:   codeTooManyFiles,
+			err:    fmt.Errorf("maximum number of %d files is reached", httpConfig.MaxFileCount),
+		}
+	}
+
+	return nil
+}
+
+// isFilePart tells whether part of an upload form is the file, i.e. a file
+// sent in the upload_field_name field, or in any field with any_upload_field
+func isFilePart(part *multipart.Part, httpConfig configurationmanager.HTTPConfig) bool {
+	if part.FileName() == "" {
+		return false
+	}
+
+	return httpConfig.AnyUploadField || part.FormName() == httpConfig.UploadFieldName
+}
+
+// checkFreeSpace verifies that storing size more bytes in dir leaves at least
+// MinFreeSpace bytes free on its disk. Unlike quotas, it's based on the actual
+// free space reported by the filesystem.
+func checkFreeSpace(dir string, size int64, httpConfig configurationmanager.HTTPConfig) error {
+	if httpConfig.MinFreeSpace <= 0 {
+		return nil
+	}
+
+	_, free, err := diskUsage(dir)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	if int64(free)-size < httpConfig.MinFreeSpace {
+		return httpError{
+			status: http.StatusInsufficientStorage,
+			code:   codeLowDiskSpace,
+			err:    fmt.Errorf("free space of %d bytes is below %d bytes", free, httpConfig.MinFreeSpace),
+		}
+	}
+
+	return nil
+}
+
+// countFiles returns the number of files stored under dir, ignoring internal
+// files
+func countFiles(dir string, httpConfig configurationmanager.HTTPConfig) (int, error) {
+	count := 0
+	err := walk(dir, httpConfig.WalkConcurrency, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !isInternalFile(info.Name()) {
+			count++
+		}
+		return nil
+	})
+
+	return count, err
+}
@@ -0,0 +1,1192 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+func TestUploadChunkedTooLarge(t *testing.T) {
+	dir := makeTempDir("TestUploadChunkedTooLarge", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "max_file_size = 1", t)
+
+	for _, size := range []int{1024 * 1024, 1024*1024 + 1} {
+		body := newUploadRequest("big.bin", strings.Repeat("x", size), "", t)
+
+		// Hide the length of the body so it's sent chunked
+		pr, pw := io.Pipe()
+		go func() {
+			io.Copy(pw, body.Body)
+			pw.Close()
+		}()
+		srv := httptest.NewServer(http.HandlerFunc(UploadHandler))
+		r, _ := http.NewRequest("POST", srv.URL+"/upload", pr)
+		r.Header.Set("Content-Type", body.Header.Get("Content-Type"))
+		resp, err := http.DefaultClient.Do(r)
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if size > 1024*1024 {
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("expected status %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+			}
+			fileCount(dir, 0, t)
+		} else {
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("expected status %d, got %d", http.StatusCreated, resp.StatusCode)
+			}
+			os.Remove(filepath.Join(dir, "big.bin"))
+		}
+	}
+}
+
+func TestUploadTooManyParts(t *testing.T) {
+	dir := makeTempDir("TestUploadTooManyParts", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "max_form_parts = 4", t)
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for i := 0; i < 100; i++ {
+		mw.WriteField("junk", "x")
+	}
+	fw, _ := mw.CreateFormFile("file", "foo.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	UploadHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	fileCount(dir, 0, t)
+}
+
+func TestUploadFieldTooLarge(t *testing.T) {
+	dir := makeTempDir("TestUploadFieldTooLarge", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "max_form_field_size = 64", t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("foo.txt", "hello", strings.Repeat("a", 1<<20), t))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	fileCount(dir, 0, t)
+}
+
+func TestUploadMultipartMemory(t *testing.T) {
+	dir := makeTempDir("TestUploadMultipartMemory", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "multipart_memory = 1024\nmax_form_parts = 64\nmax_file_size = 32", t)
+
+	// Fields are bounded in total
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for i := 0; i < 32; i++ {
+		mw.WriteField("junk", strings.Repeat("x", 64))
+	}
+	fw, _ := mw.CreateFormFile("file", "foo.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	UploadHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// A file much larger than the threshold is streamed to disk rather than
+	// buffered in memory
+	size := 16 << 20
+	r = newUploadRequest("big.bin", strings.Repeat("x", size), "", t)
+	w = httptest.NewRecorder()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	UploadHandler(w, r)
+	runtime.ReadMemStats(&after)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(size/4) {
+		t.Fatalf("expected upload to be streamed, but %d bytes were allocated", allocated)
+	}
+	info, err := os.Stat(filepath.Join(dir, "big.bin"))
+	if err != nil || info.Size() != int64(size) {
+		t.Fatalf("expected %d bytes stored, got %v %v", size, info, err)
+	}
+}
+
+func TestUploadFilenameBeforeFile(t *testing.T) {
+	dir := makeTempDir("TestUploadFilenameBeforeFile", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("filename", "renamed.txt")
+	fw, _ := mw.CreateFormFile("file", "foo.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	UploadHandler(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "renamed.txt"))
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("uploaded file not stored: %v %q", err, b)
+	}
+	fileCount(dir, 1, t)
+}
+
+func TestUploadFilenameAfterFile(t *testing.T) {
+	dir := makeTempDir("TestUploadFilenameAfterFile", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("foo.txt", "hello", "renamed.txt", t))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed.txt")); err != nil {
+		t.Fatal(err)
+	}
+	fileCount(dir, 1, t)
+}
+
+func TestUploadMissingFile(t *testing.T) {
+	dir := makeTempDir("TestUploadMissingFile", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("filename", "foo.txt")
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	UploadHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestUploadTempDirectory(t *testing.T) {
+	dir := makeTempDir("TestUploadTempDirectory", t)
+	defer os.RemoveAll(dir)
+	tmpDir := makeTempDir("TestUploadTempDirectoryTmp", t)
+	defer os.RemoveAll(tmpDir)
+
+	// Check where the partial file is while it's being received
+	var tmpPath string
+	origSyncFile := syncFile
+	defer func() {
+		syncFile = origSyncFile
+	}()
+	syncFile = func(f syncer) error {
+		tmpPath = f.(*os.File).Name()
+		return nil
+	}
+	loadConfig(dir, fmt.Sprintf("upload_temp_directory = %q\ndurable_upload = true", tmpDir), t)
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("a.txt", "content", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	if filepath.Dir(tmpPath) != tmpDir {
+		t.Fatalf("expected file to be written in %s, got %s", tmpDir, tmpPath)
+	}
+	fileCount(tmpDir, 0, t)
+	fileCount(dir, 1, t)
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	if string(content) != "content" {
+		t.Fatalf("unexpected content %q", content)
+	}
+}
+
+func TestUploadStrictMIME(t *testing.T) {
+	dir := makeTempDir("TestUploadStrictMIME", t)
+	defer os.RemoveAll(dir)
+
+	elf := "\x7fELF\x02\x01\x01\x00" + strings.Repeat("\x00", 1024)
+	png := "\x89PNG\x0d\x0a\x1a\x0a" + strings.Repeat("\x00", 1024)
+	tests := []struct {
+		strict   bool
+		name     string
+		content  string
+		filename string
+		status   int
+	}{
+		{true, "notes.txt", "Just some notes.\n", "", http.StatusCreated},
+		{true, "notes.txt", elf, "", http.StatusUnsupportedMediaType},
+		{true, "program", elf, "notes.txt", http.StatusUnsupportedMediaType},
+		{true, "image.png", png, "", http.StatusCreated},
+		{true, "image.png", "Just some notes.\n", "", http.StatusUnsupportedMediaType},
+		{true, "program", elf, "", http.StatusCreated},
+		{false, "notes.txt", elf, "", http.StatusCreated},
+	}
+	for _, test := range tests {
+		loadConfig(dir, fmt.Sprintf("strict_mime = %t", test.strict), t)
+
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(test.name, test.content, test.filename, t))
+		if w.Code != test.status {
+			t.Fatalf("strict_mime = %t, %s as %q: expected status %d, got %d",
+				test.strict, test.name, test.filename, test.status, w.Code)
+		}
+		if w.Code == http.StatusCreated {
+			name := test.name
+			if test.filename != "" {
+				name = test.filename
+			}
+			content, _ := ioutil.ReadFile(filepath.Join(dir, name))
+			if string(content) != test.content {
+				t.Fatalf("content of %s was altered", name)
+			}
+			os.Remove(filepath.Join(dir, name))
+		}
+		fileCount(dir, 0, t)
+	}
+}
+
+func TestUploadIfUnmodifiedSince(t *testing.T) {
+	dir := makeTempDir("TestUploadIfUnmodifiedSince", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	path := filepath.Join(dir, "a.txt")
+	modTime := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	upload := func(since time.Time) int {
+		r := newUploadRequest("a.txt", "new content", "", t)
+		r.Header.Set("If-Unmodified-Since", since.Format(http.TimeFormat))
+		w := httptest.NewRecorder()
+		UploadHandler(w, r)
+		return w.Code
+	}
+
+	// Target is newer
+	writeFile(path, "content", t)
+	os.Chtimes(path, modTime, modTime)
+	if code := upload(modTime.Add(-time.Hour)); code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d, got %d", http.StatusPreconditionFailed, code)
+	}
+	content, _ := ioutil.ReadFile(path)
+	if string(content) != "content" {
+		t.Fatalf("expected file to be untouched, got %q", content)
+	}
+	fileCount(dir, 1, t)
+
+	// Target is older or as old
+	for _, since := range []time.Time{modTime, modTime.Add(time.Hour)} {
+		writeFile(path, "content", t)
+		os.Chtimes(path, modTime, modTime)
+		if code := upload(since); code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d", http.StatusCreated, code)
+		}
+	}
+
+	// No target
+	os.Remove(path)
+	if code := upload(modTime); code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, code)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	dir := makeTempDir("TestUploadQuota", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `per_user_directory = true
+default_quota = 1
+
+[[http.basic_authen]]
+username = "limited"
+password = "e10adc3949ba59abbe56e057f20f883e"
+
+[[http.basic_authen]]
+username = "unlimited"
+password = "e10adc3949ba59abbe56e057f20f883e"
+quota = -1`, t)
+
+	upload := ValidateMiddleware(http.HandlerFunc(UploadHandler))
+	send := func(user string, name string, size int) int {
+		r := newUploadRequest(name, strings.Repeat("x", size), "", t)
+		r.SetBasicAuth(user, "123456")
+		w := httptest.NewRecorder()
+		upload.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Exactly at the limit, with a name ending in .tmp which counts like any
+	if code := send("limited", "a.tmp", 1024*1024); code != http.StatusCreated {
+		t.Fatalf("expected upload at the limit to succeed, got %d", code)
+	}
+	// Overwriting doesn't count the replaced file
+	if code := send("limited", "a.tmp", 1024*1024); code != http.StatusCreated {
+		t.Fatalf("expected overwrite at the limit to succeed, got %d", code)
+	}
+	// Over the limit
+	if code := send("limited", "b.bin", 1); code != http.StatusInsufficientStorage {
+		t.Fatalf("expected status %d, got %d", http.StatusInsufficientStorage, code)
+	}
+	fileCount(filepath.Join(dir, "limited"), 1, t)
+
+	if code := send("unlimited", "big.bin", 2*1024*1024); code != http.StatusCreated {
+		t.Fatalf("expected upload of unlimited user to succeed, got %d", code)
+	}
+}
+
+func TestDurableUpload(t *testing.T) {
+	dir := makeTempDir("TestDurableUpload", t)
+	defer os.RemoveAll(dir)
+
+	files, dirs := 0, 0
+	origSyncFile, origSyncDir := syncFile, syncDir
+	defer func() {
+		syncFile, syncDir = origSyncFile, origSyncDir
+	}()
+	syncFile = func(f syncer) error {
+		files++
+		return origSyncFile(f)
+	}
+	syncDir = func(d string) error {
+		if d != dir {
+			t.Fatalf("expected directory %s to be synced, got %s", dir, d)
+		}
+		dirs++
+		return origSyncDir(d)
+	}
+
+	for _, durable := range []bool{false, true} {
+		files, dirs = 0, 0
+		loadConfig(dir, fmt.Sprintf("durable_upload = %t", durable), t)
+
+		r := newUploadRequest("a.txt", "content", "", t)
+		w := httptest.NewRecorder()
+		UploadHandler(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+
+		expected := 0
+		if durable {
+			expected = 1
+		}
+		if files != expected || dirs != expected {
+			t.Fatalf("durable_upload = %t: expected %d file and directory syncs, got %d and %d",
+				durable, expected, files, dirs)
+		}
+	}
+}
+
+func TestCheckPathDepth(t *testing.T) {
+	httpConfig := configurationmanager.HTTPConfig{MaxPathDepth: 2}
+	for name, ok := range map[string]bool{
+		"a.txt":        true,
+		"x/a.txt":      true,
+		"/x/a.txt":     true,
+		"x/y/a.txt":    false,
+		"x/y/../a.txt": true,
+	} {
+		err := checkPathDepth(name, httpConfig)
+		if ok != (err == nil) {
+			t.Fatalf("unexpected result for %s: %v", name, err)
+		}
+		if e, isHTTPError := err.(httpError); err != nil && (!isHTTPError || e.status != http.StatusBadRequest) {
+			t.Fatalf("expected status %d for %s, got %v", http.StatusBadRequest, name, err)
+		}
+	}
+
+	// No limit
+	if err := checkPathDepth("a/b/c/d/e.txt", configurationmanager.HTTPConfig{}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestUploadMaxFileCount(t *testing.T) {
+	dir := makeTempDir("TestUploadMaxFileCount", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `max_file_count = 2
+checksum_sidecar = true`, t)
+
+	send := func(name string) int {
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(name, "content", "", t))
+		return w.Code
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if code := send(name); code != http.StatusCreated {
+			t.Fatalf("expected upload of %s to succeed, got %d", name, code)
+		}
+	}
+
+	// At the limit
+	if code := send("c.txt"); code != http.StatusInsufficientStorage {
+		t.Fatalf("expected status %d, got %d", http.StatusInsufficientStorage, code)
+	}
+	// Overwriting doesn't add a file
+	if code := send("a.txt"); code != http.StatusCreated {
+		t.Fatalf("expected overwrite at the limit to succeed, got %d", code)
+	}
+	fileCount(dir, 4, t)
+
+	// Room is made by a delete
+	r := httptest.NewRequest("DELETE", "/", nil)
+	r.URL.Path = "/b.txt"
+	w := httptest.NewRecorder()
+	DeleteHandler(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected delete to succeed, got %d", w.Code)
+	}
+	if code := send("c.txt"); code != http.StatusCreated {
+		t.Fatalf("expected upload after delete to succeed, got %d", code)
+	}
+
+	// Files ending in .tmp count like any
+	if code := send("d.tmp"); code != http.StatusInsufficientStorage {
+		t.Fatalf("expected status %d, got %d", http.StatusInsufficientStorage, code)
+	}
+}
+
+func TestUploadMaxFileCountCached(t *testing.T) {
+	dir := makeTempDir("TestUploadMaxFileCountCached", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `max_file_count = 2
+usage_cache_duration = "1h"`, t)
+
+	send := func(name string) int {
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(name, "content", "", t))
+		return w.Code
+	}
+
+	if code := send("report.tmp"); code != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d", code)
+	}
+	// The count is kept up to date by uploads without walking again, so a
+	// file added on disk isn't seen
+	writeFile(filepath.Join(dir, "manual.txt"), "content", t)
+	if code := send("other.tmp"); code != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d", code)
+	}
+	if code := send("third.txt"); code != http.StatusInsufficientStorage {
+		t.Fatalf("expected status %d, got %d", http.StatusInsufficientStorage, code)
+	}
+
+	// Until the count expires
+	os.Remove(filepath.Join(dir, "other.tmp"))
+	loadConfig(dir, `max_file_count = 3
+usage_cache_duration = "0s"`, t)
+	if code := send("third.txt"); code != http.StatusCreated {
+		t.Fatalf("expected upload to succeed, got %d", code)
+	}
+	if code := send("fourth.txt"); code != http.StatusInsufficientStorage {
+		t.Fatalf("expected status %d, got %d", http.StatusInsufficientStorage, code)
+	}
+}
+
+func TestUploadMinFreeSpace(t *testing.T) {
+	dir := makeTempDir("TestUploadMinFreeSpace", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `min_free_space = "1MB"`, t)
+
+	defer func() {
+		diskUsage = utilities.DiskUsage
+	}()
+	var free uint64
+	diskUsage = func(path string) (uint64, uint64, error) {
+		return 10 * 1024 * 1024, free, nil
+	}
+
+	send := func(r *http.Request) (int, string) {
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		UploadHandler(w, r)
+		var response struct {
+			Code string `json:"code"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response.Code
+	}
+
+	free = 2 * 1024 * 1024
+	if code, _ := send(newUploadRequest("a.txt", "content", "", t)); code != http.StatusCreated {
+		t.Fatalf("expected upload with enough free space to succeed, got %d", code)
+	}
+
+	// The declared size would leave too little free space
+	r := httptest.NewRequest("PUT", "/download/b.bin", strings.NewReader(strings.Repeat("x", 1024*1024+1)))
+	if code, c := send(r); code != http.StatusInsufficientStorage || c != codeLowDiskSpace {
+		t.Errorf("expected status %d and code %s, got %d %s", http.StatusInsufficientStorage, codeLowDiskSpace, code, c)
+	}
+
+	free = 1024*1024 - 1
+	if code, c := send(newUploadRequest("c.txt", "content", "", t)); code != http.StatusInsufficientStorage || c != codeLowDiskSpace {
+		t.Errorf("expected status %d and code %s, got %d %s", http.StatusInsufficientStorage, codeLowDiskSpace, code, c)
+	}
+	fileCount(dir, 1, t)
+}
+
+func TestUploadFieldName(t *testing.T) {
+	dir := makeTempDir("TestUploadFieldName", t)
+	defer os.RemoveAll(dir)
+
+	send := func(field string, name string) int {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile(field, name)
+		fw.Write([]byte("content"))
+		mw.Close()
+		r := httptest.NewRequest("POST", "/upload", body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		UploadHandler(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		extra  string
+		field  string
+		name   string
+		status int
+	}{
+		{"", "file", "default.txt", http.StatusCreated},
+		{"", "attachment", "other.txt", http.StatusBadRequest},
+		{`upload_field_name = "attachment"`, "attachment", "custom.txt", http.StatusCreated},
+		{`upload_field_name = "attachment"`, "file", "old.txt", http.StatusBadRequest},
+		{"any_upload_field = true", "upload", "any.txt", http.StatusCreated},
+		{"any_upload_field = true\nupload_field_name = \"attachment\"", "file", "any2.txt", http.StatusCreated},
+	}
+	for _, test := range tests {
+		loadConfig(dir, test.extra, t)
+		if code := send(test.field, test.name); code != test.status {
+			t.Errorf("%q with %s: expected status %d, got %d", test.extra, test.field, test.status, code)
+		}
+	}
+	fileCount(dir, 4, t)
+
+	// The index page sends the file in the configured field
+	loadConfig(dir, `upload_field_name = "attachment"`, t)
+	w := httptest.NewRecorder()
+	IndexHandler(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), `name="attachment"`) {
+		t.Errorf("expected upload form with field attachment, got %q", w.Body.String())
+	}
+}
+
+func TestRawUpload(t *testing.T) {
+	dir := makeTempDir("TestRawUpload", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "max_file_size = 1", t)
+
+	h := http.StripPrefix("/download/", http.HandlerFunc(UploadHandler))
+	put := func(p string, content string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", p, strings.NewReader(content))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, content := range []string{"first", "second"} {
+		w := put("/download/a.txt", content)
+		if w.Code != http.StatusCreated || w.Header().Get("Location") != "/download/a.txt" {
+			t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+		}
+		stored, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+		if err != nil || string(stored) != content {
+			t.Fatalf("expected %q to be stored, got %q: %v", content, stored, err)
+		}
+	}
+	fileCount(dir, 1, t)
+
+	// The name is sanitized
+	if w := put("/download/sub/../b%20c.txt", "b"); w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b_c.txt")); err != nil {
+		t.Fatalf("expected b_c.txt to be stored: %v", err)
+	}
+
+	if w := put("/download/", "content"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := put("/download/big.bin", strings.Repeat("x", 1024*1024+1)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	fileCount(dir, 2, t)
+}
+
+func TestFilenamePathPolicy(t *testing.T) {
+	for policy, expected := range map[string][]string{
+		"replace":      {"report.pdf", "docs_report.pdf", ".._.._etc_passwd"},
+		"base":         {"report.pdf", "report.pdf", "passwd"},
+		"reject":       {"report.pdf", "", ""},
+		"subdirectory": {"report.pdf", "docs/report.pdf", ""},
+	} {
+		for i, name := range []string{"report.pdf", "docs/report.pdf", "../../etc/passwd"} {
+			dir := makeTempDir("TestFilenamePathPolicy", t)
+			root := filepath.Join(dir, "root")
+			loadConfig(root, fmt.Sprintf("filename_path_policy = %q", policy), t)
+
+			w := httptest.NewRecorder()
+			UploadHandler(w, newUploadRequest("upload.bin", "content", name, t))
+
+			if expected[i] == "" {
+				if w.Code != http.StatusBadRequest {
+					t.Fatalf("%s: expected status %d for %s, got %d", policy, http.StatusBadRequest, name, w.Code)
+				}
+				fileCount(root, 0, t)
+			} else {
+				if w.Code != http.StatusCreated {
+					t.Fatalf("%s: expected status %d for %s, got %d", policy, http.StatusCreated, name, w.Code)
+				}
+				if location := w.Header().Get("Location"); location != "/download/"+expected[i] {
+					t.Fatalf("%s: expected %s to be stored as %s, got %s", policy, name, expected[i], location)
+				}
+				if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(expected[i]))); err != nil {
+					t.Fatalf("%s: expected %s to be stored as %s: %v", policy, name, expected[i], err)
+				}
+			}
+			// Nothing is written out of the file server directory
+			fileCount(dir, 1, t)
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func TestFilenameCase(t *testing.T) {
+	for filenameCase, expected := range map[string][]string{
+		"preserve": {"Report.PDF", "Résumé_2.txt", "report.pdf"},
+		"lower":    {"report.pdf", "résumé_2.txt", "report.pdf"},
+		"ascii":    {"report.pdf", "resume_2.txt", "report.pdf"},
+	} {
+		dir := makeTempDir("TestFilenameCase", t)
+		loadConfig(dir, fmt.Sprintf("filename_case = %q", filenameCase), t)
+
+		for i, name := range []string{"Report.PDF", "Résumé 2.txt", "report.pdf"} {
+			w := httptest.NewRecorder()
+			UploadHandler(w, newUploadRequest(name, "content", "", t))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("%s: expected status %d for %s, got %d", filenameCase, http.StatusCreated, name, w.Code)
+			}
+			if location := w.Header().Get("Location"); location != "/download/"+url.PathEscape(expected[i]) {
+				t.Errorf("%s: expected %s to be stored as %s, got %s", filenameCase, name, expected[i], location)
+			}
+			if _, err := os.Stat(filepath.Join(dir, expected[i])); err != nil {
+				t.Errorf("%s: expected %s to be stored as %s: %v", filenameCase, name, expected[i], err)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFilenamePathPolicyBackslash(t *testing.T) {
+	httpConfig := configurationmanager.HTTPConfig{MaxFilenameLength: 255, FilenamePathPolicy: configurationmanager.FilenamePathBase}
+	if name, err := uploadFilename(`C:\Users\me\report.pdf`, httpConfig); err != nil || name != "report.pdf" {
+		t.Fatalf("expected report.pdf, got %q: %v", name, err)
+	}
+
+	httpConfig.FilenamePathPolicy = configurationmanager.FilenamePathReject
+	if _, err := uploadFilename(`docs\report.pdf`, httpConfig); err == nil {
+		t.Fatalf("expected path with backslashes to be rejected")
+	}
+
+	httpConfig.FilenamePathPolicy = configurationmanager.FilenamePathSubdirectory
+	if name, err := uploadFilename("/docs//./2024/report.pdf", httpConfig); err != nil || name != "docs/2024/report.pdf" {
+		t.Fatalf("expected docs/2024/report.pdf, got %q: %v", name, err)
+	}
+}
+
+func TestUploadExtensionMaxFileSize(t *testing.T) {
+	dir := makeTempDir("TestUploadExtensionMaxFileSize", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `max_file_size = 1
+[http.extension_max_file_size]
+".JPG" = "1KB"
+"mp4" = "2MB"`, t)
+
+	tests := []struct {
+		name     string
+		filename string
+		size     int
+		status   int
+	}{
+		{"a.jpg", "", 1024, http.StatusCreated},
+		{"b.jpg", "", 1025, http.StatusRequestEntityTooLarge},
+		{"c.Jpg", "", 1025, http.StatusRequestEntityTooLarge},
+		// The filename field decides the limit
+		{"d.bin", "d.jpg", 1025, http.StatusRequestEntityTooLarge},
+		{"e.mp4", "", 1024*1024 + 1, http.StatusCreated},
+		// Other extensions fall back to max_file_size
+		{"f.bin", "", 1024 * 1024, http.StatusCreated},
+		{"g.bin", "", 1024*1024 + 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		UploadHandler(w, newUploadRequest(test.name, strings.Repeat("x", test.size), test.filename, t))
+		if w.Code != test.status {
+			t.Errorf("%s of %d bytes: expected status %d, got %d", test.name, test.size, test.status, w.Code)
+		}
+	}
+
+	fileCount(dir, 3, t)
+}
+
+func TestUploadConcurrentSameName(t *testing.T) {
+	dir := makeTempDir("TestUploadConcurrentSameName", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "reject_concurrent_uploads = true", t)
+
+	// Stream the first upload slowly so it's still in progress
+	// The content is longer than the sniffed part, which is read before the
+	// temporary file is created
+	first := strings.Repeat("x", 1024)
+	body := newUploadRequest("foo.txt", first, "", t)
+	pr, pw := io.Pipe()
+	srv := httptest.NewServer(http.HandlerFunc(UploadHandler))
+	defer srv.Close()
+	defer pw.Close()
+	r, _ := http.NewRequest("POST", srv.URL+"/upload", pr)
+	r.Header.Set("Content-Type", body.Header.Get("Content-Type"))
+	done := make(chan int)
+	go func() {
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+
+	content, _ := ioutil.ReadAll(body.Body)
+	pw.Write(content[:len(content)-10])
+	var tmpPath string
+	for i := 0; ; i++ {
+		if matches, _ := filepath.Glob(filepath.Join(dir, "foo.txt.*.tmp")); len(matches) == 1 {
+			tmpPath = matches[0]
+			if !isUploadTemp(filepath.Base(tmpPath)) {
+				t.Fatalf("unexpected temporary file %s", tmpPath)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatal("first upload did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("foo.txt", "world", "", t))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status %d, got %d", http.StatusConflict, w.Code)
+	}
+	if _, err := os.Stat(tmpPath); err != nil {
+		t.Errorf("temporary file of first upload was removed: %v", err)
+	}
+
+	// Another name isn't affected
+	w = httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("bar.txt", "world", "", t))
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	pw.Write(content[len(content)-10:])
+	pw.Close()
+	if status := <-done; status != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, status)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "foo.txt")); string(data) != first {
+		t.Errorf("foo.txt was corrupted")
+	}
+
+	// The name is free again once the first upload is done
+	w = httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("foo.txt", "world", "", t))
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+}
+
+// watchedReader reads zeros and records whether it was read
+type watchedReader struct {
+	r    io.Reader
+	read int32
+}
+
+func (w *watchedReader) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&w.read, 1)
+	return w.r.Read(p)
+}
+
+func TestUploadExpectContinue(t *testing.T) {
+	dir := makeTempDir("TestUploadExpectContinue", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `max_file_size = 1
+per_user_directory = true
+default_quota = 2
+
+[[http.basic_authen]]
+username = "user"
+password = "e10adc3949ba59abbe56e057f20f883e"`, t)
+	os.Mkdir(filepath.Join(dir, "user"), 0755)
+	writeFile(filepath.Join(dir, "user", "old.bin"), strings.Repeat("x", 1024*1024+512*1024), t)
+
+	mux := http.NewServeMux()
+	mux.Handle("/upload", http.HandlerFunc(UploadHandler))
+	mux.Handle("/download/", http.StripPrefix("/download/", http.HandlerFunc(UploadHandler)))
+	srv := httptest.NewServer(ValidateMiddleware(mux))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	defer client.Transport.(*http.Transport).CloseIdleConnections()
+
+	send := func(method string, p string, contentType string, size int64) (int, bool) {
+		body := &watchedReader{r: io.LimitReader(zeroReader{}, size)}
+		r, _ := http.NewRequest(method, srv.URL+p, body)
+		r.ContentLength = size
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Expect", "100-continue")
+		r.SetBasicAuth("user", "123456")
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, atomic.LoadInt32(&body.read) == 1
+	}
+
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		size        int64
+		status      int
+	}{
+		{"PUT", "/download/big.bin", "application/octet-stream", 1024*1024 + 1, http.StatusRequestEntityTooLarge},
+		// Over the quota of 2 MB with the existing file
+		{"PUT", "/download/new.bin", "application/octet-stream", 1024 * 1024, http.StatusInsufficientStorage},
+		{"POST", "/upload", "multipart/form-data; boundary=x", 100 * 1024 * 1024, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		status, read := send(test.method, test.path, test.contentType, test.size)
+		if status != test.status {
+			t.Errorf("%s %s: expected status %d, got %d", test.method, test.path, test.status, status)
+		}
+		if read {
+			t.Errorf("%s %s: body was sent", test.method, test.path)
+		}
+	}
+
+	// Without credentials the body isn't read either
+	body := &watchedReader{r: strings.NewReader("hello")}
+	r, _ := http.NewRequest("PUT", srv.URL+"/download/a.txt", body)
+	r.Header.Set("Expect", "100-continue")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || atomic.LoadInt32(&body.read) == 1 {
+		t.Errorf("expected status %d without the body sent, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// An acceptable upload is sent once the server continues
+	if status, read := send("PUT", "/download/small.bin", "application/octet-stream", 1024); status != http.StatusCreated || !read {
+		t.Errorf("expected status %d with the body sent, got %d", http.StatusCreated, status)
+	}
+}
+
+// zeroReader reads zeros forever
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestIsUploadTemp(t *testing.T) {
+	for name, expected := range map[string]bool{
+		tempName("a.txt"):       true,
+		tempName(".names.json"): true,
+		"a.txt.tmp":             false,
+		"report.tmp":            false,
+		"a.txt.not-a-uuid.tmp":  false,
+		"a.txt.8c2f1e9a-4b7d-4f1e-9a3c-5d6e7f809a1b":     false,
+		"a.txt_8c2f1e9a-4b7d-4f1e-9a3c-5d6e7f809a1b.tmp": false,
+	} {
+		if isUploadTemp(name) != expected {
+			t.Errorf("%s: expected %v", name, expected)
+		}
+	}
+}
+
+func TestUploadTempFilesUnique(t *testing.T) {
+	dir := makeTempDir("TestUploadTempFilesUnique", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	// Each upload is large enough to be written in several steps
+	contents := make(map[string]bool)
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for i := 0; i < 8; i++ {
+		content := strings.Repeat(string(rune('a'+i)), 256*1024)
+		contents[content] = true
+		r := newUploadRequest("same.bin", content, "", t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			UploadHandler(w, r)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusCreated {
+			t.Errorf("expected status %d, got %d", http.StatusCreated, code)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "same.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contents[string(data)] {
+		t.Errorf("same.bin is corrupted")
+	}
+	fileCount(dir, 1, t)
+}
+
+func TestUploadErrorCodes(t *testing.T) {
+	dir := makeTempDir("TestUploadErrorCodes", t)
+	defer os.RemoveAll(dir)
+
+	// A directory in the way of the stored file
+	os.MkdirAll(filepath.Join(dir, "taken", "sub"), 0755)
+	// A file in the way of the temporary directory
+	blocker := filepath.Join(dir, "blocker")
+	writeFile(blocker, "", t)
+
+	truncated := newUploadRequest("a.txt", strings.Repeat("x", 4096), "", t)
+	body, _ := ioutil.ReadAll(truncated.Body)
+	truncated.Body = ioutil.NopCloser(bytes.NewReader(body[:len(body)-100]))
+
+	tooManyParts := &bytes.Buffer{}
+	mw := multipart.NewWriter(tooManyParts)
+	for i := 0; i < 20; i++ {
+		mw.WriteField("junk", "x")
+	}
+	mw.Close()
+
+	tests := []struct {
+		name   string
+		extra  string
+		r      *http.Request
+		status int
+		code   string
+	}{
+		{"malformed", "", httptest.NewRequest("POST", "/upload", strings.NewReader("junk")), http.StatusBadRequest, "parse_failed"},
+		{"too many parts", "", func() *http.Request {
+			r := httptest.NewRequest("POST", "/upload", tooManyParts)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			return r
+		}(), http.StatusBadRequest, "invalid_form"},
+		{"no file", "", func() *http.Request {
+			b := &bytes.Buffer{}
+			mw := multipart.NewWriter(b)
+			mw.WriteField("filename", "a.txt")
+			mw.Close()
+			r := httptest.NewRequest("POST", "/upload", b)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			return r
+		}(), http.StatusBadRequest, "missing_file"},
+		{"long name", "max_filename_length = 8", newUploadRequest("long-name.txt", "x", "", t), http.StatusBadRequest, "invalid_filename"},
+		{"too large", "max_file_size = 1", newUploadRequest("big.bin", strings.Repeat("x", 1024*1024+1), "", t), http.StatusRequestEntityTooLarge, "too_large"},
+		{"mime", "strict_mime = true", newUploadRequest("a.png", "plain text", "", t), http.StatusUnsupportedMediaType, "unsupported_type"},
+		{"quota", "default_quota = 1", func() *http.Request {
+			r := newUploadRequest("big.bin", strings.Repeat("x", 1024*1024+1), "", t)
+			return r.WithContext(context.WithValue(r.Context(), usernameKey, "user"))
+		}(), http.StatusInsufficientStorage, "quota_exceeded"},
+		{"truncated", "", truncated, http.StatusBadRequest, "receive_failed"},
+		{"temporary directory", fmt.Sprintf("upload_temp_directory = %q", filepath.Join(blocker, "tmp")), newUploadRequest("a.txt", "x", "", t), http.StatusInternalServerError, "write_failed"},
+		{"rename", "", newUploadRequest("taken", "x", "", t), http.StatusInternalServerError, "rename_failed"},
+	}
+	for _, test := range tests {
+		loadConfig(dir, test.extra, t)
+		test.r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		UploadHandler(w, test.r)
+
+		var response struct {
+			Status int    `json:"status"`
+			Code   string `json:"code"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != test.status || response.Status != test.status || response.Code != test.code {
+			t.Errorf("%s: expected status %d and code %q, got %d %q", test.name, test.status, test.code, w.Code, w.Body.String())
+		}
+	}
+
+	// The code is on the error page too
+	loadConfig(dir, "", t)
+	w := httptest.NewRecorder()
+	UploadHandler(w, httptest.NewRequest("POST", "/upload", strings.NewReader("junk")))
+	if !strings.Contains(w.Body.String(), "parse_failed") {
+		t.Errorf("error page lacks the code: %q", w.Body.String())
+	}
+}
+
+// newSizedUploadRequest returns a request uploading content as name with a
+// form declaring its size, and its body
+func newSizedUploadRequest(name string, content string, size string, t *testing.T) (*http.Request, *bytes.Buffer) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("size", size)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Accept", "application/json")
+	return r, body
+}
+
+func TestUploadDeclaredSize(t *testing.T) {
+	dir := makeTempDir("TestUploadDeclaredSize", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "max_file_size = 1", t)
+
+	big := strings.Repeat("x", 2*1024*1024)
+	tests := []struct {
+		name    string
+		content string
+		size    string
+		status  int
+		code    string
+	}{
+		{"exact.txt", "hello", "5", http.StatusCreated, ""},
+		{"over.txt", "hello", "100", http.StatusCreated, ""},
+		{"under.txt", "hello world", "5", http.StatusBadRequest, "size_mismatch"},
+		{"invalid.txt", "hello", "five", http.StatusBadRequest, "invalid_form"},
+		{"big.txt", big, fmt.Sprint(len(big)), http.StatusRequestEntityTooLarge, "too_large"},
+	}
+	for _, test := range tests {
+		r, body := newSizedUploadRequest(test.name, test.content, test.size, t)
+		length := r.ContentLength
+		w := httptest.NewRecorder()
+		UploadHandler(w, r)
+
+		var response struct {
+			Code string `json:"code"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != test.status || response.Code != test.code {
+			t.Errorf("%s: expected status %d and code %q, got %d %q", test.name, test.status, test.code, w.Code, w.Body.String())
+		}
+		_, err := os.Stat(filepath.Join(dir, test.name))
+		if (test.status == http.StatusCreated) != (err == nil) {
+			t.Errorf("%s: unexpected stored file: %v", test.name, err)
+		}
+		// An upload rejected for its declared size isn't received
+		if unread := body.Len(); test.code == "too_large" && int64(unread) < length-64*1024 {
+			t.Errorf("%s: %d bytes of %d were read", test.name, length-int64(unread), length)
+		}
+	}
+	// Nor left behind
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		t.Errorf("unexpected temporary files %v", tmp)
+	}
+}
+
+func TestUploadEmptyPolicy(t *testing.T) {
+	dir := makeTempDir("TestUploadEmptyPolicy", t)
+	defer os.RemoveAll(dir)
+
+	// Empty files are stored by default
+	loadConfig(dir, "", t)
+	w := httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("empty.txt", "", "", t))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "empty.txt")); err != nil || info.Size() != 0 {
+		t.Fatalf("expected an empty file: %v", err)
+	}
+
+	loadConfig(dir, `empty_upload_policy = "reject"`, t)
+	for _, r := range []*http.Request{
+		newUploadRequest("other.txt", "", "", t),
+		httptest.NewRequest("PUT", "/other.txt", strings.NewReader("")),
+	} {
+		r.Header.Set("Accept", "application/json")
+		w = httptest.NewRecorder()
+		UploadHandler(w, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"empty_file"`) {
+			t.Errorf("%s: expected status %d, got %d %q", r.Method, http.StatusBadRequest, w.Code, w.Body.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other.txt")); !os.IsNotExist(err) {
+		t.Errorf("empty file was stored: %v", err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		t.Errorf("unexpected temporary files %v", tmp)
+	}
+
+	// Other files are still stored
+	w = httptest.NewRecorder()
+	UploadHandler(w, newUploadRequest("full.txt", "x", "", t))
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+// usage describes the files of a directory and the filesystem containing it
+type usage struct {
+	Files      int    `json:"files"`
+	Bytes      int64  `json:"bytes"`
+	DiskTotal  uint64 `json:"disk_total_bytes"`
+	DiskFree   uint64 `json:"disk_free_bytes"`
+	QuotaBytes int64  `json:"quota_bytes,omitempty"`
+}
+
+// cachedUsage is the usage of a directory computed at some time
+type cachedUsage struct {
+	usage usage
+	time  time.Time
+}
+
+var (
+	// diskUsage exists so it can be mocked out by tests
+	diskUsage = utilities.DiskUsage
+
+	usageCacheMutex sync.Mutex
+	usageCache      = make(map[string]cachedUsage)
+	// usageGeneration changes whenever usages are invalidated, so that a walk
+	// which may have missed the change isn't cached
+	usageGeneration uint64
+)
+
+// UsageHandler reports in JSON the number and size of the files of the user,
+// the space of the filesystem they are stored on and the quota of the user
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	mlog := logger.New()
+
+	cm := configurationmanager.New()
+	httpConfig := cm.GetHTTPConfig()
+
+	u, err := directoryUsage(userDirectory(r, httpConfig), httpConfig)
+	if err != nil {
+		mlog.Critical.Printf("%+v", err)
+		renderError(w, r, http.StatusInternalServerError, "Usage failed", fmt.Sprintf("%+v", err))
+		return
+	}
+	u.QuotaBytes = userQuota(r, httpConfig)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// directoryUsage returns the usage of dir, computed at most
+// usage_cache_duration ago and not before a change of dir through the server.
+// A directory which doesn't exist yet is empty.
+func directoryUsage(dir string, httpConfig configurationmanager.HTTPConfig) (usage, error) {
+	usageCacheMutex.Lock()
+	c, ok := usageCache[dir]
+	generation := usageGeneration
+	usageCacheMutex.Unlock()
+	if ok && time.Since(c.time) < httpConfig.UsageCacheDuration {
+		return c.usage, nil
+	}
+
+	// The cache isn't locked during the walk so that requests for other
+	// directories, or served from the cache, don't wait for it
+	now := time.Now()
+	var u usage
+	err := walk(dir, httpConfig.WalkConcurrency, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == dir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || isInternalFile(info.Name()) {
+			return nil
+		}
+
+		u.Files++
+		u.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return u, err
+	}
+
+	// The directory of a user may not exist yet but its filesystem does
+	statPath := dir
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		statPath = filepath.Dir(dir)
+	}
+	u.DiskTotal, u.DiskFree, err = diskUsage(statPath)
+	if err != nil {
+		return u, err
+	}
+
+	if httpConfig.UsageCacheDuration <= 0 {
+		return u, nil
+	}
+
+	usageCacheMutex.Lock()
+	defer usageCacheMutex.Unlock()
+	if generation == usageGeneration {
+		usageCache[dir] = cachedUsage{usage: u, time: now}
+	}
+	return u, nil
+}
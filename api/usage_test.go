@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+func TestUsageHandler(t *testing.T) {
+	dir := makeTempDir("TestUsageHandler", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, `per_user_directory = true
+default_quota = 5
+
+[[http.basic_authen]]
+username = "user"
+password = "e10adc3949ba59abbe56e057f20f883e"`, t)
+
+	defer func() {
+		diskUsage = utilities.DiskUsage
+	}()
+	diskUsage = func(path string) (uint64, uint64, error) {
+		return 1000000, 250000, nil
+	}
+
+	userDir := filepath.Join(dir, "user")
+	os.Mkdir(userDir, 0755)
+	writeFile(filepath.Join(userDir, "a.txt"), "12345", t)
+	writeFile(filepath.Join(userDir, "a.txt.sha256"), "123", t)
+	writeFile(filepath.Join(userDir, "b.txt"), "1234567890", t)
+	writeFile(filepath.Join(userDir, tempName("c.txt")), "partial", t)
+	writeFile(filepath.Join(dir, "other.txt"), "not the user's", t)
+
+	get := func() usage {
+		r := httptest.NewRequest("GET", "/usage", nil)
+		r.SetBasicAuth("user", "123456")
+		w := httptest.NewRecorder()
+		ValidateMiddleware(http.HandlerFunc(UsageHandler)).ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+
+		var u usage
+		if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+			t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+		}
+		return u
+	}
+
+	expected := usage{Files: 2, Bytes: 15, DiskTotal: 1000000, DiskFree: 250000, QuotaBytes: 5 * 1024 * 1024}
+	if u := get(); u != expected {
+		t.Fatalf("expected %+v, got %+v", expected, u)
+	}
+
+	// The result is cached for a while
+	writeFile(filepath.Join(userDir, "d.txt"), "1", t)
+	if u := get(); u != expected {
+		t.Fatalf("expected cached %+v, got %+v", expected, u)
+	}
+
+	loadConfig(dir, `per_user_directory = true
+default_quota = 5
+usage_cache_duration = "0s"
+
+[[http.basic_authen]]
+username = "user"
+password = "e10adc3949ba59abbe56e057f20f883e"`, t)
+	expected.Files, expected.Bytes = 3, 16
+	if u := get(); u != expected {
+		t.Fatalf("expected %+v, got %+v", expected, u)
+	}
+}
+
+func TestUsageConcurrent(t *testing.T) {
+	dir := makeTempDir("TestUsageConcurrent", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "", t)
+
+	slow := filepath.Join(dir, "slow")
+	fast := filepath.Join(dir, "fast")
+	os.Mkdir(slow, 0755)
+	os.Mkdir(fast, 0755)
+
+	defer func() {
+		diskUsage = utilities.DiskUsage
+	}()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	diskUsage = func(path string) (uint64, uint64, error) {
+		if path == slow {
+			close(started)
+			<-release
+		}
+		return 1000000, 250000, nil
+	}
+
+	httpConfig := configurationmanager.New().GetHTTPConfig()
+	done := make(chan error)
+	go func() {
+		_, err := directoryUsage(slow, httpConfig)
+		done <- err
+	}()
+	<-started
+
+	// The usage of another directory doesn't wait for the slow one
+	result := make(chan error)
+	go func() {
+		_, err := directoryUsage(fast, httpConfig)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("usage of a directory waited for the walk of another")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// walk is filepath.Walk, except that the entries of each directory are
+// stat'ed by up to concurrency goroutines at once, which is faster on slow or
+// networked disks. fn is still called for every file in lexical order, from
+// the goroutine of the caller. A concurrency of 1 or less is filepath.Walk.
+func walk(root string, concurrency int, fn filepath.WalkFunc) error {
+	if concurrency <= 1 {
+		return filepath.Walk(root, fn)
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDirectory(root, info, concurrency, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+// walkDirectory walks p, described by info, like filepath.Walk does
+// recursively
+func walkDirectory(p string, info os.FileInfo, concurrency int, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(p, info, nil)
+	}
+
+	names, err := readDirNames(p)
+	err1 := fn(p, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	infos, errs := lstatAll(p, names, concurrency)
+	for i, name := range names {
+		filename := filepath.Join(p, name)
+		if errs[i] != nil {
+			if err := fn(filename, nil, errs[i]); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+
+		err = walkDirectory(filename, infos[i], concurrency, fn)
+		if err != nil && (!infos[i].IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readDirNames returns the sorted names of the entries of dir
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// lstatAll returns the information and errors of os.Lstat for names in dir,
+// in the same order, from up to concurrency goroutines
+func lstatAll(dir string, names []string, concurrency int) ([]os.FileInfo, []error) {
+	infos := make([]os.FileInfo, len(names))
+	errs := make([]error, len(names))
+
+	// Each goroutine stats a contiguous share of names, which costs less
+	// synchronization than handing names out one at a time
+	if concurrency > len(names) {
+		concurrency = len(names)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func(start int, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				infos[i], errs[i] = os.Lstat(filepath.Join(dir, names[i]))
+			}
+		}(w*len(names)/concurrency, (w+1)*len(names)/concurrency)
+	}
+	wg.Wait()
+
+	return infos, errs
+}
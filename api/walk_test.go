@@ -0,0 +1,107 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// walked returns what fn is called with by walk for dir, which skips
+// directories named skip
+func walked(dir string, concurrency int, t testing.TB) []string {
+	var calls []string
+	err := walk(dir, concurrency, func(p string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dir, p)
+		switch {
+		case err != nil:
+			calls = append(calls, rel+" error")
+		case info.IsDir():
+			calls = append(calls, rel+"/")
+			if info.Name() == "skip" {
+				return filepath.SkipDir
+			}
+		default:
+			calls = append(calls, fmt.Sprintf("%s %d", rel, info.Size()))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return calls
+}
+
+func TestWalk(t *testing.T) {
+	dir := makeTempDir("TestWalk", t)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"b", "a/c", "a/skip/d", "a/b/e", "z", "A"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		writeFile(filepath.Join(dir, name), strings.Repeat("x", len(name)), t)
+	}
+	os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "link"))
+
+	expected := walked(dir, 1, t)
+	if len(expected) != 10 {
+		t.Fatalf("unexpected walk %v", expected)
+	}
+	for _, concurrency := range []int{2, 8} {
+		if calls := walked(dir, concurrency, t); !reflect.DeepEqual(calls, expected) {
+			t.Errorf("%d: expected %v, got %v", concurrency, expected, calls)
+		}
+	}
+
+	// A missing root is reported to fn
+	missing := filepath.Join(dir, "missing")
+	if calls := walked(missing, 4, t); !reflect.DeepEqual(calls, []string{". error"}) {
+		t.Errorf("unexpected walk %v", calls)
+	}
+}
+
+func TestListWalkConcurrency(t *testing.T) {
+	dir := makeTempDir("TestListWalkConcurrency", t)
+	defer os.RemoveAll(dir)
+	loadConfig(dir, "walk_concurrency = 4", t)
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeFile(filepath.Join(dir, "b.txt"), "beta", t)
+	writeFile(filepath.Join(dir, "sub", "a.txt"), "alpha", t)
+	writeFile(filepath.Join(dir, tempName("a.txt")), "partial", t)
+
+	if names := list(t); !reflect.DeepEqual(names, []string{"b.txt", "sub/a.txt"}) {
+		t.Errorf("unexpected files %v", names)
+	}
+}
+
+// BenchmarkWalk compares serial and concurrent walks of a directory of 10000
+// files
+func BenchmarkWalk(b *testing.B) {
+	dir := makeTempDir("BenchmarkWalk", b)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 100; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("%03d", i))
+		os.Mkdir(sub, 0755)
+		for j := 0; j < 100; j++ {
+			writeFile(filepath.Join(sub, fmt.Sprintf("%03d.txt", j)), "x", b)
+		}
+	}
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				count := 0
+				walk(dir, concurrency, func(p string, info os.FileInfo, err error) error {
+					count++
+					return err
+				})
+				if count != 10101 {
+					b.Fatalf("walked %d files", count)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	// UPLOAD represents a file stored by an upload
+	UPLOAD = "upload"
+	// DELETE represents a file removed by a delete request
+	DELETE = "delete"
+)
+
+// Record is an entry of the audit log
+type Record struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`
+	Action   string    `json:"action"`
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256,omitempty"`
+}
+
+// Auditing writes records to the audit log, one JSON object per line. It's
+// separated from the operational log so records can be processed by tools.
+type Auditing struct {
+	mu     sync.Mutex
+	stream io.Writer
+}
+
+var instance *Auditing
+var once sync.Once
+
+// New initializes singleton audit log. Records are discarded until a stream
+// is configured.
+func New() *Auditing {
+	once.Do(func() {
+		instance = &Auditing{}
+		instance.stream = ioutil.Discard
+	})
+
+	return instance
+}
+
+// SetStream configures the stream records are appended to
+func (a *Auditing) SetStream(stream io.Writer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stream = stream
+}
+
+// Log appends a record to the audit log. Time is set to now if it's zero.
+func (a *Auditing) Log(record Record) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// A single write keeps the line whole across log rotation
+	_, err = a.stream.Write(line)
+	return err
+}
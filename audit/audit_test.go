@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := New()
+	a.SetStream(buf)
+
+	now := time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Time: now, User: "alice", Action: UPLOAD, Filename: "a.txt", Size: 3, SHA256: "abc"},
+		{Action: DELETE, Filename: "a.txt"},
+	}
+	for _, r := range records {
+		if err := a.Log(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scanner := bufio.NewScanner(buf)
+	var lines []Record
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %q is not valid JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, r)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	if !lines[0].Time.Equal(now) || lines[0].User != "alice" || lines[0].SHA256 != "abc" {
+		t.Fatalf("unexpected record %+v", lines[0])
+	}
+	if lines[1].Time.IsZero() {
+		t.Fatalf("expected time to be set")
+	}
+}
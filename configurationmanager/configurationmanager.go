@@ -1,39 +1,269 @@
 package configurationmanager
 
 import (
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/http/httpguts"
 
 	"github.com/anhdowastaken/fileserver-go/logger"
+	"github.com/anhdowastaken/fileserver-go/utilities"
+)
+
+// Policies applied to upload filenames containing a path
+const (
+	// FilenamePathReplace replaces slashes with underscores like other
+	// reserved characters
+	FilenamePathReplace = "replace"
+	// FilenamePathBase keeps the last element of the path only
+	FilenamePathBase = "base"
+	// FilenamePathReject rejects the upload
+	FilenamePathReject = "reject"
+	// FilenamePathSubdirectory stores the file in subdirectories
+	FilenamePathSubdirectory = "subdirectory"
+)
+
+// Cases of stored filenames
+const (
+	// FilenameCasePreserve stores filenames as they are uploaded
+	FilenameCasePreserve = "preserve"
+	// FilenameCaseLower stores filenames in lowercase
+	FilenameCaseLower = "lower"
+	// FilenameCaseASCII stores filenames in lowercase ASCII
+	FilenameCaseASCII = "ascii"
+)
+
+// Policies applied to upload filenames which are sanitized to the name of an
+// existing file uploaded under another name
+const (
+	// FilenameCollisionOverwrite overwrites the existing file
+	FilenameCollisionOverwrite = "overwrite"
+	// FilenameCollisionSuffix stores the file with a numeric suffix
+	FilenameCollisionSuffix = "suffix"
+	// FilenameCollisionReject rejects the upload
+	FilenameCollisionReject = "reject"
+)
+
+// Policies applied to missing files requested in an archive
+const (
+	// ArchiveMissingReject rejects the request
+	ArchiveMissingReject = "reject"
+	// ArchiveMissingSkip leaves the missing files out of the archive
+	ArchiveMissingSkip = "skip"
+)
+
+// Policies applied to uploads of empty files
+const (
+	// EmptyUploadAllow stores empty files like any other
+	EmptyUploadAllow = "allow"
+	// EmptyUploadReject rejects the upload
+	EmptyUploadReject = "reject"
+)
+
+// Strategies of the ETags of downloads
+const (
+	// ETagModTime makes ETags of the modification time and size of files
+	ETagModTime = "modtime"
+	// ETagContent makes ETags of the SHA-256 of the content of files
+	ETagContent = "content"
+)
+
+// Routes of downloads whose rate limit can be set in download_rate_limits
+const (
+	// RouteDownload is /download/
+	RouteDownload = "download"
+	// RouteShared is /shared/
+	RouteShared = "shared"
+	// RouteArchive is /archive and /archive/
+	RouteArchive = "archive"
+)
+
+// EncryptionKeyEnv is the environment variable used as encryption key when
+// encryption_key is not set in the config file
+const EncryptionKeyEnv = "FILESERVER_ENCRYPTION_KEY"
+
+// ShareKeyEnv is the environment variable used as key to sign share links
+// when share_key is not set in the config file
+const ShareKeyEnv = "FILESERVER_SHARE_KEY"
+
+// MinShareKeySize is the minimum size in bytes of the key signing share links
+const MinShareKeySize = 32
+
+const (
+	// LogTimezoneLocal makes log timestamps and log file names use local time
+	LogTimezoneLocal = "local"
+	// LogTimezoneUTC makes log timestamps and log file names use UTC
+	LogTimezoneUTC = "utc"
+)
+
+// Primary streams of logs
+const (
+	// LogOutputSyslog logs to syslog, or to standard error if it's unavailable
+	LogOutputSyslog = "syslog"
+	// LogOutputStdout logs to standard output
+	LogOutputStdout = "stdout"
+	// LogOutputStderr logs to standard error
+	LogOutputStderr = "stderr"
 )
 
 // AppConfig structure contains main configuration of the app
 type AppConfig struct {
-	FilelogDestination string `mapstructure:"filelog_destination"`
-	LogEnable          bool   `mapstructure:"log_enable"`
-	LogLevel           int    `mapstructure:"log_level"`
-	LogRotationTime    int    `mapstructure:"log_rotation_time"`
-	MaxLogSize         int    `mapstructure:"max_log_size"`
+	LogOutput           string `mapstructure:"log_output"`
+	FilelogDestination  string `mapstructure:"filelog_destination"`
+	AuditLogDestination string `mapstructure:"audit_log_destination"`
+	LogTimezone         string `mapstructure:"log_timezone"`
+	LogCompression      bool   `mapstructure:"log_compression"`
+	LogEnable           bool   `mapstructure:"log_enable"`
+	LogLevel            int    `mapstructure:"log_level"`
+	AccessLogLevel      int    `mapstructure:"access_log_level"`
+	LogRotationTime     int    `mapstructure:"log_rotation_time"`
+	MaxLogSize          int    `mapstructure:"max_log_size"`
 }
 
 type HTTPConfig struct {
-	Address             string        `mapstructure:"address"`
-	SSL                 bool          `mapstructure:"ssl"`
-	KeyFile             string        `mapstructure:"key_file"`
-	CertFile            string        `mapstructure:"cert_file"`
-	MaxFileSize         int           `mapstructure:"max_file_size"`
-	FileServerDirectory string        `mapstructure:"file_server_directory"`
-	Authen              []BasicAuthen `mapstructure:"basic_authen"`
+	Address                     string            `mapstructure:"address"`
+	SSL                         bool              `mapstructure:"ssl"`
+	H2C                         bool              `mapstructure:"h2c"`
+	KeyFile                     string            `mapstructure:"key_file"`
+	CertFile                    string            `mapstructure:"cert_file"`
+	RequireClientCert           bool              `mapstructure:"require_client_cert"`
+	CAFile                      string            `mapstructure:"ca_file"`
+	ClientCertIdentity          bool              `mapstructure:"client_cert_identity"`
+	DisableSessionTickets       bool              `mapstructure:"disable_session_tickets"`
+	OCSPStapleFile              string            `mapstructure:"ocsp_staple_file"`
+	MaxFileSize                 int               `mapstructure:"max_file_size"`
+	ExtensionMaxFileSizeStrings map[string]string `mapstructure:"extension_max_file_size"`
+	MaxFilenameLength           int               `mapstructure:"max_filename_length"`
+	MaxFormParts                int               `mapstructure:"max_form_parts"`
+	UploadFieldName             string            `mapstructure:"upload_field_name"`
+	AnyUploadField              bool              `mapstructure:"any_upload_field"`
+	MaxFormFieldSize            int               `mapstructure:"max_form_field_size"`
+	MultipartMemory             int               `mapstructure:"multipart_memory"`
+	CopyBufferSize              int               `mapstructure:"copy_buffer_size"`
+	DownloadRateLimitString     string            `mapstructure:"download_rate_limit"`
+	DownloadRateLimitStrings    map[string]string `mapstructure:"download_rate_limits"`
+	MaxHeaderBytes              int               `mapstructure:"max_header_bytes"`
+	MaxConnections              int               `mapstructure:"max_connections"`
+	MaxRequestsPerIP            int               `mapstructure:"max_requests_per_ip"`
+	MaxPathDepth                int               `mapstructure:"max_path_depth"`
+	WalkConcurrency             int               `mapstructure:"walk_concurrency"`
+	ListCacheDuration           time.Duration     `mapstructure:"list_cache_duration"`
+	UsageCacheDuration          time.Duration     `mapstructure:"usage_cache_duration"`
+	MaxFileCount                int               `mapstructure:"max_file_count"`
+	TruncateFilename            bool              `mapstructure:"truncate_filename"`
+	FilenamePathPolicy          string            `mapstructure:"filename_path_policy"`
+	FilenameCollisionPolicy     string            `mapstructure:"filename_collision_policy"`
+	FilenameCase                string            `mapstructure:"filename_case"`
+	EmptyUploadPolicy           string            `mapstructure:"empty_upload_policy"`
+	ArchiveMissingPolicy        string            `mapstructure:"archive_missing_policy"`
+	MaxArchiveSize              int               `mapstructure:"max_archive_size"`
+	FileServerDirectory         string            `mapstructure:"file_server_directory"`
+	UploadTempDirectory         string            `mapstructure:"upload_temp_directory"`
+	FileModeString              string            `mapstructure:"file_mode"`
+	DirModeString               string            `mapstructure:"dir_mode"`
+	ChecksumSidecar             bool              `mapstructure:"checksum_sidecar"`
+	DurableUpload               bool              `mapstructure:"durable_upload"`
+	RejectConcurrentUploads     bool              `mapstructure:"reject_concurrent_uploads"`
+	ETagStrategy                string            `mapstructure:"etag_strategy"`
+	SafeDownloads               bool              `mapstructure:"safe_downloads"`
+	PruneEmptyDirectories       bool              `mapstructure:"prune_empty_directories"`
+	StrictMIME                  bool              `mapstructure:"strict_mime"`
+	VerifyMagicBytes            bool              `mapstructure:"verify_magic_bytes"`
+	HiddenPatterns              []string          `mapstructure:"hidden_patterns"`
+	StaticDirectory             string            `mapstructure:"static_directory"`
+	FaviconFile                 string            `mapstructure:"favicon_file"`
+	Encryption                  bool              `mapstructure:"encryption"`
+	EncryptionKeyHex            string            `mapstructure:"encryption_key"`
+	IndexEnable                 bool              `mapstructure:"index_enable"`
+	EnableUpload                bool              `mapstructure:"enable_upload"`
+	IndexTemplate               string            `mapstructure:"index_template"`
+	TemplateDirectory           string            `mapstructure:"template_directory"`
+	UnauthorizedPage            bool              `mapstructure:"unauthorized_page"`
+	ServerHeader                string            `mapstructure:"server_header"`
+	HTMLCharset                 string            `mapstructure:"html_charset"`
+	ContentTypes                map[string]string `mapstructure:"content_types"`
+	CustomHeaders               map[string]string `mapstructure:"custom_headers"`
+	VersionPublic               bool              `mapstructure:"version_public"`
+	LogThroughput               bool              `mapstructure:"log_throughput"`
+	SlowRequestThreshold        time.Duration     `mapstructure:"slow_request_threshold"`
+	TempFileMaxAge              time.Duration     `mapstructure:"temp_file_max_age"`
+	HandlerTimeout              time.Duration     `mapstructure:"handler_timeout"`
+	ImmutablePeriod             time.Duration     `mapstructure:"immutable_period"`
+	PostUploadCommand           string            `mapstructure:"post_upload_command"`
+	PostUploadTimeout           time.Duration     `mapstructure:"post_upload_timeout"`
+	PostUploadDeleteOnFailure   bool              `mapstructure:"post_upload_delete_on_failure"`
+	PostUploadRetries           int               `mapstructure:"post_upload_retries"`
+	PostUploadRetryBackoff      time.Duration     `mapstructure:"post_upload_retry_backoff"`
+	PostUploadRetryMaxDuration  time.Duration     `mapstructure:"post_upload_retry_max_duration"`
+	ShareKeyHex                 string            `mapstructure:"share_key"`
+	ShareTTL                    time.Duration     `mapstructure:"share_ttl"`
+	DrainRetryAfter             time.Duration     `mapstructure:"drain_retry_after"`
+	DrainDownloads              bool              `mapstructure:"drain_downloads"`
+	PerUserDirectory            bool              `mapstructure:"per_user_directory"`
+	DefaultQuota                int               `mapstructure:"default_quota"`
+	MinFreeSpaceString          string            `mapstructure:"min_free_space"`
+	RequireAuthForDownload      bool              `mapstructure:"require_auth_for_download"`
+	RequireAuthForUpload        bool              `mapstructure:"require_auth_for_upload"`
+	HtpasswdFile                string            `mapstructure:"htpasswd_file"`
+	Authen                      []BasicAuthen     `mapstructure:"basic_authen"`
+
+	// FileMode is the permission applied to uploaded files. If it's 0, files
+	// keep the permission they are created with.
+	FileMode os.FileMode `mapstructure:"-"`
+	// DirMode is the permission of directories created by the server
+	DirMode os.FileMode `mapstructure:"-"`
+	// ExtensionMaxFileSize is the maximum size in bytes of uploaded files by
+	// lowercase extension, starting with a dot, overriding MaxFileSize
+	ExtensionMaxFileSize map[string]int64 `mapstructure:"-"`
+	// DownloadRateLimit is the maximum rate in bytes per second at which each
+	// download is sent. If it's 0, downloads are not throttled.
+	DownloadRateLimit int64 `mapstructure:"-"`
+	// DownloadRateLimits overrides DownloadRateLimit by route
+	DownloadRateLimits map[string]int64 `mapstructure:"-"`
+	// MinFreeSpace is the free space in bytes of the disk below which uploads
+	// are refused. If it's 0, uploads are not refused for free space.
+	MinFreeSpace int64 `mapstructure:"-"`
+	// EncryptionKey is the AES-256 key used to encrypt stored files
+	EncryptionKey []byte `mapstructure:"-"`
+	// ClientCAs are the certificate authorities of client certificates
+	// loaded from CAFile
+	ClientCAs *x509.CertPool `mapstructure:"-"`
+	// OCSPStaple is the OCSP response read from OCSPStapleFile
+	OCSPStaple []byte `mapstructure:"-"`
+	// ShareKey is the HMAC key signing share links. If it's empty, sharing
+	// is disabled.
+	ShareKey []byte `mapstructure:"-"`
 }
 
+// BasicAuthen is a user allowed to access the web server. Password is a hash
+// in any format supported by utilities.VerifyPassword.
+//
+// Quota is the storage quota of the user in MB. If it's 0, the default quota
+// applies. If it's negative, the user has no quota. Admin users can reach the
+// administration endpoints.
 type BasicAuthen struct {
 	Username string `mapstructure:"username"`
 	Password string `mapstructure:"password"`
+	Quota    int    `mapstructure:"quota"`
+	Admin    bool   `mapstructure:"admin"`
 }
 
+// charsetPattern matches the names of charsets registered by IANA
+var charsetPattern = regexp.MustCompile(`^[A-Za-z0-9!#$%&'+^_{}~.:-]+$`)
+
 // ConfigurationManager structure
 type ConfigurationManager struct {
 	mutex      sync.Mutex
@@ -94,6 +324,15 @@ func (cm *ConfigurationManager) Load(configurationFile string) error {
 		}
 	}
 
+	if m["access_log_level"] == nil {
+		tmp.appConfig.AccessLogLevel = tmp.appConfig.LogLevel // By default, same as log level
+	} else {
+		accessLogLevel, ok := m["access_log_level"].(int64)
+		if !ok || (accessLogLevel < logger.FATAL || accessLogLevel > logger.DEBUG) {
+			tmp.appConfig.AccessLogLevel = tmp.appConfig.LogLevel
+		}
+	}
+
 	if m["log_rotation_time"] == nil {
 		tmp.appConfig.LogRotationTime = 60 // By default, log will be rotated after 60 minutes
 	} else {
@@ -112,6 +351,22 @@ func (cm *ConfigurationManager) Load(configurationFile string) error {
 		}
 	}
 
+	tmp.appConfig.LogTimezone = strings.ToLower(strings.TrimSpace(tmp.appConfig.LogTimezone))
+	if tmp.appConfig.LogTimezone == "" {
+		tmp.appConfig.LogTimezone = LogTimezoneLocal // By default, log timestamps are in local time
+	} else if tmp.appConfig.LogTimezone != LogTimezoneLocal && tmp.appConfig.LogTimezone != LogTimezoneUTC {
+		return fmt.Errorf("log_timezone is not valid: %s", tmp.appConfig.LogTimezone)
+	}
+
+	tmp.appConfig.LogOutput = strings.ToLower(strings.TrimSpace(tmp.appConfig.LogOutput))
+	switch tmp.appConfig.LogOutput {
+	case "":
+		tmp.appConfig.LogOutput = LogOutputSyslog // By default, logs go to syslog
+	case LogOutputSyslog, LogOutputStdout, LogOutputStderr:
+	default:
+		return fmt.Errorf("log_output must be %s, %s or %s", LogOutputSyslog, LogOutputStdout, LogOutputStderr)
+	}
+
 	err = cm.v.UnmarshalKey("http", &tmp.httpConfig)
 	if err != nil {
 		return fmt.Errorf("[http] part of config file is not valid: %s \n", err)
@@ -131,6 +386,31 @@ func (cm *ConfigurationManager) Load(configurationFile string) error {
 		tmp.httpConfig.SSL = false
 	}
 
+	if m["index_enable"] == nil {
+		tmp.httpConfig.IndexEnable = true
+	}
+
+	if m["enable_upload"] == nil {
+		tmp.httpConfig.EnableUpload = true
+	}
+
+	tmp.httpConfig.UploadFieldName = strings.TrimSpace(tmp.httpConfig.UploadFieldName)
+	if tmp.httpConfig.UploadFieldName == "" {
+		tmp.httpConfig.UploadFieldName = "file" // By default, the file is sent in the "file" field
+	}
+
+	if m["require_auth_for_download"] == nil {
+		tmp.httpConfig.RequireAuthForDownload = true
+	}
+
+	if m["require_auth_for_upload"] == nil {
+		tmp.httpConfig.RequireAuthForUpload = true
+	}
+
+	if m["safe_downloads"] == nil {
+		tmp.httpConfig.SafeDownloads = true
+	}
+
 	if m["max_file_size"] == nil {
 		tmp.httpConfig.MaxFileSize = 10
 	} else {
@@ -140,6 +420,430 @@ func (cm *ConfigurationManager) Load(configurationFile string) error {
 		}
 	}
 
+	tmp.httpConfig.ExtensionMaxFileSize = make(map[string]int64)
+	for ext, size := range tmp.httpConfig.ExtensionMaxFileSizeStrings {
+		ext = normalizeExtension(ext)
+		n, err := utilities.ParseSize(size)
+		if err != nil || n <= 0 || ext == "." {
+			return fmt.Errorf("extension_max_file_size of %s is not valid: %q", ext, size)
+		}
+		tmp.httpConfig.ExtensionMaxFileSize[ext] = n
+	}
+
+	if s := tmp.httpConfig.DownloadRateLimitString; s != "" {
+		tmp.httpConfig.DownloadRateLimit, err = utilities.ParseSize(s)
+		if err != nil {
+			return fmt.Errorf("download_rate_limit is not valid: %q", s)
+		}
+	}
+
+	tmp.httpConfig.DownloadRateLimits = make(map[string]int64)
+	for route, limit := range tmp.httpConfig.DownloadRateLimitStrings {
+		route = strings.ToLower(strings.TrimSpace(route))
+		switch route {
+		case RouteDownload, RouteShared, RouteArchive:
+		default:
+			return fmt.Errorf("route of download_rate_limits must be %s, %s or %s: %q", RouteDownload, RouteShared, RouteArchive, route)
+		}
+		n, err := utilities.ParseSize(limit)
+		if err != nil {
+			return fmt.Errorf("download_rate_limits of %s is not valid: %q", route, limit)
+		}
+		tmp.httpConfig.DownloadRateLimits[route] = n
+	}
+
+	contentTypes := make(map[string]string)
+	for ext, contentType := range tmp.httpConfig.ContentTypes {
+		ext = normalizeExtension(ext)
+		contentType = strings.TrimSpace(contentType)
+		if _, _, err := mime.ParseMediaType(contentType); err != nil || ext == "." {
+			return fmt.Errorf("content type of %s is not valid: %q", ext, contentType)
+		}
+		contentTypes[ext] = contentType
+	}
+	tmp.httpConfig.ContentTypes = contentTypes
+
+	customHeaders := make(map[string]string)
+	for name, value := range tmp.httpConfig.CustomHeaders {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("custom header %q is not valid: %q", name, value)
+		}
+		customHeaders[name] = value
+	}
+	tmp.httpConfig.CustomHeaders = customHeaders
+
+	if m["default_quota"] != nil {
+		defaultQuota, ok := m["default_quota"].(int64)
+		if !ok || defaultQuota < 0 {
+			tmp.httpConfig.DefaultQuota = 0 // By default, there is no quota
+		}
+	}
+
+	if s := tmp.httpConfig.MinFreeSpaceString; s != "" {
+		tmp.httpConfig.MinFreeSpace, err = utilities.ParseSize(s)
+		if err != nil {
+			return fmt.Errorf("min_free_space is not valid: %q", s)
+		}
+	}
+
+	if m["max_filename_length"] == nil {
+		tmp.httpConfig.MaxFilenameLength = 255 // By default, filenames are limited to 255 bytes
+	} else {
+		maxFilenameLength, ok := m["max_filename_length"].(int64)
+		if !ok || maxFilenameLength <= 0 {
+			tmp.httpConfig.MaxFilenameLength = 255
+		}
+	}
+
+	if m["max_form_parts"] == nil {
+		tmp.httpConfig.MaxFormParts = 16 // By default, an upload form has at most 16 parts
+	} else {
+		maxFormParts, ok := m["max_form_parts"].(int64)
+		if !ok || maxFormParts <= 0 {
+			tmp.httpConfig.MaxFormParts = 16
+		}
+	}
+
+	if m["max_header_bytes"] == nil {
+		tmp.httpConfig.MaxHeaderBytes = 1 << 20 // By default, same as Go's default of 1MB
+	} else {
+		maxHeaderBytes, ok := m["max_header_bytes"].(int64)
+		if !ok || maxHeaderBytes <= 0 {
+			tmp.httpConfig.MaxHeaderBytes = 1 << 20
+		}
+	}
+
+	if m["max_connections"] != nil {
+		maxConnections, ok := m["max_connections"].(int64)
+		if !ok || maxConnections < 0 {
+			tmp.httpConfig.MaxConnections = 0 // By default, connections are unlimited
+		}
+	}
+
+	if m["max_path_depth"] != nil {
+		maxPathDepth, ok := m["max_path_depth"].(int64)
+		if !ok || maxPathDepth < 0 {
+			tmp.httpConfig.MaxPathDepth = 0 // By default, paths can be as deep as the filesystem allows
+		}
+	}
+
+	if m["max_file_count"] != nil {
+		maxFileCount, ok := m["max_file_count"].(int64)
+		if !ok || maxFileCount < 0 {
+			tmp.httpConfig.MaxFileCount = 0 // By default, the number of files is unlimited
+		}
+	}
+
+	if m["max_archive_size"] == nil {
+		tmp.httpConfig.MaxArchiveSize = 1024 // By default, directories up to 1GB are archived
+	} else {
+		maxArchiveSize, ok := m["max_archive_size"].(int64)
+		if !ok || maxArchiveSize < 0 {
+			tmp.httpConfig.MaxArchiveSize = 1024
+		}
+	}
+
+	if m["multipart_memory"] == nil {
+		tmp.httpConfig.MultipartMemory = 32 << 20 // By default, same as Go's default of 32MB
+	} else {
+		multipartMemory, ok := m["multipart_memory"].(int64)
+		if !ok || multipartMemory <= 0 {
+			tmp.httpConfig.MultipartMemory = 32 << 20
+		}
+	}
+
+	if m["max_form_field_size"] == nil {
+		tmp.httpConfig.MaxFormFieldSize = 4096 // By default, a form field is at most 4KB
+	} else {
+		maxFormFieldSize, ok := m["max_form_field_size"].(int64)
+		if !ok || maxFormFieldSize <= 0 {
+			tmp.httpConfig.MaxFormFieldSize = 4096
+		}
+	}
+
+	if m["walk_concurrency"] == nil {
+		tmp.httpConfig.WalkConcurrency = 1 // By default, files are stat'ed one at a time
+	} else {
+		walkConcurrency, ok := m["walk_concurrency"].(int64)
+		if !ok || walkConcurrency <= 0 {
+			tmp.httpConfig.WalkConcurrency = 1
+		}
+	}
+
+	err = checkDuration(m, "list_cache_duration")
+	if err != nil {
+		return err
+	}
+
+	if m["usage_cache_duration"] == nil {
+		tmp.httpConfig.UsageCacheDuration = 10 * time.Second // By default, usages are reused for 10 seconds
+	} else {
+		err = checkDuration(m, "usage_cache_duration")
+		if err != nil {
+			return err
+		}
+	}
+
+	if m["max_requests_per_ip"] != nil {
+		maxRequestsPerIP, ok := m["max_requests_per_ip"].(int64)
+		if !ok || maxRequestsPerIP < 0 {
+			tmp.httpConfig.MaxRequestsPerIP = 0 // By default, there is no limit per IP
+		}
+	}
+
+	if m["copy_buffer_size"] == nil {
+		tmp.httpConfig.CopyBufferSize = 32 << 10 // By default, same as io.Copy's buffer of 32KB
+	} else {
+		copyBufferSize, ok := m["copy_buffer_size"].(int64)
+		if !ok || copyBufferSize <= 0 {
+			tmp.httpConfig.CopyBufferSize = 32 << 10
+		}
+	}
+
+	err = checkDuration(m, "slow_request_threshold")
+	if err != nil {
+		return err
+	}
+
+	err = checkDuration(m, "handler_timeout")
+	if err != nil {
+		return err
+	}
+
+	err = checkDuration(m, "immutable_period")
+	if err != nil {
+		return err
+	}
+
+	if m["post_upload_timeout"] == nil {
+		tmp.httpConfig.PostUploadTimeout = time.Minute // By default, the post upload command is killed after 1 minute
+	} else {
+		err = checkDuration(m, "post_upload_timeout")
+		if err != nil {
+			return err
+		}
+		if tmp.httpConfig.PostUploadTimeout <= 0 {
+			return fmt.Errorf("post_upload_timeout must be positive")
+		}
+	}
+
+	if m["post_upload_retries"] != nil {
+		postUploadRetries, ok := m["post_upload_retries"].(int64)
+		if !ok || postUploadRetries < 0 {
+			tmp.httpConfig.PostUploadRetries = 0 // By default, the post upload command isn't retried
+		}
+	}
+
+	if m["post_upload_retry_backoff"] == nil {
+		tmp.httpConfig.PostUploadRetryBackoff = time.Second // By default, the first retry is after 1 second
+	} else {
+		err = checkDuration(m, "post_upload_retry_backoff")
+		if err != nil {
+			return err
+		}
+	}
+
+	if m["post_upload_retry_max_duration"] == nil {
+		tmp.httpConfig.PostUploadRetryMaxDuration = 10 * time.Minute // By default, retries stop 10 minutes after the first run
+	} else {
+		err = checkDuration(m, "post_upload_retry_max_duration")
+		if err != nil {
+			return err
+		}
+	}
+
+	if m["drain_retry_after"] == nil {
+		tmp.httpConfig.DrainRetryAfter = time.Minute // By default, clients retry after 1 minute while draining
+	} else {
+		err = checkDuration(m, "drain_retry_after")
+		if err != nil {
+			return err
+		}
+		if tmp.httpConfig.DrainRetryAfter < 0 {
+			return fmt.Errorf("drain_retry_after must not be negative")
+		}
+	}
+
+	if m["share_ttl"] == nil {
+		tmp.httpConfig.ShareTTL = 24 * time.Hour // By default, share links are valid for 1 day
+	} else {
+		err = checkDuration(m, "share_ttl")
+		if err != nil {
+			return err
+		}
+		if tmp.httpConfig.ShareTTL <= 0 {
+			return fmt.Errorf("share_ttl must be positive")
+		}
+	}
+
+	if m["temp_file_max_age"] == nil {
+		tmp.httpConfig.TempFileMaxAge = time.Hour // By default, temporary files older than 1 hour are purged
+	} else {
+		err = checkDuration(m, "temp_file_max_age")
+		if err != nil {
+			return err
+		}
+	}
+
+	if m["file_mode"] != nil {
+		tmp.httpConfig.FileMode, err = parseMode(tmp.httpConfig.FileModeString)
+		if err != nil {
+			return fmt.Errorf("file_mode is not valid: %s", err)
+		}
+	}
+
+	if m["dir_mode"] == nil {
+		tmp.httpConfig.DirMode = 0755
+	} else {
+		tmp.httpConfig.DirMode, err = parseMode(tmp.httpConfig.DirModeString)
+		if err != nil {
+			return fmt.Errorf("dir_mode is not valid: %s", err)
+		}
+	}
+
+	if tmp.httpConfig.Encryption {
+		key := strings.TrimSpace(tmp.httpConfig.EncryptionKeyHex)
+		if key == "" {
+			key = strings.TrimSpace(os.Getenv(EncryptionKeyEnv))
+		}
+		if key == "" {
+			return fmt.Errorf("encryption is enabled but no key is set in encryption_key or %s", EncryptionKeyEnv)
+		}
+
+		tmp.httpConfig.EncryptionKey, err = hex.DecodeString(key)
+		if err != nil || len(tmp.httpConfig.EncryptionKey) != utilities.EncryptionKeySize {
+			return fmt.Errorf("encryption key must be %d bytes encoded in hex", utilities.EncryptionKeySize)
+		}
+	}
+
+	// Anonymous clients would be served the directories of all users
+	if tmp.httpConfig.PerUserDirectory && !tmp.httpConfig.RequireAuthForDownload {
+		return fmt.Errorf("per_user_directory requires require_auth_for_download")
+	}
+
+	key := strings.TrimSpace(tmp.httpConfig.ShareKeyHex)
+	if key == "" {
+		key = strings.TrimSpace(os.Getenv(ShareKeyEnv))
+	}
+	if key != "" {
+		tmp.httpConfig.ShareKey, err = hex.DecodeString(key)
+		if err != nil || len(tmp.httpConfig.ShareKey) < MinShareKeySize {
+			return fmt.Errorf("share key must be at least %d bytes encoded in hex", MinShareKeySize)
+		}
+	}
+
+	tmp.httpConfig.CAFile = strings.TrimSpace(tmp.httpConfig.CAFile)
+	if tmp.httpConfig.SSL && tmp.httpConfig.RequireClientCert {
+		if tmp.httpConfig.CAFile == "" {
+			return fmt.Errorf("client certificates are required but ca_file is empty")
+		}
+
+		pem, err := ioutil.ReadFile(tmp.httpConfig.CAFile)
+		if err != nil {
+			return fmt.Errorf("cannot read ca_file: %s", err)
+		}
+		tmp.httpConfig.ClientCAs = x509.NewCertPool()
+		if !tmp.httpConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("ca_file %s contains no certificate", tmp.httpConfig.CAFile)
+		}
+	}
+
+	tmp.httpConfig.OCSPStapleFile = strings.TrimSpace(tmp.httpConfig.OCSPStapleFile)
+	if tmp.httpConfig.SSL && tmp.httpConfig.OCSPStapleFile != "" {
+		tmp.httpConfig.OCSPStaple, err = ioutil.ReadFile(tmp.httpConfig.OCSPStapleFile)
+		if err != nil {
+			return fmt.Errorf("cannot read ocsp_staple_file: %s", err)
+		}
+		if _, err := ocsp.ParseResponse(tmp.httpConfig.OCSPStaple, nil); err != nil {
+			return fmt.Errorf("ocsp_staple_file %s is not a valid OCSP response: %s", tmp.httpConfig.OCSPStapleFile, err)
+		}
+	}
+
+	tmp.httpConfig.HtpasswdFile = strings.TrimSpace(tmp.httpConfig.HtpasswdFile)
+	if tmp.httpConfig.HtpasswdFile != "" {
+		entries, err := readHtpasswd(tmp.httpConfig.HtpasswdFile)
+		if err != nil {
+			return fmt.Errorf("cannot read htpasswd file %s: %s", tmp.httpConfig.HtpasswdFile, err)
+		}
+
+		// Entries of the htpasswd file take precedence over the ones of the config file
+		tmp.httpConfig.Authen = mergeAuthen(entries, tmp.httpConfig.Authen)
+	}
+
+	tmp.httpConfig.FilenamePathPolicy = strings.ToLower(strings.TrimSpace(tmp.httpConfig.FilenamePathPolicy))
+	switch tmp.httpConfig.FilenamePathPolicy {
+	case "":
+		tmp.httpConfig.FilenamePathPolicy = FilenamePathReplace // By default, paths are flattened
+	case FilenamePathReplace, FilenamePathBase, FilenamePathReject, FilenamePathSubdirectory:
+	default:
+		return fmt.Errorf("filename_path_policy must be %s, %s, %s or %s",
+			FilenamePathReplace, FilenamePathBase, FilenamePathReject, FilenamePathSubdirectory)
+	}
+
+	tmp.httpConfig.FilenameCollisionPolicy = strings.ToLower(strings.TrimSpace(tmp.httpConfig.FilenameCollisionPolicy))
+	switch tmp.httpConfig.FilenameCollisionPolicy {
+	case "":
+		tmp.httpConfig.FilenameCollisionPolicy = FilenameCollisionOverwrite
+	case FilenameCollisionOverwrite, FilenameCollisionSuffix, FilenameCollisionReject:
+	default:
+		return fmt.Errorf("filename_collision_policy must be %s, %s or %s",
+			FilenameCollisionOverwrite, FilenameCollisionSuffix, FilenameCollisionReject)
+	}
+
+	tmp.httpConfig.FilenameCase = strings.ToLower(strings.TrimSpace(tmp.httpConfig.FilenameCase))
+	switch tmp.httpConfig.FilenameCase {
+	case "":
+		tmp.httpConfig.FilenameCase = FilenameCasePreserve // By default, filenames keep their case
+	case FilenameCasePreserve, FilenameCaseLower, FilenameCaseASCII:
+	default:
+		return fmt.Errorf("filename_case must be %s, %s or %s", FilenameCasePreserve, FilenameCaseLower, FilenameCaseASCII)
+	}
+
+	tmp.httpConfig.EmptyUploadPolicy = strings.ToLower(strings.TrimSpace(tmp.httpConfig.EmptyUploadPolicy))
+	switch tmp.httpConfig.EmptyUploadPolicy {
+	case "":
+		tmp.httpConfig.EmptyUploadPolicy = EmptyUploadAllow
+	case EmptyUploadAllow, EmptyUploadReject:
+	default:
+		return fmt.Errorf("empty_upload_policy must be %s or %s", EmptyUploadAllow, EmptyUploadReject)
+	}
+
+	tmp.httpConfig.ETagStrategy = strings.ToLower(strings.TrimSpace(tmp.httpConfig.ETagStrategy))
+	switch tmp.httpConfig.ETagStrategy {
+	case "":
+		tmp.httpConfig.ETagStrategy = ETagModTime
+	case ETagModTime, ETagContent:
+	default:
+		return fmt.Errorf("etag_strategy must be %s or %s", ETagModTime, ETagContent)
+	}
+
+	tmp.httpConfig.ArchiveMissingPolicy = strings.ToLower(strings.TrimSpace(tmp.httpConfig.ArchiveMissingPolicy))
+	switch tmp.httpConfig.ArchiveMissingPolicy {
+	case "":
+		tmp.httpConfig.ArchiveMissingPolicy = ArchiveMissingReject
+	case ArchiveMissingReject, ArchiveMissingSkip:
+	default:
+		return fmt.Errorf("archive_missing_policy must be %s or %s", ArchiveMissingReject, ArchiveMissingSkip)
+	}
+
+	tmp.httpConfig.HTMLCharset = strings.TrimSpace(tmp.httpConfig.HTMLCharset)
+	if tmp.httpConfig.HTMLCharset == "" {
+		tmp.httpConfig.HTMLCharset = "utf-8" // By default, the charset of the templates
+	}
+	if !charsetPattern.MatchString(tmp.httpConfig.HTMLCharset) {
+		return fmt.Errorf("html_charset %q is not valid", tmp.httpConfig.HTMLCharset)
+	}
+
+	for i, pattern := range tmp.httpConfig.HiddenPatterns {
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("hidden pattern %q is invalid", pattern)
+		}
+		tmp.httpConfig.HiddenPatterns[i] = pattern
+	}
+
 	if m["file_server_directory"] == nil || strings.TrimSpace(m["file_server_directory"].(string)) == "" {
 		return fmt.Errorf("file server directory is empty")
 	}
@@ -147,22 +851,82 @@ func (cm *ConfigurationManager) Load(configurationFile string) error {
 	cm.appConfig = tmp.appConfig
 
 	cm.appConfig.FilelogDestination = strings.TrimSpace(cm.appConfig.FilelogDestination)
+	cm.appConfig.AuditLogDestination = strings.TrimSpace(cm.appConfig.AuditLogDestination)
 
 	cm.httpConfig = tmp.httpConfig
 	cm.httpConfig.Address = strings.TrimSpace(cm.httpConfig.Address)
 	cm.httpConfig.FileServerDirectory = strings.TrimSpace(cm.httpConfig.FileServerDirectory)
+	cm.httpConfig.PostUploadCommand = strings.TrimSpace(cm.httpConfig.PostUploadCommand)
+	cm.httpConfig.UploadTempDirectory = strings.TrimSpace(cm.httpConfig.UploadTempDirectory)
+	cm.httpConfig.StaticDirectory = strings.TrimSpace(cm.httpConfig.StaticDirectory)
+	cm.httpConfig.FaviconFile = strings.TrimSpace(cm.httpConfig.FaviconFile)
+	cm.httpConfig.IndexTemplate = strings.TrimSpace(cm.httpConfig.IndexTemplate)
+	cm.httpConfig.TemplateDirectory = strings.TrimSpace(cm.httpConfig.TemplateDirectory)
+	cm.httpConfig.ServerHeader = strings.TrimSpace(cm.httpConfig.ServerHeader)
 
 	mlog.SetLevel(cm.appConfig.LogLevel)
+	mlog.SetCategoryLevel(logger.ACCESS, cm.appConfig.AccessLogLevel)
+
+	return nil
+}
+
+// checkDuration verifies that option key of m, if set, is a non negative
+// duration string such as "5s". Numbers are rejected because they would be
+// silently read as nanoseconds.
+func checkDuration(m map[string]interface{}, key string) error {
+	if m[key] == nil {
+		return nil
+	}
+
+	value, ok := m[key].(string)
+	if !ok {
+		return fmt.Errorf("%s must be a duration such as \"5s\"", key)
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%s is not valid: %s", key, err)
+	}
+	if d < 0 {
+		return fmt.Errorf("%s must not be negative", key)
+	}
 
 	return nil
 }
 
-// GetAppConfig returns configuration of the app
-func (cm ConfigurationManager) GetAppConfig() AppConfig {
+// parseMode parses an octal permission string such as "0640"
+func parseMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(strings.TrimSpace(mode), 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if value > 0777 {
+		return 0, fmt.Errorf("%s is out of range", mode)
+	}
+
+	return os.FileMode(value), nil
+}
+
+// GetAppConfig returns configuration of the app. It's safe to call while the
+// configuration is being reloaded.
+func (cm *ConfigurationManager) GetAppConfig() AppConfig {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
 	return cm.appConfig
 }
 
-// GetHTTPConfig returns configuration of the HTTP server
-func (cm ConfigurationManager) GetHTTPConfig() HTTPConfig {
+// GetHTTPConfig returns configuration of the HTTP server. It's safe to call
+// while the configuration is being reloaded.
+func (cm *ConfigurationManager) GetHTTPConfig() HTTPConfig {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
 	return cm.httpConfig
 }
+
+// normalizeExtension returns ext in lowercase and starting with a dot, so that
+// extensions can be configured with or without the dot
+func normalizeExtension(ext string) string {
+	return "." + strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+}
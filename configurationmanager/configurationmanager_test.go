@@ -0,0 +1,526 @@
+package configurationmanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileAndDirMode(t *testing.T) {
+	cm := New()
+	err := loadConfig(`file_mode = "0640"
+dir_mode = "0750"`, t)
+	if err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+
+	httpConfig := cm.GetHTTPConfig()
+	if httpConfig.FileMode != 0640 || httpConfig.DirMode != 0750 {
+		t.Fatalf("unexpected modes %o %o", httpConfig.FileMode, httpConfig.DirMode)
+	}
+}
+
+func TestDefaultFileAndDirMode(t *testing.T) {
+	cm := New()
+	if err := loadConfig("", t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+
+	httpConfig := cm.GetHTTPConfig()
+	if httpConfig.FileMode != 0 || httpConfig.DirMode != 0755 {
+		t.Fatalf("unexpected modes %o %o", httpConfig.FileMode, httpConfig.DirMode)
+	}
+}
+
+func TestInvalidMode(t *testing.T) {
+	for _, extra := range []string{`file_mode = "rw-r-----"`, `file_mode = "0999"`, `dir_mode = "07777"`} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Fatalf("expected %s to fail validation", extra)
+		}
+	}
+}
+
+func TestEncryptionKey(t *testing.T) {
+	os.Unsetenv(EncryptionKeyEnv)
+	if err := loadConfig("encryption = true", t); err == nil {
+		t.Fatal("expected encryption without key to be rejected")
+	}
+	if err := loadConfig(`encryption = true
+encryption_key = "0011"`, t); err == nil {
+		t.Fatal("expected short encryption key to be rejected")
+	}
+
+	key := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	os.Setenv(EncryptionKeyEnv, key)
+	defer os.Unsetenv(EncryptionKeyEnv)
+	if err := loadConfig("encryption = true", t); err != nil {
+		t.Fatalf("expected key from environment to be used: %v", err)
+	}
+	if len(New().GetHTTPConfig().EncryptionKey) != 32 {
+		t.Fatal("encryption key is not decoded")
+	}
+}
+
+func TestPerUserDirectoryRequiresAuth(t *testing.T) {
+	if err := loadConfig(`per_user_directory = true
+require_auth_for_download = false`, t); err == nil {
+		t.Fatal("expected anonymous downloads with per_user_directory to be rejected")
+	}
+	if err := loadConfig(`per_user_directory = true`, t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+	if err := loadConfig(`require_auth_for_download = false`, t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+}
+
+func TestDurationOption(t *testing.T) {
+	if err := loadConfig(`slow_request_threshold = "1m30s"`, t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+	if New().GetHTTPConfig().SlowRequestThreshold != 90*time.Second {
+		t.Fatalf("unexpected duration %s", New().GetHTTPConfig().SlowRequestThreshold)
+	}
+
+	for _, extra := range []string{"slow_request_threshold = 5", `slow_request_threshold = "5 seconds"`, `slow_request_threshold = "-1s"`} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Fatalf("expected %s to fail validation", extra)
+		}
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	tests := []struct {
+		extra    string
+		expected int
+	}{
+		{"", 1 << 20},
+		{"max_header_bytes = 8192", 8192},
+		{"max_header_bytes = -1", 1 << 20},
+	}
+	for _, test := range tests {
+		if err := loadConfig(test.extra, t); err != nil {
+			t.Fatalf("cannot load config: %v", err)
+		}
+		if v := New().GetHTTPConfig().MaxHeaderBytes; v != test.expected {
+			t.Fatalf("%q: expected %d, got %d", test.extra, test.expected, v)
+		}
+	}
+}
+
+func TestLogTimezone(t *testing.T) {
+	if err := loadConfig("", t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+	if tz := New().GetAppConfig().LogTimezone; tz != LogTimezoneLocal {
+		t.Fatalf("expected default timezone %s, got %s", LogTimezoneLocal, tz)
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	if err := loadConfig("", t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+	if output := New().GetAppConfig().LogOutput; output != LogOutputSyslog {
+		t.Fatalf("expected default log output %s, got %s", LogOutputSyslog, output)
+	}
+}
+
+// TestConcurrentLoad is meant to be run with the race detector
+func TestConcurrentLoad(t *testing.T) {
+	if err := loadConfig("max_file_size = 1", t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				httpConfig := New().GetHTTPConfig()
+				if httpConfig.MaxFileSize != 1 && httpConfig.MaxFileSize != 2 {
+					t.Errorf("torn read of max_file_size: %d", httpConfig.MaxFileSize)
+				}
+				New().GetAppConfig()
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := loadConfig(fmt.Sprintf("max_file_size = %d", i%2+1), t); err != nil {
+			t.Errorf("cannot load config: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# sample htpasswd file, all passwords are "secret"
+alice:$2a$04$gUICLGsnXHn/I6rYZDLV/OOGPscrA9D4DdyEFaqU8jtVE3ajzrRVC
+
+bob:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+`)
+	f.Close()
+
+	err = loadConfig(fmt.Sprintf(`htpasswd_file = %q
+
+[[http.basic_authen]]
+username = "bob"
+password = "e10adc3949ba59abbe56e057f20f883e"
+
+[[http.basic_authen]]
+username = "carol"
+password = "e10adc3949ba59abbe56e057f20f883e"`, f.Name()), t)
+	if err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+
+	expected := []BasicAuthen{
+		{Username: "alice", Password: "$2a$04$gUICLGsnXHn/I6rYZDLV/OOGPscrA9D4DdyEFaqU8jtVE3ajzrRVC"},
+		{Username: "bob", Password: "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"},
+		{Username: "carol", Password: "e10adc3949ba59abbe56e057f20f883e"},
+	}
+	if !reflect.DeepEqual(New().GetHTTPConfig().Authen, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, New().GetHTTPConfig().Authen)
+	}
+}
+
+func TestHtpasswdFileInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("alice\n")
+	f.Close()
+
+	if err := loadConfig(fmt.Sprintf("htpasswd_file = %q", f.Name()), t); err == nil {
+		t.Fatal("expected invalid htpasswd file to be rejected")
+	}
+	if err := loadConfig(`htpasswd_file = "/nonexistent/htpasswd"`, t); err == nil {
+		t.Fatal("expected missing htpasswd file to be rejected")
+	}
+}
+
+// loadConfig writes a minimal config file with extra options appended to the
+// [http] part and loads it into the singleton ConfigurationManager
+func loadConfig(extra string, t testing.TB) error {
+	content := fmt.Sprintf(`[app]
+log_level = 0
+
+[http]
+file_server_directory = "/tmp/fileserver-go"
+%s
+`, extra)
+
+	f, err := ioutil.TempFile("", "fileserver-go-*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(content)
+	f.Close()
+
+	return New().Load(f.Name())
+}
+
+func TestHiddenPatterns(t *testing.T) {
+	cm := New()
+	if err := loadConfig(`hidden_patterns = [" .* ", "*.bak"]`, t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+
+	patterns := cm.GetHTTPConfig().HiddenPatterns
+	if len(patterns) != 2 || patterns[0] != ".*" || patterns[1] != "*.bak" {
+		t.Fatalf("unexpected patterns %q", patterns)
+	}
+
+	for _, extra := range []string{`hidden_patterns = ["[a-"]`, `hidden_patterns = [""]`} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Fatalf("expected %s to fail validation", extra)
+		}
+	}
+}
+
+func TestHTMLCharset(t *testing.T) {
+	cm := New()
+	if err := loadConfig("", t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+	if charset := cm.GetHTTPConfig().HTMLCharset; charset != "utf-8" {
+		t.Fatalf("expected default charset utf-8, got %q", charset)
+	}
+
+	for _, extra := range []string{`html_charset = "utf 8"`, `html_charset = "utf-8; x=y"`} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Fatalf("expected %s to fail validation", extra)
+		}
+	}
+}
+
+func TestRequireClientCertInvalid(t *testing.T) {
+	for _, extra := range []string{
+		"ssl = true\nrequire_client_cert = true",
+		"ssl = true\nrequire_client_cert = true\nca_file = \"/nonexistent.pem\"",
+		"ssl = true\nrequire_client_cert = true\nca_file = \"/dev/null\"",
+	} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Fatalf("expected %q to fail validation", extra)
+		}
+	}
+
+	// Client certificates are only used with TLS
+	if err := loadConfig("require_client_cert = true", t); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+}
+
+func TestExtensionMaxFileSize(t *testing.T) {
+	err := loadConfig(`[http.extension_max_file_size]
+".JPG" = "5MB"
+"mp4" = "2 GB"`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := New().GetHTTPConfig().ExtensionMaxFileSize
+	if sizes[".jpg"] != 5*1024*1024 || sizes[".mp4"] != 2*1024*1024*1024 || len(sizes) != 2 {
+		t.Errorf("unexpected sizes %v", sizes)
+	}
+
+	for _, size := range []string{"", "big", "-1MB", "0"} {
+		if err := loadConfig(fmt.Sprintf("[http.extension_max_file_size]\n\".jpg\" = %q", size), t); err == nil {
+			t.Errorf("expected error for size %q", size)
+		}
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	err := loadConfig(`[http.content_types]
+"WASM" = " application/wasm "`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types := New().GetHTTPConfig().ContentTypes; !reflect.DeepEqual(types, map[string]string{".wasm": "application/wasm"}) {
+		t.Errorf("unexpected content types %v", types)
+	}
+
+	if err := loadConfig("[http.content_types]\n\".wasm\" = \"not a type\"", t); err == nil {
+		t.Error("expected error for an invalid content type")
+	}
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	for extra, expected := range map[string]int{
+		"":                           32 * 1024,
+		"copy_buffer_size = 1048576": 1024 * 1024,
+		"copy_buffer_size = 0":       32 * 1024,
+	} {
+		if err := loadConfig(extra, t); err != nil {
+			t.Fatal(err)
+		}
+		if size := New().GetHTTPConfig().CopyBufferSize; size != expected {
+			t.Errorf("%q: expected %d, got %d", extra, expected, size)
+		}
+	}
+}
+
+func TestOCSPStapleFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "ocsp-*.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a response")
+	f.Close()
+
+	for _, extra := range []string{fmt.Sprintf("ssl = true\nocsp_staple_file = %q", f.Name()), "ssl = true\nocsp_staple_file = \"/nonexistent/ocsp.der\""} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Errorf("expected %q to be rejected", extra)
+		}
+	}
+
+	// The file is only read for HTTPS
+	if err := loadConfig(fmt.Sprintf("ocsp_staple_file = %q", f.Name()), t); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	err := loadConfig(`[http.custom_headers]
+"x-frame-options" = " DENY "`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers := New().GetHTTPConfig().CustomHeaders; !reflect.DeepEqual(headers, map[string]string{"X-Frame-Options": "DENY"}) {
+		t.Errorf("unexpected headers %v", headers)
+	}
+
+	for _, header := range []string{`"bad name" = "x"`, `"" = "x"`, `"X-Test" = "a\nb"`} {
+		if err := loadConfig("[http.custom_headers]\n"+header, t); err == nil {
+			t.Errorf("expected %s to be rejected", header)
+		}
+	}
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	err := loadConfig(`download_rate_limit = "1MB"
+[http.download_rate_limits]
+Shared = "512KB"
+archive = "0"`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpConfig := New().GetHTTPConfig()
+	if httpConfig.DownloadRateLimit != 1<<20 {
+		t.Errorf("unexpected rate limit %d", httpConfig.DownloadRateLimit)
+	}
+	if limits := httpConfig.DownloadRateLimits; !reflect.DeepEqual(limits, map[string]int64{RouteShared: 512 << 10, RouteArchive: 0}) {
+		t.Errorf("unexpected rate limits %v", limits)
+	}
+
+	for _, extra := range []string{`download_rate_limit = "fast"`, `download_rate_limit = "-1"`, "[http.download_rate_limits]\nupload = \"1MB\"", "[http.download_rate_limits]\nshared = \"1XB\""} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Errorf("expected %s to be rejected", extra)
+		}
+	}
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	if err := loadConfig("", t); err != nil {
+		t.Fatal(err)
+	}
+	if n := New().GetHTTPConfig().MinFreeSpace; n != 0 {
+		t.Errorf("unexpected default %d", n)
+	}
+
+	if err := loadConfig(`min_free_space = "1GB"`, t); err != nil {
+		t.Fatal(err)
+	}
+	if n := New().GetHTTPConfig().MinFreeSpace; n != 1<<30 {
+		t.Errorf("unexpected free space %d", n)
+	}
+
+	for _, extra := range []string{`min_free_space = "lots"`, `min_free_space = "-1GB"`} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Errorf("expected %s to be rejected", extra)
+		}
+	}
+}
+
+func TestUploadFieldName(t *testing.T) {
+	if err := loadConfig("", t); err != nil {
+		t.Fatal(err)
+	}
+	httpConfig := New().GetHTTPConfig()
+	if httpConfig.UploadFieldName != "file" || httpConfig.AnyUploadField {
+		t.Errorf("unexpected defaults %q and %v", httpConfig.UploadFieldName, httpConfig.AnyUploadField)
+	}
+
+	if err := loadConfig(`upload_field_name = " attachment "`, t); err != nil {
+		t.Fatal(err)
+	}
+	if name := New().GetHTTPConfig().UploadFieldName; name != "attachment" {
+		t.Errorf("unexpected field name %q", name)
+	}
+}
+
+func TestUsageCacheDuration(t *testing.T) {
+	for extra, expected := range map[string]time.Duration{"": 10 * time.Second, `usage_cache_duration = "1m"`: time.Minute, `usage_cache_duration = "0s"`: 0} {
+		if err := loadConfig(extra, t); err != nil {
+			t.Fatal(err)
+		}
+		if d := New().GetHTTPConfig().UsageCacheDuration; d != expected {
+			t.Errorf("%s: expected %v, got %v", extra, expected, d)
+		}
+	}
+
+	if err := loadConfig(`usage_cache_duration = "-1s"`, t); err == nil {
+		t.Error("expected a negative usage_cache_duration to be rejected")
+	}
+}
+
+func TestRejectConcurrentUploads(t *testing.T) {
+	for extra, expected := range map[string]bool{"": false, "reject_concurrent_uploads = true": true} {
+		if err := loadConfig(extra, t); err != nil {
+			t.Fatal(err)
+		}
+		if reject := New().GetHTTPConfig().RejectConcurrentUploads; reject != expected {
+			t.Errorf("%q: expected %v, got %v", extra, expected, reject)
+		}
+	}
+}
+
+func TestPostUploadRetries(t *testing.T) {
+	if err := loadConfig("", t); err != nil {
+		t.Fatal(err)
+	}
+	httpConfig := New().GetHTTPConfig()
+	if httpConfig.PostUploadRetries != 0 || httpConfig.PostUploadRetryBackoff != time.Second || httpConfig.PostUploadRetryMaxDuration != 10*time.Minute {
+		t.Errorf("unexpected defaults %d, %v and %v", httpConfig.PostUploadRetries, httpConfig.PostUploadRetryBackoff, httpConfig.PostUploadRetryMaxDuration)
+	}
+
+	err := loadConfig(`post_upload_retries = 3
+post_upload_retry_backoff = "500ms"
+post_upload_retry_max_duration = "0s"`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpConfig = New().GetHTTPConfig()
+	if httpConfig.PostUploadRetries != 3 || httpConfig.PostUploadRetryBackoff != 500*time.Millisecond || httpConfig.PostUploadRetryMaxDuration != 0 {
+		t.Errorf("unexpected retries %d, %v and %v", httpConfig.PostUploadRetries, httpConfig.PostUploadRetryBackoff, httpConfig.PostUploadRetryMaxDuration)
+	}
+
+	for _, extra := range []string{`post_upload_retry_backoff = "-1s"`, `post_upload_retry_max_duration = "forever"`} {
+		if err := loadConfig(extra, t); err == nil {
+			t.Errorf("expected %s to be rejected", extra)
+		}
+	}
+}
+
+func TestFilenameCase(t *testing.T) {
+	for extra, expected := range map[string]string{"": FilenameCasePreserve, `filename_case = " Lower "`: FilenameCaseLower, `filename_case = "ascii"`: FilenameCaseASCII} {
+		if err := loadConfig(extra, t); err != nil {
+			t.Fatal(err)
+		}
+		if filenameCase := New().GetHTTPConfig().FilenameCase; filenameCase != expected {
+			t.Errorf("%s: expected %s, got %s", extra, expected, filenameCase)
+		}
+	}
+
+	if err := loadConfig(`filename_case = "upper"`, t); err == nil {
+		t.Error("expected filename_case upper to be rejected")
+	}
+}
+
+func TestETagStrategy(t *testing.T) {
+	for extra, expected := range map[string]string{"": ETagModTime, `etag_strategy = " Content "`: ETagContent} {
+		if err := loadConfig(extra, t); err != nil {
+			t.Fatal(err)
+		}
+		if strategy := New().GetHTTPConfig().ETagStrategy; strategy != expected {
+			t.Errorf("%s: expected %s, got %s", extra, expected, strategy)
+		}
+	}
+
+	if err := loadConfig(`etag_strategy = "hash"`, t); err == nil {
+		t.Error("expected etag_strategy hash to be rejected")
+	}
+}
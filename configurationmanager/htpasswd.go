@@ -0,0 +1,59 @@
+package configurationmanager
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readHtpasswd parses an Apache style htpasswd file made of "username:hash"
+// lines. Blank lines and lines starting with # are ignored.
+func readHtpasswd(path string) ([]BasicAuthen, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]BasicAuthen, 0)
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("line %d is not a valid htpasswd entry", lineNumber)
+		}
+
+		entries = append(entries, BasicAuthen{
+			Username: fields[0],
+			Password: fields[1],
+		})
+	}
+
+	return entries, scanner.Err()
+}
+
+// mergeAuthen returns primary followed by the entries of secondary whose
+// username is not in primary
+func mergeAuthen(primary []BasicAuthen, secondary []BasicAuthen) []BasicAuthen {
+	usernames := make(map[string]bool)
+	for _, v := range primary {
+		usernames[v.Username] = true
+	}
+
+	merged := append(make([]BasicAuthen, 0, len(primary)+len(secondary)), primary...)
+	for _, v := range secondary {
+		if !usernames[v.Username] {
+			merged = append(merged, v)
+		}
+	}
+
+	return merged
+}
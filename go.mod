@@ -1,10 +1,13 @@
 module github.com/anhdowastaken/fileserver-go
 
-go 1.12
+go 1.16
 
 require (
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/mux v1.7.2
 	github.com/spf13/viper v1.4.0
+	golang.org/x/crypto v0.0.0-20190605123033-f99c8df09eb5
+	golang.org/x/net v0.0.0-20190522155817-f3200d17e092
+	golang.org/x/text v0.3.0
 	gopkg.in/yaml.v2 v2.2.2
 )
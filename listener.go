@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/net/netutil"
+)
+
+// listenFDEnv is the environment variable holding the descriptor of a
+// listening socket inherited from the parent process
+const listenFDEnv = "FILESERVER_LISTEN_FD"
+
+// listen returns the listener the server accepts connections on. The socket
+// inherited from the parent process is used if there is one, otherwise a new
+// socket is bound to address.
+func listen(address string) (net.Listener, error) {
+	v := os.Getenv(listenFDEnv)
+	if v == "" {
+		return net.Listen("tcp", address)
+	}
+	// Processes started by this one must not take it for their own
+	os.Unsetenv(listenFDEnv)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("%s is not a valid file descriptor: %s", listenFDEnv, v)
+	}
+
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+
+	// FileListener duplicates the descriptor, so f can be closed
+	return net.FileListener(f)
+}
+
+// handoff starts a new instance of the server with the same arguments and
+// passes it the listening socket of l. Both instances accept connections on it
+// until this one stops, so no connection is refused in between.
+//
+// The socket is passed as descriptor 3, the first one after stdin, stdout and
+// stderr, and its number is set in FILESERVER_LISTEN_FD.
+func handoff(l net.Listener) (*os.Process, error) {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("listener is not a TCP listener")
+	}
+
+	f, err := tl.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", listenFDEnv, 3))
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
+
+// limitListener limits the number of connections accepted simultaneously by l
+// to n, or doesn't limit them if n is 0. Further connections aren't refused but
+// wait in the backlog of the socket until a connection is closed.
+func limitListener(l net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return l
+	}
+
+	return netutil.LimitListener(l, n)
+}
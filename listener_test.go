@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListenInherited(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+
+	f, err := parent.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	os.Setenv(listenFDEnv, strconv.Itoa(int(f.Fd())))
+	defer os.Unsetenv(listenFDEnv)
+
+	// The address is ignored when a socket is inherited
+	l, err := listen("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if os.Getenv(listenFDEnv) != "" {
+		t.Fatalf("expected %s to be unset", listenFDEnv)
+	}
+	if l.Addr().String() != parent.Addr().String() {
+		t.Fatalf("expected address %s, got %s", parent.Addr(), l.Addr())
+	}
+
+	// The parent stops accepting, the inherited socket keeps serving
+	parent.Close()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Fatalf("unexpected response %q", body)
+	}
+}
+
+func TestListenInvalidFD(t *testing.T) {
+	os.Setenv(listenFDEnv, "stdin")
+	defer os.Unsetenv(listenFDEnv)
+
+	if _, err := listen("127.0.0.1:0"); err == nil {
+		t.Fatalf("expected invalid %s to fail", listenFDEnv)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := limitListener(raw, 1)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", raw.Addr().String())
+		if err != nil {
+			t.Fatalf("expected connection %d to be queued, got %v", i, err)
+		}
+		defer c.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatalf("expected second connection to wait for the first one")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("expected second connection to be accepted once the first one is closed")
+	}
+}
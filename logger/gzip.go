@@ -0,0 +1,48 @@
+package logger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// GzipWriter compresses what is written to an underlying writer. Each write
+// is compressed as a separate gzip member, which tools such as gunzip and zcat
+// read as a single stream. So the output is valid after every write and can be
+// split between writes, e.g. by log rotation, at the cost of a lower ratio.
+// The output can only be appended to and read from the beginning.
+type GzipWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+	gz  *gzip.Writer
+}
+
+// NewGzipWriter returns a GzipWriter writing to w
+func NewGzipWriter(w io.Writer) *GzipWriter {
+	gw := &GzipWriter{w: w}
+	gw.gz = gzip.NewWriter(&gw.buf)
+	return gw
+}
+
+// Write compresses p and writes it to the underlying writer in a single write
+func (gw *GzipWriter) Write(p []byte) (int, error) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	gw.buf.Reset()
+	gw.gz.Reset(&gw.buf)
+	_, err := gw.gz.Write(p)
+	if err == nil {
+		err = gw.gz.Close()
+	}
+	if err == nil {
+		_, err = gw.w.Write(gw.buf.Bytes())
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,33 @@
+package logger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestGzipWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := log.New(NewGzipWriter(buf), "INFO    : ", 0)
+
+	expected := ""
+	for _, line := range []string{"first line", "second line", "third line"} {
+		l.Println(line)
+		expected += "INFO    : " + line + "\n"
+
+		// The output is complete after each write
+		r, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("cannot decompress: %v", err)
+		}
+		if string(content) != expected {
+			t.Fatalf("expected %q, got %q", expected, content)
+		}
+	}
+}
@@ -33,16 +33,24 @@ var LOGLEVEL = map[int]string{
 	DISABLE:  "DISABLE",
 }
 
-// Logging contains 5 loggers with configureable log level, prefix and stream
+// ACCESS is the category of the log of HTTP requests
+const ACCESS = "access"
+
+// Logging contains 5 loggers with configureable log level, prefix and stream.
+// Categories of log, such as ACCESS, have their own Logging with its own level
+// and the prefix and stream of the main one.
 type Logging struct {
-	Fatal    *log.Logger
-	Critical *log.Logger
-	Warning  *log.Logger
-	Info     *log.Logger
-	Debug    *log.Logger
-	level    int
-	stream   io.Writer
-	prefix   string
+	Fatal      *log.Logger
+	Critical   *log.Logger
+	Warning    *log.Logger
+	Info       *log.Logger
+	Debug      *log.Logger
+	level      int
+	stream     io.Writer
+	prefix     string
+	utc        bool
+	mu         sync.Mutex
+	categories map[string]*Logging
 }
 
 var instance *Logging
@@ -51,42 +59,94 @@ var once sync.Once
 // New initializes singleton logger
 func New() *Logging {
 	once.Do(func() {
-		instance = &Logging{}
-		instance.level = INFO
-		instance.prefix = ""
-		instance.stream = os.Stderr
-
-		instance.Fatal = log.New(
-			instance.stream,
-			"FATAL   : ",
-			log.Ldate|log.Lmicroseconds)
-		instance.Critical = log.New(
-			instance.stream,
-			"CRITICAL: ",
-			log.Ldate|log.Lmicroseconds|log.Lshortfile)
-		instance.Warning = log.New(
-			instance.stream,
-			"WARNING : ",
-			log.Ldate|log.Lmicroseconds)
-		instance.Info = log.New(
-			instance.stream,
-			"INFO    : ",
-			log.Ldate|log.Lmicroseconds)
-		instance.Debug = log.New(
-			instance.stream,
-			"DEBUG   : ",
-			log.Ldate|log.Lmicroseconds|log.Lshortfile)
-
+		instance = newLogging()
 		instance.SetStreamSingle(os.Stderr)
 	})
 
 	return instance
 }
 
-// SetLevel configures minimal log level will be displayed
+// newLogging creates a Logging writing INFO and above to stderr
+func newLogging() *Logging {
+	l := &Logging{}
+	l.level = INFO
+	l.prefix = ""
+	l.stream = os.Stderr
+	l.categories = make(map[string]*Logging)
+
+	l.Fatal = log.New(
+		l.stream,
+		"FATAL   : ",
+		log.Ldate|log.Lmicroseconds)
+	l.Critical = log.New(
+		l.stream,
+		"CRITICAL: ",
+		log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	l.Warning = log.New(
+		l.stream,
+		"WARNING : ",
+		log.Ldate|log.Lmicroseconds)
+	l.Info = log.New(
+		l.stream,
+		"INFO    : ",
+		log.Ldate|log.Lmicroseconds)
+	l.Debug = log.New(
+		l.stream,
+		"DEBUG   : ",
+		log.Ldate|log.Lmicroseconds|log.Lshortfile)
+
+	return l
+}
+
+// Category returns the Logging of category name, e.g. ACCESS. A new category
+// has the level, prefix, stream and timezone of l.
+func (l *Logging) Category(name string) *Logging {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.categories[name]
+	if !ok {
+		c = newLogging()
+		if l.prefix != "" {
+			c.SetPrefix(l.prefix)
+		}
+		c.SetUTC(l.utc)
+		c.stream = l.stream
+		c.SetLevel(l.level)
+		l.categories[name] = c
+	}
+
+	return c
+}
+
+// SetCategoryLevel configures minimal log level will be displayed for category
+// name only
+func (l *Logging) SetCategoryLevel(name string, level int) {
+	l.Category(name).SetLevel(level)
+}
+
+// each calls f for l then for each of its categories
+func (l *Logging) each(f func(*Logging)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f(l)
+	for _, c := range l.categories {
+		f(c)
+	}
+}
+
+// SetLevel configures minimal log level will be displayed, for all categories
 func (l *Logging) SetLevel(level int) {
-	l.level = level
-	switch level {
+	l.each(func(c *Logging) {
+		c.level = level
+		c.apply()
+	})
+}
+
+// apply sets the output of each logger according to level and stream
+func (l *Logging) apply() {
+	switch l.level {
 	case FATAL:
 		l.Fatal.SetOutput(l.stream)
 		l.Critical.SetOutput(ioutil.Discard)
@@ -131,24 +191,42 @@ func (l *Logging) SetLevel(level int) {
 	}
 }
 
-// SetPrefix configures prefix of each line of log
+// SetPrefix configures prefix of each line of log, for all categories
 func (l *Logging) SetPrefix(pfix string) {
-	l.prefix = pfix
-	l.Fatal.SetPrefix(pfix + " " + l.Fatal.Prefix())
-	l.Critical.SetPrefix(pfix + " " + l.Critical.Prefix())
-	l.Warning.SetPrefix(pfix + " " + l.Warning.Prefix())
-	l.Info.SetPrefix(pfix + " " + l.Info.Prefix())
-	l.Debug.SetPrefix(pfix + " " + l.Debug.Prefix())
+	l.each(func(c *Logging) {
+		c.prefix = pfix
+		c.Fatal.SetPrefix(pfix + " " + c.Fatal.Prefix())
+		c.Critical.SetPrefix(pfix + " " + c.Critical.Prefix())
+		c.Warning.SetPrefix(pfix + " " + c.Warning.Prefix())
+		c.Info.SetPrefix(pfix + " " + c.Info.Prefix())
+		c.Debug.SetPrefix(pfix + " " + c.Debug.Prefix())
+	})
 }
 
-// SetStreamSingle configure to log to only one stream
+// SetStreamSingle configure to log to only one stream, for all categories
 func (l *Logging) SetStreamSingle(stream io.Writer) {
-	l.stream = stream
-	l.SetLevel(l.level)
+	l.each(func(c *Logging) {
+		c.stream = stream
+		c.apply()
+	})
 }
 
-// SetStreamMulti configures to log to multiple streams
+// SetStreamMulti configures to log to multiple streams, for all categories
 func (l *Logging) SetStreamMulti(streams []io.Writer) {
-	l.stream = io.MultiWriter(streams...)
-	l.SetLevel(l.level)
+	l.SetStreamSingle(io.MultiWriter(streams...))
+}
+
+// SetUTC configures whether timestamps are in UTC instead of local time, for
+// all categories
+func (l *Logging) SetUTC(utc bool) {
+	l.each(func(c *Logging) {
+		c.utc = utc
+		for _, lg := range []*log.Logger{c.Fatal, c.Critical, c.Warning, c.Info, c.Debug} {
+			if utc {
+				lg.SetFlags(lg.Flags() | log.LUTC)
+			} else {
+				lg.SetFlags(lg.Flags() &^ log.LUTC)
+			}
+		}
+	})
 }
@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCategoryLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := newLogging()
+	l.SetPrefix("TEST")
+	l.SetStreamSingle(buf)
+	l.SetLevel(WARNING)
+	l.SetCategoryLevel(ACCESS, INFO)
+
+	access := l.Category(ACCESS)
+	if access != l.Category(ACCESS) {
+		t.Fatalf("expected the same logger for a category")
+	}
+
+	l.Info.Printf("application info")
+	l.Warning.Printf("application warning")
+	access.Info.Printf("access info")
+	access.Debug.Printf("access debug")
+
+	output := buf.String()
+	for _, s := range []string{"TEST WARNING : ", "application warning", "TEST INFO    : ", "access info"} {
+		if !strings.Contains(output, s) {
+			t.Fatalf("expected %q in %q", s, output)
+		}
+	}
+	for _, s := range []string{"application info", "access debug"} {
+		if strings.Contains(output, s) {
+			t.Fatalf("unexpected %q in %q", s, output)
+		}
+	}
+
+	// The single level applies to all categories
+	buf.Reset()
+	l.SetLevel(DISABLE)
+	l.Fatal.Printf("application fatal")
+	access.Fatal.Printf("access fatal")
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing logged, got %q", buf.String())
+	}
+
+	// Streams are shared, levels are kept
+	l.SetCategoryLevel(ACCESS, INFO)
+	other := &bytes.Buffer{}
+	l.SetStreamSingle(other)
+	access.Info.Printf("access info")
+	l.Warning.Printf("application warning")
+	if other.String() == "" || !strings.Contains(other.String(), "access info") || strings.Contains(other.String(), "application") {
+		t.Fatalf("unexpected output %q", other.String())
+	}
+}
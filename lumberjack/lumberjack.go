@@ -95,6 +95,14 @@ var (
 	megabyte = 1024 * 1024
 )
 
+// writers holds the buffered writers of Write, reset on return, so that
+// writing a line doesn't allocate one
+var writers = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewWriter(nil)
+	},
+}
+
 // Write implements io.Writer. If a write would cause the log file to be larger
 // than MaxSize, the file is closed, renamed to include a timestamp of the
 // current time, and a new log file is created using the original log file name.
@@ -120,11 +128,19 @@ func (l *Logger) Write(p []byte) (n int, err error) {
 		}
 	}
 
-	w := bufio.NewWriter(l.file)
+	// Buffers are taken from a pool rather than allocated for each write, and
+	// flushed straight away so that lines reach the file in order
+	w := writers.Get().(*bufio.Writer)
+	w.Reset(l.file)
 	n, err = w.Write(p)
+	if err == nil {
+		err = w.Flush()
+	}
+	n -= w.Buffered()
 	l.size += int64(n)
-
-	w.Flush()
+	// Reset drops what wasn't written and the reference to the file
+	w.Reset(nil)
+	writers.Put(w)
 
 	return n, err
 }
@@ -219,7 +235,7 @@ func (l *Logger) openNew() error {
 // between the filename and the extension, using the local time if requested
 // (otherwise UTC). If existing file will exceed size limit after writing, we'll
 // choose new filename with an index.
-func (l Logger) processName(write_length int) string {
+func (l *Logger) processName(write_length int) string {
 	dir := filepath.Dir(l.get_filename())
 	filename := filepath.Base(l.get_filename())
 	ext := filepath.Ext(filename)
@@ -282,6 +298,15 @@ func (l Logger) processName(write_length int) string {
 func (l *Logger) openExistingOrNew(writeLen int) error {
 	name := l.processName(writeLen)
 	info, err := os_Stat(name)
+	// Keep writing to the file already open, instead of opening it again for
+	// every write
+	if err == nil && l.file != nil && l.file.Name() == name && info.Size()+int64(writeLen) < l.get_max_size() {
+		return nil
+	}
+	if err := l.close(); err != nil {
+		return err
+	}
+
 	if os.IsNotExist(err) {
 		return l.openNew()
 	}
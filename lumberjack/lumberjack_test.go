@@ -377,3 +377,20 @@ func exists(path string, t testing.TB) {
 	_, err := os.Stat(path)
 	assertUp(err == nil, t, 1, "expected file to exist, but got error from os.Stat: %v", err)
 }
+
+func BenchmarkWrite(b *testing.B) {
+	currentTime = fakeTime
+	dir := makeTempDir("BenchmarkWrite", b)
+	defer os.RemoveAll(dir)
+
+	l := &Logger{Filename: logFile(dir)}
+	defer l.Close()
+	line := []byte("2009/11/17 20:34:58 [INFO] user uploaded foo.txt (1024 bytes)\n")
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := l.Write(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	// "fmt"
+	"context"
+	"crypto/tls"
 	"strings"
 	// "path"
 	// "net/url"
 	// "sync"
 	"flag"
 	"io"
+	"io/ioutil"
 	"log/syslog"
 	"net/http"
 	"os"
@@ -16,8 +19,11 @@ import (
 	"syscall"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/anhdowastaken/fileserver-go/api"
+	"github.com/anhdowastaken/fileserver-go/audit"
 	"github.com/anhdowastaken/fileserver-go/configurationmanager"
 	"github.com/anhdowastaken/fileserver-go/logger"
 	"github.com/anhdowastaken/fileserver-go/lumberjack"
@@ -26,20 +32,27 @@ import (
 const instanceName = "FILESERVER-GO"
 const defaultConfigFile = "fileserver-go.conf"
 
+// Build metadata, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 func main() {
 	mlog := logger.New()
 
 	confPath := flag.String("c", "", "Config file of an instance")
+	verify := flag.Bool("verify", false, "Verify checksums of stored files against their sidecars then exit")
 	flag.Parse()
 
 	// When start an instance, output log will be streamed to KERNEL LOG
 	// Severity of log when streamed to syslog will be INFO
-	logwriter, _ := syslog.New(syslog.LOG_INFO, "")
-
-	mlog.SetStreamSingle(logwriter)
+	logwriter := setSyslogStream(mlog)
 
 	mlog.SetPrefix(strings.ToUpper(instanceName))
-	mlog.Info.Printf("Start %s", strings.ToUpper(instanceName))
+	mlog.Info.Printf("Start %s %s (commit %s, built %s)", strings.ToUpper(instanceName), version, commit, buildDate)
 
 	if *confPath == "" {
 		mlog.Critical.Printf("Can not found config path in command line. Use default path instead: %s\n", defaultConfigFile)
@@ -64,30 +77,59 @@ func main() {
 	}
 
 	// Configure streams for logger
-	loggerStreams := make([]io.Writer, 0)
+	logwriter = logOutputStream(mlog, appConfig, logwriter)
+	var fileStream io.Writer
 	lumberjackLog := &lumberjack.Logger{}
 	if appConfig.FilelogDestination != "" {
 		mlog.Info.Printf("Set log to %s", appConfig.FilelogDestination)
-		lumberjackLog = &lumberjack.Logger{
-			Filename:     appConfig.FilelogDestination,
-			RotationTime: int(appConfig.LogRotationTime),
-			MaxSize:      int(appConfig.MaxLogSize),
-			LocalTime:    true,
-		}
-		loggerStreams = append(loggerStreams, lumberjackLog)
-	}
-
-	if len(loggerStreams) > 0 {
-		mlog.SetStreamMulti(loggerStreams)
+		lumberjackLog = newFileLogger(appConfig.FilelogDestination, appConfig)
+		fileStream = fileLogStream(lumberjackLog, appConfig)
 	}
+	setLogStreams(mlog, logwriter, fileStream)
 
 	if appConfig.LogEnable == false {
 		mlog.SetLevel(logger.DISABLE)
 	}
+	mlog.SetUTC(appConfig.LogTimezone == configurationmanager.LogTimezoneUTC)
+
+	// Configure stream for audit log
+	auditLog := &lumberjack.Logger{}
+	if appConfig.AuditLogDestination != "" {
+		mlog.Info.Printf("Set audit log to %s", appConfig.AuditLogDestination)
+		auditLog = newFileLogger(appConfig.AuditLogDestination, appConfig)
+		audit.New().SetStream(auditLog)
+	}
 
 	// Print config info
 	mlog.Info.Printf("Log level: %s\n", logger.LOGLEVEL[appConfig.LogLevel])
 
+	if *verify {
+		httpConfig := cm.GetHTTPConfig()
+
+		// Stop verifying as soon as the user asks to
+		ctx, cancel := context.WithCancel(context.Background())
+		verifySigs := make(chan os.Signal, 1)
+		signal.Notify(verifySigs, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-verifySigs
+			mlog.Info.Printf("Verification is cancelled")
+			cancel()
+		}()
+
+		mlog.Info.Printf("Verify checksums of files in %s", httpConfig.FileServerDirectory)
+		summary, err := api.VerifyChecksums(ctx, httpConfig.FileServerDirectory)
+		mlog.Info.Printf("Verification summary: %d OK, %d corrupt, %d missing checksum",
+			summary.OK, summary.Corrupt, summary.MissingChecksum)
+		if err != nil {
+			mlog.Critical.Printf("Verification failed: %+v", err)
+			os.Exit(1)
+		}
+		if summary.Corrupt > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGHUP)
 	go func() {
@@ -116,14 +158,13 @@ func main() {
 					mlog.Info.Printf("Reload config file %s successfully\n", *confPath)
 				}
 
-				// Re-configure output log to KERNEL LOG
-				// Severity of log when streamed to syslog will be INFO
-				logwriter, _ := syslog.New(syslog.LOG_INFO, "")
-				mlog.SetStreamSingle(logwriter)
-
 				appConfig := cm.GetAppConfig()
+				// Re-configure the primary stream of logs, connecting to
+				// syslog again if it's used
+				logwriter := logOutputStream(mlog, appConfig, nil)
+
 				// Configure streams for logger
-				loggerStreams := make([]io.Writer, 0)
+				var fileStream io.Writer
 				if appConfig.FilelogDestination != "" {
 					_, err := os.OpenFile(appConfig.FilelogDestination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 					if err != nil {
@@ -131,23 +172,26 @@ func main() {
 					} else {
 						mlog.Info.Printf("Set log to %s", appConfig.FilelogDestination)
 						lumberjackLog.Close()
-						lumberjackLog = &lumberjack.Logger{
-							Filename:     appConfig.FilelogDestination,
-							RotationTime: int(appConfig.LogRotationTime),
-							MaxSize:      int(appConfig.MaxLogSize),
-							LocalTime:    true,
-						}
-						loggerStreams = append(loggerStreams, lumberjackLog)
+						lumberjackLog = newFileLogger(appConfig.FilelogDestination, appConfig)
+						fileStream = fileLogStream(lumberjackLog, appConfig)
 					}
 				}
-
-				if len(loggerStreams) > 0 {
-					mlog.SetStreamMulti(loggerStreams)
-				}
+				setLogStreams(mlog, logwriter, fileStream)
 
 				if appConfig.LogEnable == false {
 					mlog.SetLevel(logger.DISABLE)
 				}
+				mlog.SetUTC(appConfig.LogTimezone == configurationmanager.LogTimezoneUTC)
+
+				// Re-configure stream for audit log
+				auditLog.Close()
+				if appConfig.AuditLogDestination != "" {
+					mlog.Info.Printf("Set audit log to %s", appConfig.AuditLogDestination)
+					auditLog = newFileLogger(appConfig.AuditLogDestination, appConfig)
+					audit.New().SetStream(auditLog)
+				} else {
+					audit.New().SetStream(ioutil.Discard)
+				}
 
 				// Print config info
 				mlog.Info.Printf("Log level: %s\n", logger.LOGLEVEL[appConfig.LogLevel])
@@ -158,27 +202,317 @@ func main() {
 	// Create goroutine to serve HTTP REST API
 	httpConfig := cm.GetHTTPConfig()
 
-	router := mux.NewRouter()
-	router.HandleFunc("/", api.IndexHandler).Methods("GET")
-	router.HandleFunc("/upload", api.UploadHandler).Methods("POST")
-	fileServer := api.NoDirListing(http.FileServer(http.Dir(httpConfig.FileServerDirectory)))
-	router.PathPrefix("/download/").Handler(http.StripPrefix("/download/", fileServer)).Methods("GET")
-	router.Use(api.ValidateMiddleware)
+	err = os.MkdirAll(httpConfig.FileServerDirectory, httpConfig.DirMode)
+	if err != nil {
+		mlog.Critical.Printf("Cannot make file server directory %s: %s", httpConfig.FileServerDirectory, err)
+		os.Exit(1)
+	}
+
+	router := newRouter(httpConfig)
+
+	tlsConfig, err := serverTLSConfig(httpConfig)
+	if err != nil {
+		mlog.Critical.Printf("Cannot configure TLS: %+v", err)
+		os.Exit(1)
+	}
 
 	address := httpConfig.Address
 	srv := &http.Server{
-		Handler:  api.LoggingMiddleware(router),
-		Addr:     address,
-		ErrorLog: mlog.Debug,
+		Handler:        serverHandler(router, httpConfig),
+		Addr:           address,
+		ErrorLog:       mlog.Debug,
+		MaxHeaderBytes: httpConfig.MaxHeaderBytes,
+		TLSConfig:      tlsConfig,
+	}
+
+	logSummary(mlog, cm.GetAppConfig(), httpConfig)
+
+	listener, err := listen(address)
+	if err != nil {
+		mlog.Critical.Printf("Cannot listen on %s: %+v", address, err)
+		os.Exit(1)
 	}
 
+	// On SIGUSR1, hand the listening socket over to a new instance, then stop
+	// accepting connections and wait for the current ones to finish
+	stopped := make(chan struct{})
+	handoffSigs := make(chan os.Signal, 1)
+	signal.Notify(handoffSigs, syscall.SIGUSR1)
+	go func() {
+		for range handoffSigs {
+			mlog.Info.Printf("Received SIGUSR1!")
+			p, err := handoff(listener)
+			if err != nil {
+				mlog.Critical.Printf("Cannot hand listener over to a new instance: %+v", err)
+				continue
+			}
+
+			mlog.Info.Printf("Hand listener over to process %d", p.Pid)
+			srv.Shutdown(context.Background())
+			close(stopped)
+			return
+		}
+	}()
+
+	// On SIGUSR2, switch draining mode on or off
+	drainSigs := make(chan os.Signal, 1)
+	signal.Notify(drainSigs, syscall.SIGUSR2)
+	go func() {
+		for range drainSigs {
+			api.SetDraining(!api.Draining())
+			mlog.Info.Printf("Received SIGUSR2! Draining mode is %t", api.Draining())
+		}
+	}()
+
 	if httpConfig.SSL {
 		mlog.Info.Printf("Start HTTPS server %s\n", address)
-		mlog.Critical.Printf("%v+\n", srv.ListenAndServeTLS(httpConfig.CertFile, httpConfig.KeyFile))
+		certFile, keyFile := httpConfig.CertFile, httpConfig.KeyFile
+		if tlsConfig != nil && len(tlsConfig.Certificates) > 0 {
+			// The certificate is already loaded, with its OCSP response
+			certFile, keyFile = "", ""
+		}
+		err = srv.ServeTLS(limitListener(listener, httpConfig.MaxConnections), certFile, keyFile)
 	} else {
 		mlog.Info.Printf("Start HTTP server %s\n", address)
-		mlog.Critical.Printf("%v+\n", srv.ListenAndServe())
+		err = srv.Serve(limitListener(listener, httpConfig.MaxConnections))
 	}
 
+	if err == http.ErrServerClosed {
+		<-stopped
+		mlog.Info.Printf("Stop %s", strings.ToUpper(instanceName))
+		os.Exit(0)
+	}
+	mlog.Critical.Printf("%v+\n", err)
 	os.Exit(1)
 }
+
+// newFileLogger creates a rotated log file at filename, naming rotated files in
+// the timezone of the log
+func newFileLogger(filename string, appConfig configurationmanager.AppConfig) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:     filename,
+		RotationTime: int(appConfig.LogRotationTime),
+		MaxSize:      int(appConfig.MaxLogSize),
+		LocalTime:    appConfig.LogTimezone != configurationmanager.LogTimezoneUTC,
+	}
+}
+
+var (
+	// newSyslog connects to syslog. It exists so it can be mocked out by
+	// tests.
+	newSyslog = func(priority syslog.Priority, tag string) (io.Writer, error) {
+		return syslog.New(priority, tag)
+	}
+
+	// syslogFallback is written to instead of syslog when it's unavailable
+	syslogFallback io.Writer = os.Stderr
+)
+
+// setSyslogStream makes mlog write to syslog only and returns the stream.
+// When syslog is unavailable, e.g. in minimal container images, standard
+// error is written to instead.
+func setSyslogStream(mlog *logger.Logging) io.Writer {
+	stream, err := newSyslog(syslog.LOG_INFO, "")
+	if err != nil {
+		stream = syslogFallback
+	}
+	mlog.SetStreamSingle(stream)
+
+	if err != nil {
+		mlog.Warning.Printf("Cannot connect to syslog, log to standard error instead: %+v", err)
+	}
+
+	return stream
+}
+
+// logOutputStream returns the primary stream of logs selected by log_output.
+// syslogWriter is returned for syslog, unless it's nil in which case mlog is
+// connected to syslog again.
+func logOutputStream(mlog *logger.Logging, appConfig configurationmanager.AppConfig, syslogWriter io.Writer) io.Writer {
+	switch appConfig.LogOutput {
+	case configurationmanager.LogOutputStdout:
+		return os.Stdout
+	case configurationmanager.LogOutputStderr:
+		return os.Stderr
+	}
+
+	if syslogWriter == nil {
+		syslogWriter = setSyslogStream(mlog)
+	}
+
+	return syslogWriter
+}
+
+// setLogStreams makes mlog write both to primary, the stream selected by
+// log_output, and to fileStream, the log file, if it's not nil
+func setLogStreams(mlog *logger.Logging, primary io.Writer, fileStream io.Writer) {
+	streams := []io.Writer{primary}
+	if fileStream != nil {
+		streams = append(streams, fileStream)
+	}
+
+	mlog.SetStreamMulti(streams)
+}
+
+// fileLogStream returns the stream log lines are written to for file l,
+// compressing them if configured
+func fileLogStream(l *lumberjack.Logger, appConfig configurationmanager.AppConfig) io.Writer {
+	if appConfig.LogCompression {
+		return logger.NewGzipWriter(l)
+	}
+
+	return l
+}
+
+// logSummary logs the settings the server runs with in a single line. Secrets
+// such as passwords and the encryption key are never logged.
+func logSummary(mlog *logger.Logging, appConfig configurationmanager.AppConfig, httpConfig configurationmanager.HTTPConfig) {
+	usernames := make([]string, 0, len(httpConfig.Authen))
+	for _, v := range httpConfig.Authen {
+		usernames = append(usernames, v.Username)
+	}
+
+	mlog.Info.Printf("Configuration: address=%s ssl=%t file_server_directory=%s max_file_size=%dMB "+
+		"authentication=%t users=[%s] per_user_directory=%t encryption=%t log_level=%s log_timezone=%s",
+		httpConfig.Address, httpConfig.SSL, httpConfig.FileServerDirectory, httpConfig.MaxFileSize,
+		len(usernames) > 0, strings.Join(usernames, ","), httpConfig.PerUserDirectory, httpConfig.Encryption,
+		logger.LOGLEVEL[appConfig.LogLevel], appConfig.LogTimezone)
+}
+
+// serverTLSConfig returns the TLS configuration of the server: requiring
+// client certificates signed by the configured authorities, without session
+// tickets, or stapling an OCSP response to the certificate, which is then
+// loaded here. It's nil if none of them is configured, so that the defaults
+// of the http package apply.
+func serverTLSConfig(httpConfig configurationmanager.HTTPConfig) (*tls.Config, error) {
+	if !httpConfig.SSL || (!httpConfig.RequireClientCert && !httpConfig.DisableSessionTickets && httpConfig.OCSPStaple == nil) {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		SessionTicketsDisabled: httpConfig.DisableSessionTickets,
+	}
+	if httpConfig.RequireClientCert {
+		config.ClientCAs = httpConfig.ClientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if httpConfig.OCSPStaple != nil {
+		cert, err := tls.LoadX509KeyPair(httpConfig.CertFile, httpConfig.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert.OCSPStaple = httpConfig.OCSPStaple
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// newRouter returns the router of the routes of the server. Requests for a
+// path without routes are rejected with 404, and with a method the path has no
+// route for with 405.
+func newRouter(httpConfig configurationmanager.HTTPConfig) *mux.Router {
+	router := mux.NewRouter()
+
+	// Static assets and the favicon are public so they bypass authentication
+	if httpConfig.FaviconFile != "" {
+		router.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, httpConfig.FaviconFile)
+		}).Methods("GET")
+	}
+	if httpConfig.StaticDirectory != "" {
+		staticServer := api.NoDirListing(httpConfig.StaticDirectory, http.FileServer(http.Dir(httpConfig.StaticDirectory)))
+		router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", staticServer)).Methods("GET")
+	}
+
+	var fileServer http.Handler
+	if httpConfig.Encryption {
+		fileServer = api.MissingFile(httpConfig.FileServerDirectory, api.DecryptFileServer(httpConfig.FileServerDirectory))
+	} else {
+		fileServer = api.MissingFile(httpConfig.FileServerDirectory, api.FileServer(httpConfig.FileServerDirectory))
+	}
+	fileServer = api.ETag(httpConfig.FileServerDirectory, fileServer)
+
+	// Share links carry their own credential
+	router.PathPrefix("/shared/").Handler(http.StripPrefix("/shared/", api.DrainDownloads(api.Throttle(configurationmanager.RouteShared, api.SharedHandler(fileServer))))).Methods("GET")
+
+	// Load balancers and orchestrators probe readiness without credentials
+	router.HandleFunc("/ready", api.ReadyHandler).Methods("GET")
+
+	versionHandler := api.VersionHandler(version, commit, buildDate)
+	if httpConfig.VersionPublic {
+		router.Handle("/version", versionHandler).Methods("GET")
+	}
+
+	// Downloads and uploads are in subrouters of their own so that either
+	// can be served without authentication
+	downloads := router.PathPrefix("/").Subrouter()
+	downloads.Handle("/", api.TimeoutMiddleware(http.HandlerFunc(api.IndexHandler))).Methods("GET")
+	downloads.Handle("/usage", api.TimeoutMiddleware(http.HandlerFunc(api.UsageHandler))).Methods("GET")
+	downloads.Handle("/list", api.TimeoutMiddleware(http.HandlerFunc(api.ListHandler))).Methods("GET")
+	downloads.Handle("/archive", api.DrainDownloads(api.Throttle(configurationmanager.RouteArchive, http.HandlerFunc(api.ArchiveHandler)))).Methods("GET", "POST")
+	downloads.PathPrefix("/archive/").Handler(http.StripPrefix("/archive/", api.DrainDownloads(api.Throttle(configurationmanager.RouteArchive, http.HandlerFunc(api.DirectoryArchiveHandler))))).Methods("GET")
+	downloads.PathPrefix("/download/").Handler(http.StripPrefix("/download/", api.DrainDownloads(api.Throttle(configurationmanager.RouteDownload, api.Hidden("Download", api.UserScope(fileServer)))))).Methods("GET")
+	if httpConfig.RequireAuthForDownload {
+		downloads.Use(api.ValidateMiddleware)
+	}
+
+	if httpConfig.EnableUpload {
+		uploads := router.PathPrefix("/").Subrouter()
+		uploads.Handle("/upload", api.Drain(http.HandlerFunc(api.UploadHandler))).Methods("POST")
+		uploads.PathPrefix("/download/").Handler(http.StripPrefix("/download/", api.Drain(api.Hidden("Upload", http.HandlerFunc(api.UploadHandler))))).Methods("PUT")
+		if httpConfig.RequireAuthForUpload {
+			uploads.Use(api.ValidateMiddleware)
+		}
+	}
+
+	protected := router.PathPrefix("/").Subrouter()
+	if !httpConfig.VersionPublic {
+		protected.Handle("/version", versionHandler).Methods("GET")
+	}
+	protected.HandleFunc("/share", api.ShareHandler).Methods("POST")
+	protected.PathPrefix("/download/").Handler(http.StripPrefix("/download/", api.Hidden("Delete", http.HandlerFunc(api.DeleteHandler)))).Methods("DELETE")
+	protected.Handle("/admin/purge-temp", api.AdminOnly(http.HandlerFunc(api.PurgeTempHandler))).Methods("POST")
+	protected.Handle("/admin/drain", api.AdminOnly(http.HandlerFunc(api.DrainHandler))).Methods("GET", "POST", "DELETE")
+	protected.Use(api.ValidateMiddleware)
+
+	router.NotFoundHandler = http.HandlerFunc(api.NotFoundHandler)
+	router.MethodNotAllowedHandler = api.MethodNotAllowed(allowedMethods(router))
+
+	return router
+}
+
+// routeMethods are the methods which routes are registered with
+var routeMethods = []string{"GET", "POST", "PUT", "DELETE"}
+
+// allowedMethods returns a function listing the methods which router has a
+// route for at the path of a request
+func allowedMethods(router *mux.Router) func(*http.Request) []string {
+	return func(r *http.Request) []string {
+		methods := []string{}
+		for _, method := range routeMethods {
+			req := new(http.Request)
+			*req = *r
+			req.Method = method
+			var match mux.RouteMatch
+			if router.Match(req, &match) && match.MatchErr == nil {
+				methods = append(methods, method)
+			}
+		}
+
+		return methods
+	}
+}
+
+// serverHandler wraps the router with the middlewares applied to all requests,
+// before routing so that method overrides are routed by their new method.
+// Cleartext HTTP/2 is accepted too if it's enabled and TLS isn't used, since
+// HTTP/2 is negotiated automatically over TLS.
+func serverHandler(router http.Handler, httpConfig configurationmanager.HTTPConfig) http.Handler {
+	handler := api.LoggingMiddleware(api.ServerHeaderMiddleware(api.CustomHeadersMiddleware(api.IPLimitMiddleware(api.MethodOverrideMiddleware(router)))))
+	if httpConfig.H2C && !httpConfig.SSL {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	return handler
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/http2"
+
+	"github.com/anhdowastaken/fileserver-go/api"
+	"github.com/anhdowastaken/fileserver-go/configurationmanager"
+	"github.com/anhdowastaken/fileserver-go/logger"
+)
+
+func TestLogTimezone(t *testing.T) {
+	mlog := logger.New()
+	defer mlog.SetUTC(false)
+
+	for _, tz := range []string{configurationmanager.LogTimezoneLocal, configurationmanager.LogTimezoneUTC} {
+		appConfig := configurationmanager.AppConfig{LogTimezone: tz}
+		utc := tz == configurationmanager.LogTimezoneUTC
+
+		l := newFileLogger("/tmp/fileserver-go.log", appConfig)
+		if l.LocalTime == utc {
+			t.Fatalf("%s: expected rotated file names in local time to be %t", tz, !utc)
+		}
+
+		mlog.SetUTC(utc)
+		for _, lg := range []*log.Logger{mlog.Fatal, mlog.Critical, mlog.Warning, mlog.Info, mlog.Debug} {
+			if (lg.Flags()&log.LUTC != 0) != utc {
+				t.Fatalf("%s: expected log timestamps in UTC to be %t", tz, utc)
+			}
+		}
+	}
+}
+
+func TestLogSummary(t *testing.T) {
+	buf := &bytes.Buffer{}
+	mlog := logger.New()
+	mlog.SetStreamSingle(buf)
+	mlog.SetLevel(logger.INFO)
+	defer mlog.SetStreamSingle(os.Stderr)
+
+	appConfig := configurationmanager.AppConfig{LogLevel: logger.INFO, LogTimezone: configurationmanager.LogTimezoneUTC}
+	httpConfig := configurationmanager.HTTPConfig{
+		Address:             "0.0.0.0:9000",
+		FileServerDirectory: "/srv/files",
+		MaxFileSize:         10,
+		Encryption:          true,
+		EncryptionKeyHex:    "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff",
+		Authen: []configurationmanager.BasicAuthen{
+			{Username: "admin", Password: "e10adc3949ba59abbe56e057f20f883e"},
+		},
+	}
+	logSummary(mlog, appConfig, httpConfig)
+
+	output := buf.String()
+	if strings.Count(output, "\n") != 1 {
+		t.Fatalf("expected a single line, got %q", output)
+	}
+	for _, s := range []string{"address=0.0.0.0:9000", "ssl=false", "file_server_directory=/srv/files",
+		"max_file_size=10MB", "authentication=true", "users=[admin]", "encryption=true", "log_timezone=utc"} {
+		if !strings.Contains(output, s) {
+			t.Fatalf("expected %q in %q", s, output)
+		}
+	}
+	for _, secret := range []string{httpConfig.Authen[0].Password, httpConfig.EncryptionKeyHex} {
+		if strings.Contains(output, secret) {
+			t.Fatalf("secret logged in %q", output)
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		router := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%d", r.ProtoMajor)
+		})
+		srv := httptest.NewServer(serverHandler(router, configurationmanager.HTTPConfig{H2C: enabled}))
+
+		// Speak HTTP/2 from the start, without TLS
+		client := &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			},
+		}
+		resp, err := client.Get(srv.URL)
+		if !enabled {
+			if err == nil {
+				resp.Body.Close()
+				t.Fatalf("expected HTTP/2 to be refused when h2c is disabled")
+			}
+			srv.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("cannot negotiate h2c: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != "2" {
+			t.Fatalf("expected HTTP/2, got %s and %q", resp.Proto, body)
+		}
+
+		// HTTP/1.1 clients are still served
+		resp, err = http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 1 {
+			t.Fatalf("expected HTTP/1.1, got %s", resp.Proto)
+		}
+		srv.Close()
+	}
+}
+
+func TestSetLogStreams(t *testing.T) {
+	mlog := logger.New()
+	mlog.SetLevel(logger.INFO)
+	defer mlog.SetStreamSingle(os.Stderr)
+
+	syslogBuf, fileBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	setLogStreams(mlog, syslogBuf, fileBuf)
+	mlog.Info.Printf("both")
+	mlog.Debug.Printf("neither")
+
+	for name, buf := range map[string]*bytes.Buffer{"syslog": syslogBuf, "file": fileBuf} {
+		if !strings.Contains(buf.String(), "both") || strings.Contains(buf.String(), "neither") {
+			t.Fatalf("unexpected %s output %q", name, buf.String())
+		}
+	}
+
+	// Without a log file
+	syslogBuf.Reset()
+	setLogStreams(mlog, syslogBuf, nil)
+	mlog.Info.Printf("syslog only")
+	if !strings.Contains(syslogBuf.String(), "syslog only") {
+		t.Fatalf("unexpected syslog output %q", syslogBuf.String())
+	}
+}
+
+func TestSyslogUnavailable(t *testing.T) {
+	mlog := logger.New()
+	mlog.SetLevel(logger.INFO)
+	defer mlog.SetStreamSingle(os.Stderr)
+
+	defer func(f func(syslog.Priority, string) (io.Writer, error), w io.Writer) {
+		newSyslog, syslogFallback = f, w
+	}(newSyslog, syslogFallback)
+	newSyslog = func(syslog.Priority, string) (io.Writer, error) {
+		return nil, errors.New("no syslog")
+	}
+	fallback := &bytes.Buffer{}
+	syslogFallback = fallback
+
+	stream := setSyslogStream(mlog)
+	mlog.Info.Printf("still logged")
+	if stream != fallback || !strings.Contains(fallback.String(), "no syslog") || !strings.Contains(fallback.String(), "still logged") {
+		t.Fatalf("unexpected fallback output %q", fallback.String())
+	}
+
+	// The fallback is combined with the log file like syslog
+	fileBuf := &bytes.Buffer{}
+	setLogStreams(mlog, stream, fileBuf)
+	mlog.Info.Printf("both")
+	if !strings.Contains(fallback.String(), "both") || !strings.Contains(fileBuf.String(), "both") {
+		t.Fatalf("unexpected output %q and %q", fallback.String(), fileBuf.String())
+	}
+}
+
+// newCertificate returns a certificate with common name cn signed by parent,
+// or self-signed if parent is nil
+func newCertificate(cn string, parent *tls.Certificate, t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCert(t *testing.T) {
+	ca := newCertificate("test CA", nil, t)
+	alice := newCertificate("alice", &ca, t)
+	mallory := newCertificate("mallory", nil, t)
+
+	dir, err := ioutil.TempDir("", "TestClientCert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0644)
+	confFile := filepath.Join(dir, "fileserver-go.conf")
+	ioutil.WriteFile(confFile, []byte(fmt.Sprintf(`[app]
+log_level = 0
+
+[http]
+file_server_directory = %q
+ssl = true
+require_client_cert = true
+ca_file = %q
+client_cert_identity = true
+
+[[http.basic_authen]]
+username = "admin"
+password = "e10adc3949ba59abbe56e057f20f883e"
+`, dir, caFile)), 0644)
+
+	cm := configurationmanager.New()
+	if err := cm.Load(confFile); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+
+	handler := api.ValidateMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, api.Username(r))
+	}))
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS, err = serverTLSConfig(cm.GetHTTPConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(cert *tls.Certificate) (string, error) {
+		client := srv.Client()
+		transport := client.Transport.(*http.Transport)
+		transport.TLSClientConfig.Certificates = nil
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		defer transport.CloseIdleConnections()
+
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	// The common name is the identity, without Basic authentication
+	if body, err := get(&alice); err != nil || body != "alice" {
+		t.Fatalf("expected request as alice, got %q: %v", body, err)
+	}
+
+	for name, cert := range map[string]*tls.Certificate{"no certificate": nil, "untrusted certificate": &mallory} {
+		if _, err := get(cert); err == nil {
+			t.Fatalf("expected connection with %s to be refused", name)
+		}
+	}
+}
+
+// loadTestConfig loads a configuration serving dir, with extra appended to
+// the [http] table
+func loadTestConfig(dir string, extra string, t *testing.T) configurationmanager.HTTPConfig {
+	confFile := filepath.Join(dir, "fileserver-go.conf")
+	ioutil.WriteFile(confFile, []byte(fmt.Sprintf(`[app]
+log_level = 0
+
+[http]
+file_server_directory = %q
+%s
+`, dir, extra)), 0644)
+
+	cm := configurationmanager.New()
+	if err := cm.Load(confFile); err != nil {
+		t.Fatalf("cannot load config: %v", err)
+	}
+
+	return cm.GetHTTPConfig()
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMethodNotAllowed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	router := newRouter(loadTestConfig(dir, "", t))
+
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{"POST", "/", "GET"},
+		{"DELETE", "/version", "GET"},
+		{"POST", "/usage", "GET"},
+		{"PUT", "/list", "GET"},
+		{"GET", "/upload", "POST"},
+		{"GET", "/share", "POST"},
+		{"DELETE", "/archive", "GET, POST"},
+		{"POST", "/archive/dir", "GET"},
+		{"POST", "/download/a.txt", "GET, PUT, DELETE"},
+		{"GET", "/admin/purge-temp", "POST"},
+		{"PUT", "/admin/drain", "GET, POST, DELETE"},
+		{"POST", "/shared/token", "GET"},
+	}
+	for _, test := range tests {
+		for _, accept := range []string{"text/html", "application/json"} {
+			r := httptest.NewRequest(test.method, test.path, nil)
+			r.Header.Set("Accept", accept)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != test.allow {
+				t.Errorf("%s %s: expected status %d with Allow %q, got %d %q", test.method, test.path, http.StatusMethodNotAllowed, test.allow, w.Code, w.Header().Get("Allow"))
+			}
+			if !strings.HasPrefix(w.Header().Get("Content-Type"), accept) || !strings.Contains(w.Body.String(), "Method not allowed") {
+				t.Errorf("%s %s: unexpected %s response %q", test.method, test.path, accept, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNotFound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	router := newRouter(loadTestConfig(dir, "", t))
+
+	for _, path := range []string{"/missing", "/uploads", "/admin/unknown"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") ||
+			!strings.Contains(w.Body.String(), "<h4>Not found</h4>") {
+			t.Errorf("%s: expected the error page with status %d, got %d %q", path, http.StatusNotFound, w.Code, w.Body.String())
+		}
+
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept", "application/json")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"status":404`) {
+			t.Errorf("%s: expected JSON with status %d, got %d %q", path, http.StatusNotFound, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestTLSOptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := newCertificate("localhost", nil, t)
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	staple, err := ocsp.CreateResponse(cert.Leaf, cert.Leaf, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: cert.Leaf.SerialNumber,
+		ThisUpdate:   time.Now(),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}, cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, stapleFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ocsp.der")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	ioutil.WriteFile(stapleFile, staple, 0644)
+	files := fmt.Sprintf("ssl = true\ncert_file = %q\nkey_file = %q\n", certFile, keyFile)
+
+	// By default the http package configures TLS
+	config, err := serverTLSConfig(loadTestConfig(dir, files, t))
+	if err != nil || config != nil {
+		t.Fatalf("expected no TLS configuration, got %+v: %v", config, err)
+	}
+
+	config, err = serverTLSConfig(loadTestConfig(dir, files+fmt.Sprintf("disable_session_tickets = true\nocsp_staple_file = %q", stapleFile), t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.SessionTicketsDisabled || config.ClientAuth != tls.NoClientCert {
+		t.Errorf("unexpected TLS configuration %+v", config)
+	}
+	if len(config.Certificates) != 1 || !bytes.Equal(config.Certificates[0].OCSPStaple, staple) {
+		t.Fatalf("expected the certificate with its OCSP response, got %d certificates", len(config.Certificates))
+	}
+
+	// Clients get the stapled response
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = config
+	srv.StartTLS()
+	defer srv.Close()
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !bytes.Equal(conn.ConnectionState().OCSPResponse, staple) {
+		t.Error("expected the OCSP response to be stapled")
+	}
+}
+
+func TestUploadDisabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUploadDisabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("content"), 0644)
+
+	for _, enable := range []bool{false, true} {
+		router := newRouter(loadTestConfig(dir, fmt.Sprintf("enable_upload = %t", enable), t))
+
+		tests := []struct {
+			method string
+			path   string
+			status int
+		}{
+			{"POST", "/upload", http.StatusNotFound},
+			{"PUT", "/download/b.txt", http.StatusMethodNotAllowed},
+		}
+		for _, test := range tests {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader("content")))
+			if rejected := w.Code == test.status; rejected == enable {
+				t.Errorf("enable_upload = %t, %s %s: unexpected status %d", enable, test.method, test.path, w.Code)
+			}
+		}
+
+		// Downloads are still served
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/download/a.txt", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "content" {
+			t.Errorf("enable_upload = %t: unexpected download %d %q", enable, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequireAuthPerRoute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRequireAuthPerRoute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("content"), 0644)
+
+	tests := []struct {
+		method string
+		path   string
+		upload bool
+	}{
+		{"GET", "/", false},
+		{"GET", "/list", false},
+		{"GET", "/download/a.txt", false},
+		{"GET", "/archive?files=a.txt", false},
+		{"PUT", "/download/b.txt", true},
+		{"POST", "/upload", true},
+	}
+	for _, c := range []struct {
+		download bool
+		upload   bool
+	}{
+		{false, true},
+		{true, false},
+		{false, false},
+	} {
+		router := newRouter(loadTestConfig(dir, fmt.Sprintf(`require_auth_for_download = %t
+require_auth_for_upload = %t
+[[http.basic_authen]]
+username = "user"
+password = "e10adc3949ba59abbe56e057f20f883e"`, c.download, c.upload), t))
+
+		for _, test := range tests {
+			for _, authenticated := range []bool{false, true} {
+				r := httptest.NewRequest(test.method, test.path, strings.NewReader("content"))
+				if authenticated {
+					r.SetBasicAuth("user", "123456")
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+
+				required := c.download
+				if test.upload {
+					required = c.upload
+				}
+				if unauthorized := w.Code == http.StatusUnauthorized; unauthorized != (required && !authenticated) {
+					t.Errorf("%+v, %s %s, authenticated %t: unexpected status %d", c, test.method, test.path, authenticated, w.Code)
+				}
+			}
+		}
+
+		// Deleting always requires authentication
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("DELETE", "/download/a.txt", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%+v: expected status %d for anonymous delete, got %d", c, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	mlog := logger.New()
+	mlog.SetLevel(logger.INFO)
+	defer mlog.SetStreamSingle(os.Stderr)
+
+	defer func(f func(syslog.Priority, string) (io.Writer, error)) {
+		newSyslog = f
+	}(newSyslog)
+	syslogBuf := &bytes.Buffer{}
+	newSyslog = func(syslog.Priority, string) (io.Writer, error) {
+		return syslogBuf, nil
+	}
+
+	// Standard streams are replaced by pipes to capture what's logged there
+	defer func(stdout *os.File, stderr *os.File) {
+		os.Stdout, os.Stderr = stdout, stderr
+	}(os.Stdout, os.Stderr)
+	capture := func(f **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		*f = w
+		return func() string {
+			w.Close()
+			b, _ := ioutil.ReadAll(r)
+			r.Close()
+			return string(b)
+		}
+	}
+
+	for _, output := range []string{configurationmanager.LogOutputSyslog, configurationmanager.LogOutputStdout, configurationmanager.LogOutputStderr} {
+		syslogBuf.Reset()
+		stdout, stderr := capture(&os.Stdout), capture(&os.Stderr)
+
+		appConfig := configurationmanager.AppConfig{LogOutput: output}
+		fileBuf := &bytes.Buffer{}
+		setLogStreams(mlog, logOutputStream(mlog, appConfig, nil), fileBuf)
+		mlog.Info.Printf("logged to %s", output)
+
+		outputs := map[string]string{
+			configurationmanager.LogOutputSyslog: syslogBuf.String(),
+			configurationmanager.LogOutputStdout: stdout(),
+			configurationmanager.LogOutputStderr: stderr(),
+		}
+		for stream, content := range outputs {
+			if logged := strings.Contains(content, "logged to "+output); logged != (stream == output) {
+				t.Errorf("log_output = %s: unexpected %s output %q", output, stream, content)
+			}
+		}
+		if !strings.Contains(fileBuf.String(), "logged to "+output) {
+			t.Errorf("log_output = %s: unexpected file output %q", output, fileBuf.String())
+		}
+	}
+
+	// The syslog connection made before the config is loaded is kept
+	existing := &bytes.Buffer{}
+	if stream := logOutputStream(mlog, configurationmanager.AppConfig{LogOutput: configurationmanager.LogOutputSyslog}, existing); stream != existing {
+		t.Errorf("expected the existing syslog stream, got %v", stream)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !noembed
+// +build !noembed
+
+package template
+
+import "embed"
+
+// embedded holds the templates, so the binary can be deployed without the
+// template directory. Build with the noembed tag to leave them out.
+//
+//go:embed *.html
+var embedded embed.FS
+
+func init() {
+	FS = embedded
+}
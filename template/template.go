@@ -0,0 +1,7 @@
+// Package template provides the HTML templates rendered by the server
+package template
+
+import "io/fs"
+
+// FS holds the templates embedded in the binary, or is nil if they are not
+var FS fs.FS
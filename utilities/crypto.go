@@ -0,0 +1,231 @@
+package utilities
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encrypted streams are made of a random nonce followed by chunks of at most
+// encryptionChunkSize bytes of plaintext, each sealed with AES-256-GCM. The
+// nonce of a chunk is the stream nonce XORed with the chunk index, and the last
+// chunk is authenticated as such so that a truncated stream is detected.
+const encryptionChunkSize = 64 * 1024
+
+// EncryptionKeySize is the size in bytes of AES-256 keys
+const EncryptionKeySize = 32
+
+var (
+	lastChunk    = []byte{1}
+	notLastChunk = []byte{0}
+	errTruncated = errors.New("encrypted stream is truncated")
+	errClosed    = errors.New("encrypted stream is already closed")
+)
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce derives the nonce of the chunk at index from the stream nonce
+func chunkNonce(dst []byte, nonce []byte, index uint64) []byte {
+	dst = append(dst[:0], nonce...)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, index)
+	for i := range counter {
+		dst[len(dst)-8+i] ^= counter[i]
+	}
+
+	return dst
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	buf    []byte
+	out    []byte
+	tmp    []byte
+	index  uint64
+	closed bool
+}
+
+// NewEncryptWriter returns a WriteCloser which encrypts everything written to it
+// with AES-256-GCM and writes the result to w. Close must be called to flush
+// the last chunk; it doesn't close w.
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nonce); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, errClosed
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, because only then
+		// it's known not to be the last one
+		if len(ew.buf) == encryptionChunkSize {
+			if err := ew.seal(notLastChunk); err != nil {
+				return n, err
+			}
+		}
+
+		m := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+	}
+
+	return n, nil
+}
+
+func (ew *encryptWriter) seal(ad []byte) error {
+	ew.tmp = chunkNonce(ew.tmp, ew.nonce, ew.index)
+	ew.out = ew.aead.Seal(ew.out[:0], ew.tmp, ew.buf, ad)
+	ew.index++
+	ew.buf = ew.buf[:0]
+
+	_, err := ew.w.Write(ew.out)
+	return err
+}
+
+// Close seals and writes the last chunk of the stream
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return errClosed
+	}
+	ew.closed = true
+
+	return ew.seal(lastChunk)
+}
+
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	in    []byte
+	plain []byte
+	out   []byte
+	tmp   []byte
+	index uint64
+	done  bool
+	err   error
+}
+
+// NewDecryptReader returns a Reader which decrypts a stream written by
+// NewEncryptWriter. Reading fails if the stream was tampered with or truncated.
+func NewDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		if err == io.EOF {
+			err = errTruncated
+		}
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:     bufio.NewReaderSize(r, encryptionChunkSize+aead.Overhead()),
+		aead:  aead,
+		nonce: nonce,
+		in:    make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		dr.err = dr.open()
+	}
+
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) open() error {
+	n, err := io.ReadFull(dr.r, dr.in)
+	if err == io.EOF {
+		return errTruncated
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	// The chunk is the last one if nothing follows it
+	last := true
+	if err == nil {
+		if _, err := dr.r.Peek(1); err == nil {
+			last = false
+		} else if err != io.EOF {
+			return err
+		}
+	}
+
+	ad := lastChunk
+	if !last {
+		ad = notLastChunk
+	}
+
+	dr.tmp = chunkNonce(dr.tmp, dr.nonce, dr.index)
+	dr.plain, err = dr.aead.Open(dr.plain[:0], dr.tmp, dr.in[:n], ad)
+	if err != nil {
+		return err
+	}
+	dr.out = dr.plain
+	dr.index++
+	dr.done = last
+
+	return nil
+}
+
+// DecryptedSize returns the size of the plaintext of a stream of size bytes
+// written by NewEncryptWriter, or -1 if it's too short to be one
+func DecryptedSize(size int64) int64 {
+	const nonceSize, tagSize = 12, 16
+
+	size -= nonceSize
+	if size < tagSize {
+		return -1
+	}
+	chunks := (size + encryptionChunkSize + tagSize - 1) / (encryptionChunkSize + tagSize)
+
+	return size - chunks*tagSize
+}
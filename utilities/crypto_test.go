@@ -0,0 +1,122 @@
+package utilities
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func encrypt(plaintext []byte, key []byte, t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	ew, err := NewEncryptWriter(buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write in odd sized pieces to exercise chunk boundaries
+	for len(plaintext) > 0 {
+		n := 1000
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		if _, err := ew.Write(plaintext[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plaintext = plaintext[n:]
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func decrypt(ciphertext []byte, key []byte) ([]byte, error) {
+	dr, err := NewDecryptReader(bytes.NewReader(ciphertext), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(dr)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := make([]byte, EncryptionKeySize)
+	rand.Read(key)
+
+	sizes := []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 5}
+	for _, size := range sizes {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext := encrypt(plaintext, key, t)
+		// Short plaintexts can appear in random ciphertext by chance
+		if size >= 16 && bytes.Contains(ciphertext, plaintext) {
+			t.Fatalf("ciphertext contains plaintext for size %d", size)
+		}
+
+		decrypted, err := decrypt(ciphertext, key)
+		if err != nil {
+			t.Fatalf("cannot decrypt %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("round trip of %d bytes doesn't match", size)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	key := make([]byte, EncryptionKeySize)
+	other := make([]byte, EncryptionKeySize)
+	other[0] = 1
+
+	ciphertext := encrypt([]byte("secret"), key, t)
+	if _, err := decrypt(ciphertext, other); err == nil {
+		t.Fatal("expected decryption with wrong key to fail")
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := make([]byte, EncryptionKeySize)
+	ciphertext := encrypt([]byte("secret"), key, t)
+	ciphertext[len(ciphertext)-1] ^= 1
+
+	if _, err := decrypt(ciphertext, key); err == nil {
+		t.Fatal("expected decryption of tampered stream to fail")
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	key := make([]byte, EncryptionKeySize)
+	plaintext := make([]byte, 2*encryptionChunkSize+10)
+	ciphertext := encrypt(plaintext, key, t)
+
+	// Drop the last chunk: what remains is a valid sequence of chunks which
+	// must not be accepted as a complete stream
+	overhead := 16
+	truncated := ciphertext[:len(ciphertext)-(10+overhead)]
+	if _, err := decrypt(truncated, key); err == nil {
+		t.Fatal("expected decryption of truncated stream to fail")
+	}
+
+	if _, err := decrypt(ciphertext[:5], key); err == nil {
+		t.Fatal("expected decryption of stream without nonce to fail")
+	}
+}
+
+func TestDecryptedSize(t *testing.T) {
+	key := make([]byte, EncryptionKeySize)
+	rand.Read(key)
+
+	sizes := []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 2 * encryptionChunkSize, 3*encryptionChunkSize + 5}
+	for _, size := range sizes {
+		ciphertext := encrypt(make([]byte, size), key, t)
+		if n := DecryptedSize(int64(len(ciphertext))); n != int64(size) {
+			t.Errorf("expected size %d, got %d", size, n)
+		}
+	}
+
+	if n := DecryptedSize(12); n != -1 {
+		t.Errorf("expected -1 for a truncated stream, got %d", n)
+	}
+}
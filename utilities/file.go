@@ -0,0 +1,146 @@
+package utilities
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// rename exists so it can be mocked out by tests
+	rename = os.Rename
+
+	// write exists so it can be mocked out by tests
+	write = func(w io.Writer, data []byte) (int, error) {
+		return w.Write(data)
+	}
+)
+
+// WriteFileAtomic writes data to file path like ioutil.WriteFile, except that
+// path is never left partially written. data is written to a temporary file in
+// the same directory which is then renamed to path, so path has either its
+// previous or its new content, even if the process crashes. The temporary file
+// is named .<name>.<uuid>.tmp like the temporary files of uploads, so that it's
+// hidden and purged like them.
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%s.tmp", filepath.Base(path), uuid.New().String()))
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = write(f, data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = rename(f.Name(), path)
+	}
+
+	return err
+}
+
+// MoveFile moves file src to dst, replacing dst if it exists. When src and dst
+// are on different filesystems, which rename doesn't support, src is copied to
+// dst then removed.
+func MoveFile(src string, dst string) error {
+	err := rename(src, dst)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	err = copyFile(src, dst)
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// copyFile copies the content and permission of file src to dst and flushes
+// dst to stable storage
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// The permission is only applied by OpenFile if dst doesn't exist yet
+	err = out.Chmod(info.Mode().Perm())
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+
+	return err
+}
+
+// UniqueFilename returns name if no file named name exists in dir, otherwise
+// the first of "stem(1).ext", "stem(2).ext" and so on which doesn't exist. A
+// leading dot, as in ".profile", isn't taken for an extension. Callers must
+// serialize the creation of files if they race for names.
+func UniqueFilename(dir string, name string) (string, error) {
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; ; i++ {
+		_, err := os.Lstat(filepath.Join(dir, candidate))
+		if os.IsNotExist(err) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s(%d)%s", stem, i, ext)
+	}
+}
+
+// statfs exists so it can be mocked out by tests
+var statfs = syscall.Statfs
+
+// DiskUsage returns the total and available sizes in bytes of the filesystem
+// containing path. Available is what unprivileged users can use.
+func DiskUsage(path string) (total uint64, available uint64, err error) {
+	var st syscall.Statfs_t
+	err = statfs(path, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return st.Blocks * uint64(st.Bsize), st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,185 @@
+package utilities
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMoveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMoveFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	crossDevice := func(oldpath string, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	defer func() {
+		rename = os.Rename
+	}()
+
+	for _, r := range []func(string, string) error{os.Rename, crossDevice} {
+		rename = r
+
+		src := filepath.Join(dir, "src")
+		dst := filepath.Join(dir, "dst")
+		if err := ioutil.WriteFile(src, []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// dst is replaced
+		if err := ioutil.WriteFile(dst, []byte("old content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := MoveFile(src, dst); err != nil {
+			t.Fatalf("cannot move file: %v", err)
+		}
+		if _, err := os.Stat(src); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", src, err)
+		}
+		content, err := ioutil.ReadFile(dst)
+		if err != nil || string(content) != "content" {
+			t.Fatalf("unexpected content %q, %v", content, err)
+		}
+		info, _ := os.Stat(dst)
+		if info.Mode().Perm() != 0600 {
+			t.Fatalf("expected permission 0600, got %o", info.Mode().Perm())
+		}
+	}
+}
+
+func TestMoveFileError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMoveFileError")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := MoveFile(filepath.Join(dir, "missing"), filepath.Join(dir, "dst")); err == nil {
+		t.Fatalf("expected moving a missing file to fail")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWriteFileAtomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index.json")
+	if err := WriteFileAtomic(path, []byte("old content"), 0640); err != nil {
+		t.Fatalf("cannot write file: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0640 {
+		t.Fatalf("expected permission 0640, got %o", info.Mode().Perm())
+	}
+
+	// Fail in the middle of the write, then when moving the file in place
+	defer func() {
+		write = func(w io.Writer, data []byte) (int, error) {
+			return w.Write(data)
+		}
+		rename = os.Rename
+	}()
+	write = func(w io.Writer, data []byte) (int, error) {
+		n, _ := w.Write(data[:len(data)/2])
+		return n, errors.New("no space left on device")
+	}
+	if err := WriteFileAtomic(path, []byte("new content"), 0640); err == nil {
+		t.Fatalf("expected failing write to fail")
+	}
+	write = func(w io.Writer, data []byte) (int, error) {
+		return w.Write(data)
+	}
+	rename = func(string, string) error {
+		return errors.New("rename failed")
+	}
+	if err := WriteFileAtomic(path, []byte("new content"), 0640); err == nil {
+		t.Fatalf("expected failing rename to fail")
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != "old content" {
+		t.Fatalf("expected previous content to be kept, got %q, %v", content, err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected temporary files to be removed, got %d files", len(files))
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	defer func() {
+		statfs = syscall.Statfs
+	}()
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		st.Bsize = 4096
+		st.Blocks = 1000
+		st.Bfree = 500
+		st.Bavail = 400
+		return nil
+	}
+
+	total, available, err := DiskUsage("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4096000 || available != 1638400 {
+		t.Fatalf("unexpected usage %d/%d", available, total)
+	}
+}
+
+func TestUniqueFilename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestUniqueFilename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each name is created once found, so collisions pile up
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"report.pdf", "report(1).pdf"},
+		{"report.pdf", "report(2).pdf"},
+		{"report(1).pdf", "report(1)(1).pdf"},
+		{"notes", "notes"},
+		{"notes", "notes(1)"},
+		{".profile", ".profile"},
+		{".profile", ".profile(1)"},
+		{"archive.tar.gz", "archive.tar.gz"},
+		{"archive.tar.gz", "archive.tar(1).gz"},
+	} {
+		name, err := UniqueFilename(dir, test.name)
+		if err != nil || name != test.expected {
+			t.Fatalf("%s: expected %s, got %s: %v", test.name, test.expected, name, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Directories and dangling symlinks take names too
+	os.Mkdir(filepath.Join(dir, "dir"), 0755)
+	os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "link"))
+	for name, expected := range map[string]string{"dir": "dir(1)", "link": "link(1)"} {
+		if unique, err := UniqueFilename(dir, name); err != nil || unique != expected {
+			t.Errorf("%s: expected %s, got %s: %v", name, expected, unique, err)
+		}
+	}
+
+	// Errors other than a missing file are returned
+	if _, err := UniqueFilename(filepath.Join(dir, "report.pdf"), "a"); err == nil {
+		t.Error("expected an error in a file which isn't a directory")
+	}
+}
@@ -0,0 +1,115 @@
+package utilities
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// VerifyPassword reports whether password matches hash. Supported hashes are
+// the ones produced by Apache's htpasswd (bcrypt, MD5-crypt "$apr1$" and
+// "$1$", SHA-1 "{SHA}") and the hex MD5 hashes used in the config file.
+func VerifyPassword(hash string, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		magic := hash[:strings.Index(hash[1:], "$")+2]
+		salt := strings.TrimPrefix(hash, magic)
+		if i := strings.Index(salt, "$"); i >= 0 {
+			salt = salt[:i]
+		}
+		return constantTimeEqual(MD5Crypt(password, salt, magic), hash)
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return constantTimeEqual("{SHA}"+base64.StdEncoding.EncodeToString(sum[:]), hash)
+	}
+
+	return constantTimeEqual(StringToMD5String(password), strings.ToLower(hash))
+}
+
+func constantTimeEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// MD5Crypt hashes password with the MD5-crypt algorithm used by htpasswd -m
+// (magic "$apr1$") and crypt(3) (magic "$1$")
+func MD5Crypt(password string, salt string, magic string) string {
+	pw := []byte(password)
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	d := md5.New()
+	d.Write(pw)
+	d.Write([]byte(magic))
+	d.Write([]byte(salt))
+
+	d2 := md5.New()
+	d2.Write(pw)
+	d2.Write([]byte(salt))
+	d2.Write(pw)
+	mixin := d2.Sum(nil)
+
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(mixin)
+		} else {
+			d.Write(mixin[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(pw[:1])
+		}
+	}
+	final := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d2 := md5.New()
+		if i&1 != 0 {
+			d2.Write(pw)
+		} else {
+			d2.Write(final)
+		}
+		if i%3 != 0 {
+			d2.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			d2.Write(pw)
+		}
+		if i&1 != 0 {
+			d2.Write(final)
+		} else {
+			d2.Write(pw)
+		}
+		final = d2.Sum(nil)
+	}
+
+	result := []byte(magic + salt + "$")
+	encode := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for i := 0; i < n; i++ {
+			result = append(result, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	encode(final[0], final[6], final[12], 4)
+	encode(final[1], final[7], final[13], 4)
+	encode(final[2], final[8], final[14], 4)
+	encode(final[3], final[9], final[15], 4)
+	encode(final[4], final[10], final[5], 4)
+	encode(0, 0, final[11], 2)
+
+	return string(result)
+}
@@ -0,0 +1,40 @@
+package utilities
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMD5Crypt(t *testing.T) {
+	// Generated with openssl passwd -apr1 and openssl passwd -1
+	if got := MD5Crypt("secret", "saltsalt", "$apr1$"); got != "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0" {
+		t.Fatalf("unexpected apr1 hash %s", got)
+	}
+	if got := MD5Crypt("secret", "saltsalt", "$1$"); got != "$1$saltsalt$9xy1btjgzLYfb7hivXtC//" {
+		t.Fatalf("unexpected MD5-crypt hash %s", got)
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := []string{
+		string(bcryptHash),
+		"$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0",
+		"$1$saltsalt$9xy1btjgzLYfb7hivXtC//",
+		"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"5ebe2294ecd0e0f08eab7690d2a6ee69",
+	}
+	for _, hash := range hashes {
+		if !VerifyPassword(hash, "secret") {
+			t.Fatalf("expected password to match %s", hash)
+		}
+		if VerifyPassword(hash, "wrong") {
+			t.Fatalf("expected wrong password not to match %s", hash)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package utilities
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidToken is returned by VerifyToken for malformed tokens and tokens
+// whose signature doesn't match
+var ErrInvalidToken = errors.New("token is invalid")
+
+// SignToken returns a URL-safe token made of payload and its HMAC-SHA256
+// signature with key. The payload is encoded, not encrypted, so it must not
+// contain secrets.
+func SignToken(payload []byte, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyToken checks the signature of a token made by SignToken with key and
+// returns its payload
+func VerifyToken(token string, key []byte) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidToken
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,34 @@
+package utilities
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToken(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	token := SignToken([]byte(`{"f":"a.txt"}`), key)
+
+	payload, err := VerifyToken(token, key)
+	if err != nil || string(payload) != `{"f":"a.txt"}` {
+		t.Fatalf("unexpected payload %q: %v", payload, err)
+	}
+
+	tampered := SignToken([]byte(`{"f":"b.txt"}`), key)
+	tampered = tampered[:strings.Index(tampered, ".")] + token[strings.Index(token, "."):]
+	for _, invalid := range []string{
+		"",
+		"abc",
+		token + ".abc",
+		tampered,
+		"!!!" + token,
+	} {
+		if _, err := VerifyToken(invalid, key); err != ErrInvalidToken {
+			t.Fatalf("expected %q to be invalid, got %v", invalid, err)
+		}
+	}
+
+	if _, err := VerifyToken(token, []byte("another key")); err != ErrInvalidToken {
+		t.Fatalf("expected token to be invalid with another key, got %v", err)
+	}
+}
@@ -2,8 +2,20 @@ package utilities
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // BytesToMD5Bytes returns MD5 hash bytes of a byte array
@@ -34,9 +46,123 @@ func StringToMD5String(text string) string {
 	return hex.EncodeToString(algorithm.Sum(nil))
 }
 
+// HashingReader reads from another reader while computing the MD5 and SHA-256
+// hashes of what is read, e.g. to hash an upload on its way to disk
+type HashingReader struct {
+	r      io.Reader
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+// NewHashingReader returns a HashingReader reading from r
+func NewHashingReader(r io.Reader) *HashingReader {
+	return &HashingReader{r: r, md5: md5.New(), sha256: sha256.New()}
+}
+
+func (h *HashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.md5.Write(p[:n])
+	h.sha256.Write(p[:n])
+
+	return n, err
+}
+
+// MD5 returns the MD5 hash of the bytes read so far, which is the hash of the
+// whole stream once it's read to the end
+func (h *HashingReader) MD5() []byte {
+	return h.md5.Sum(nil)
+}
+
+// SHA256 returns the SHA-256 hash of the bytes read so far, which is the hash
+// of the whole stream once it's read to the end
+func (h *HashingReader) SHA256() []byte {
+	return h.sha256.Sum(nil)
+}
+
 func SanitizeFilename(filename string) string {
 	// https://en.wikipedia.org/wiki/Filename#Reserved_characters_and_words
 	rep := regexp.MustCompile(`[\x5C\x2F\x3F\x25\x2A\x3A\x7C\x22\x3E\x3C\x20]`)
 
 	return rep.ReplaceAllString(filename, "_")
 }
+
+// ASCIIFilename transliterates filename to ASCII: accents are dropped, e.g.
+// "résumé.pdf" gives "resume.pdf", and other non-ASCII characters are replaced
+// with underscores like reserved characters are by SanitizeFilename
+func ASCIIFilename(filename string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(filename) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+// TruncateFilename shortens filename so that it is at most maxBytes bytes long.
+// The extension is kept when possible and multi-byte characters are never cut
+// in the middle.
+func TruncateFilename(filename string, maxBytes int) string {
+	if len(filename) <= maxBytes {
+		return filename
+	}
+	if maxBytes <= 0 {
+		return ""
+	}
+
+	ext := filepath.Ext(filename)
+	if len(ext) >= maxBytes {
+		ext = ""
+	}
+
+	base := filename[:len(filename)-len(ext)]
+	limit := maxBytes - len(ext)
+	for limit > 0 && !utf8.RuneStart(base[limit]) {
+		limit--
+	}
+
+	return base[:limit] + ext
+}
+
+// sizeUnits are the suffixes accepted by ParseSize with their multiplier.
+// Units are binary, like max_file_size which is in MB of 1024*1024 bytes.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes such as "512", "5MB" or "1.5 GB". Suffixes
+// are case-insensitive and KB, MB, GB and TB are powers of 1024.
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(n) || n < 0 || n*multiplier > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return int64(n * multiplier), nil
+}
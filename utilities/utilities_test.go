@@ -0,0 +1,125 @@
+package utilities
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+)
+
+func TestASCIIFilename(t *testing.T) {
+	for name, expected := range map[string]string{
+		"report.pdf":   "report.pdf",
+		"Résumé.PDF":   "Resume.PDF",
+		"naïve_façade": "naive_facade",
+		"日本.txt":       "__.txt",
+	} {
+		if got := ASCIIFilename(name); got != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, got)
+		}
+	}
+}
+
+func TestTruncateFilenameShort(t *testing.T) {
+	if got := TruncateFilename("report.pdf", 255); got != "report.pdf" {
+		t.Fatalf("expected name to be unchanged, got %q", got)
+	}
+}
+
+func TestTruncateFilenameKeepsExtension(t *testing.T) {
+	name := strings.Repeat("a", 300) + ".pdf"
+	got := TruncateFilename(name, 255)
+	if len(got) != 255 {
+		t.Fatalf("expected 255 bytes, got %d", len(got))
+	}
+	if !strings.HasSuffix(got, ".pdf") {
+		t.Fatalf("expected extension to be kept, got %q", got)
+	}
+}
+
+func TestTruncateFilenameMultiByte(t *testing.T) {
+	// "é" is 2 bytes, so 127 of them plus ".txt" is 258 bytes but only 131 runes
+	name := strings.Repeat("é", 127) + ".txt"
+	if len(name) <= 255 || utf8.RuneCountInString(name) > 255 {
+		t.Fatalf("test name should exceed the limit in bytes only")
+	}
+
+	got := TruncateFilename(name, 255)
+	if len(got) > 255 {
+		t.Fatalf("expected at most 255 bytes, got %d", len(got))
+	}
+	if !utf8.ValidString(got) {
+		t.Fatalf("truncated name is not valid UTF-8: %q", got)
+	}
+	if got != strings.Repeat("é", 125)+".txt" {
+		t.Fatalf("unexpected truncated name %q", got)
+	}
+}
+
+func TestTruncateFilenameBoundary(t *testing.T) {
+	// "日" is 3 bytes: 84 of them is exactly 252 bytes, plus ".txt" is 256
+	name := strings.Repeat("日", 84) + ".txt"
+	got := TruncateFilename(name, 256)
+	if got != name {
+		t.Fatalf("name at the limit should be unchanged, got %q", got)
+	}
+
+	got = TruncateFilename(name, 255)
+	if got != strings.Repeat("日", 83)+".txt" {
+		t.Fatalf("unexpected truncated name %q (%d bytes)", got, len(got))
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"0":      0,
+		"512":    512,
+		"512B":   512,
+		"1KB":    1024,
+		"5MB":    5 * 1024 * 1024,
+		"5mb":    5 * 1024 * 1024,
+		" 2 GB ": 2 * 1024 * 1024 * 1024,
+		"1.5G":   3 * 512 * 1024 * 1024,
+		"1TB":    1 << 40,
+		"10M":    10 * 1024 * 1024,
+	} {
+		n, err := ParseSize(s)
+		if err != nil || n != expected {
+			t.Fatalf("expected %q to be %d, got %d: %v", s, expected, n, err)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "-1MB", "5XB", "1e30TB", "NaN", "Inf", "five"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Fatalf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestHashingReader(t *testing.T) {
+	content := "The quick brown fox jumps over the lazy dog"
+	h := NewHashingReader(strings.NewReader(content))
+
+	// Small reads hash the same as the whole content at once
+	read, err := ioutil.ReadAll(iotest.OneByteReader(h))
+	if err != nil || string(read) != content {
+		t.Fatalf("expected content to be read unchanged, got %q: %v", read, err)
+	}
+	if sum := hex.EncodeToString(h.MD5()); sum != "9e107d9d372bb6826bd81d3542a419d6" {
+		t.Errorf("unexpected MD5 %s", sum)
+	}
+	if sum := hex.EncodeToString(h.SHA256()); sum != "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592" {
+		t.Errorf("unexpected SHA-256 %s", sum)
+	}
+	if sum := hex.EncodeToString(h.MD5()); sum != StringToMD5String(content) {
+		t.Errorf("MD5 %s differs from StringToMD5String", sum)
+	}
+
+	empty := NewHashingReader(strings.NewReader(""))
+	ioutil.ReadAll(empty)
+	if sum := hex.EncodeToString(empty.SHA256()); sum != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("unexpected SHA-256 of empty content %s", sum)
+	}
+}